@@ -8,9 +8,11 @@ import (
 	"ivanjabrony/cloud-test/internal/logger"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
@@ -29,40 +31,113 @@ func main() {
 
 	logger := logger.New(cfg.Env, cfg.LogFormat)
 	global := balancer.NewPool(logger, cfg)
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	// background routines live until the balancer shuts down
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// reload re-reads config file and applies it to the pool, invalid config is rejected and the old one is kept
+	reloadChan := make(chan string, 1)
+	reload := func(reason string) {
+		newCfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			logger.Error("Config reload failed, keeping current config", slog.String("reason", reason), slog.Any("error", err))
+			return
+		}
+
+		logger.Info("Reloading config", slog.String("reason", reason))
+		global.Apply(newCfg)
+	}
 
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: http.HandlerFunc(balancer.LoadBalancer(logger, cfg, global)),
+		Handler: http.HandlerFunc(balancer.LoadBalancer(logger, global)),
 	}
 
-	go balancer.HealthCheckRoutine(ctx, logger, cfg, global)
+	var adminServer *http.Server
+	if cfg.AdminPort != 0 {
+		adminServer = &http.Server{
+			Addr:    net.JoinHostPort(cfg.AdminHost, strconv.Itoa(cfg.AdminPort)),
+			Handler: balancer.AdminHandler(logger, global),
+		}
+	}
+
+	var metricsServer *http.Server
+	if cfg.Metrics.Port != 0 {
+		metricsServer = &http.Server{
+			Addr:    net.JoinHostPort(cfg.Metrics.Host, strconv.Itoa(cfg.Metrics.Port)),
+			Handler: balancer.MetricsHandler(global),
+		}
+	}
 
-	serverErr := make(chan error, 1)
+	go balancer.HealthCheckRoutine(ctx, logger, global)
+	go balancer.OutlierDetectionRoutine(ctx, logger, global)
+	if cfg.WatchInterval > 0 {
+		go config.WatchConfig(ctx, configPath, cfg.WatchInterval, func() {
+			select {
+			case reloadChan <- "file changed":
+			default:
+				// reload is already pending
+			}
+		})
+	}
+
+	serverErr := make(chan error, 3)
 	go func() {
 		logger.Info("Load Balancer started at :%d", slog.Int("port", cfg.Port))
 		serverErr <- server.ListenAndServe()
 	}()
+	if adminServer != nil {
+		go func() {
+			logger.Info("Admin API started", slog.String("address", adminServer.Addr))
+			serverErr <- adminServer.ListenAndServe()
+		}()
+	}
+	if metricsServer != nil {
+		go func() {
+			logger.Info("Metrics server started", slog.String("address", metricsServer.Addr))
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
 
-	select {
-	case sig := <-sigChan:
-		logger.Info("Received signal, shutting down...", slog.String("signal", sig.String()))
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reload(sig.String())
+				continue
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
-		defer cancel()
+			logger.Info("Received signal, shutting down...", slog.String("signal", sig.String()))
 
-		if err := server.Shutdown(ctx); err != nil {
-			logger.Error("Server shutdown error", slog.Any("error", err))
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), global.Config().ShutdownTimeout)
+			defer cancel()
+
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Error("Server shutdown error", slog.Any("error", err))
+			}
+			if adminServer != nil {
+				if err := adminServer.Shutdown(ctx); err != nil {
+					logger.Error("Admin server shutdown error", slog.Any("error", err))
+				}
+			}
+			if metricsServer != nil {
+				if err := metricsServer.Shutdown(ctx); err != nil {
+					logger.Error("Metrics server shutdown error", slog.Any("error", err))
+				}
+			}
 
-		logger.Info("Server stopped")
+			logger.Info("Server stopped")
+			return
 
-	case err := <-serverErr:
-		logger.Error("Server failed", slog.Any("error", err))
-		os.Exit(1)
+		case reason := <-reloadChan:
+			reload(reason)
+
+		case err := <-serverErr:
+			logger.Error("Server failed", slog.Any("error", err))
+			os.Exit(1)
+		}
 	}
 }
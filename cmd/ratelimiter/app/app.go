@@ -7,7 +7,6 @@ import (
 	"ivanjabrony/cloud-test/internal/logger"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"ivanjabrony/cloud-test/internal/ratelimit/controller/router"
-	"ivanjabrony/cloud-test/internal/ratelimit/storage"
 	"log/slog"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
@@ -15,10 +14,10 @@ import (
 )
 
 type Application struct {
-	cfg     *config.Config
-	l       *logger.MyLogger
-	router  *router.RLRouter
-	storage *storage.BucketStorage
+	cfg    *config.Config
+	l      *logger.MyLogger
+	router *router.RLRouter
+	stop   func(ctx context.Context)
 }
 
 func NewApplication(cfg *config.Config, logger *logger.MyLogger) (*Application, func(), error) {
@@ -37,18 +36,18 @@ func NewApplication(cfg *config.Config, logger *logger.MyLogger) (*Application,
 		return nil, nil, errors.New("couldn't apply database migrations")
 	}
 
-	handlers, storage, err := InitBackend(pool, cfg, logger)
+	handlers, stopBackend, err := InitBackend(pool, cfg, logger)
 	if err != nil {
 		return nil, closeDB, err
 	}
 
-	router := router.NewRouter(cfg, logger, handlers.Config, handlers.Ratelimit)
+	router := router.NewRouter(cfg, logger, handlers.Config, handlers.Ratelimit, handlers.Metrics)
 
 	app := Application{
-		cfg:     cfg,
-		l:       logger,
-		router:  router,
-		storage: storage,
+		cfg:    cfg,
+		l:      logger,
+		router: router,
+		stop:   stopBackend,
 	}
 
 	return &app, closeDB, nil
@@ -73,6 +72,6 @@ func (app *Application) Stop(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	app.storage.Stop(ctx)
+	app.stop(ctx)
 	return nil
 }
@@ -1,57 +1,92 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"ivanjabrony/cloud-test/internal/logger"
 	"ivanjabrony/cloud-test/internal/ratelimit"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"ivanjabrony/cloud-test/internal/ratelimit/controller/handler"
+	"ivanjabrony/cloud-test/internal/ratelimit/identity"
+	"ivanjabrony/cloud-test/internal/ratelimit/metrics"
+	"ivanjabrony/cloud-test/internal/ratelimit/redislimiter"
 	"ivanjabrony/cloud-test/internal/ratelimit/repository"
 	"ivanjabrony/cloud-test/internal/ratelimit/service"
 	"ivanjabrony/cloud-test/internal/ratelimit/storage"
+	"log/slog"
+	"net/http"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 )
 
-func InitBackend(pool *pgxpool.Pool, cfg *config.Config, logger *logger.MyLogger) (*Handlers, *storage.BucketStorage, error) {
+// BucketStorage is an in-memory storage of buckets, implementation is chosen in config
+type BucketStorage interface {
+	LoadOrStore(ctx context.Context, key string, bucket ratelimit.Limiter) (actual ratelimit.Limiter, loaded bool)
+	StorePinned(ctx context.Context, key string, bucket ratelimit.Limiter)
+	Load(ctx context.Context, key string) (bucket ratelimit.Limiter, ok bool)
+	Len() int
+	Evictions() (idle, capacity uint64)
+	Stop(ctx context.Context)
+}
+
+// RateLimiter checks limits of clients and applies their configs
+type RateLimiter interface {
+	handler.RateLimiter
+	service.RateLimiter
+}
+
+// InitBackend wires storages, repositories, services and handlers together.
+// Returned func releases resources of the backend
+func InitBackend(pool *pgxpool.Pool, cfg *config.Config, logger *logger.MyLogger) (*Handlers, func(ctx context.Context), error) {
 	if pool == nil || cfg == nil || logger == nil {
 		return nil, nil, errors.New("nil values in init constructor")
 	}
 
-	storage, err := initStorages()
+	storage, err := initStorages(cfg, logger)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	repository, err := initRepositories(pool, logger)
-	if err != nil {
-		return nil, nil, err
+	storage.Concurrency = ratelimit.NewConcurrencyLimiter(cfg.UserConfig.MaxInFlight, cfg.Concurrency.MaxQueue, cfg.Concurrency.QueueTimeout)
+	if a := cfg.AdaptiveConcurrency; a.Enabled {
+		storage.Adaptive = ratelimit.NewAdaptiveLimiter(a.InitialLimit, a.MinLimit, a.MaxLimit, a.Tolerance)
 	}
 
-	services, err := initServices(repository, storage, cfg, logger)
+	metrics := initMetrics(pool, storage, cfg)
+
+	repository, err := initRepositories(pool, metrics, logger)
 	if err != nil {
+		storage.stop(context.Background())
 		return nil, nil, err
 	}
 
-	ratelimiter, err := initRatelimiter(storage, cfg, logger)
+	services, err := initServices(repository, storage, cfg, logger)
 	if err != nil {
+		storage.stop(context.Background())
 		return nil, nil, err
 	}
 
-	handlers, err := initHandlers(services, ratelimiter, cfg, logger)
+	handlers, err := initHandlers(services, storage, metrics, cfg, logger)
 	if err != nil {
+		storage.stop(context.Background())
 		return nil, nil, err
 	}
 
-	return handlers, storage.BucketStorage, nil
+	return handlers, storage.stop, nil
 }
 
+// storages holds a rate limiter with storage of its buckets and a limiter of requests in flight.
+// BucketStorage is nil if buckets are not kept in memory
 type storages struct {
-	BucketStorage *storage.BucketStorage
+	BucketStorage BucketStorage
+	RateLimiter   RateLimiter
+	Concurrency   *ratelimit.ConcurrencyLimiter
+	Adaptive      *ratelimit.AdaptiveLimiter // nil if adaptive concurrency limit is disabled
+	stop          func(ctx context.Context)
 }
 
 type repositories struct {
-	configRepo *repository.ConfigRepository
+	configRepo *repository.InstrumentedRepository
 }
 
 type services struct {
@@ -61,24 +96,100 @@ type services struct {
 type Handlers struct {
 	Config    *handler.ConfigHandler
 	Ratelimit *handler.RateLimitHandler
+	Metrics   http.Handler
 }
 
-func initStorages() (*storages, error) {
-	storage := storage.NewBucketStorage()
-	return &storages{storage}, nil
+func initStorages(cfg *config.Config, logger *logger.MyLogger) (*storages, error) {
+	if cfg.BucketStorage.Type == config.StorageRedis {
+		return initRedisStorage(cfg, logger)
+	}
+
+	var bucketStorage BucketStorage
+	c := cfg.BucketStorage
+	switch c.Type {
+	case config.StorageSharded:
+		bucketStorage = storage.NewShardedBucketStorage(c.Shards, c.IdleTTL, c.CleanupInterval, c.MaxBuckets)
+	case config.StorageSyncMap:
+		bucketStorage = storage.NewSyncMapBucketStorage(c.IdleTTL, c.CleanupInterval, c.MaxBuckets)
+	default:
+		bucketStorage = storage.NewBucketStorage(c.IdleTTL, c.CleanupInterval, c.MaxBuckets)
+	}
+
+	ratelimiter, err := ratelimit.NewRateLimiter(bucketStorage, cfg.UserConfig.Tokens, cfg.UserConfig.RatePerSec, cfg.UserConfig.Algorithm)
+	if err != nil {
+		bucketStorage.Stop(context.Background())
+		return nil, err
+	}
+
+	return &storages{bucketStorage, ratelimiter, nil, nil, bucketStorage.Stop}, nil
 }
 
-func initRepositories(pool *pgxpool.Pool, logger *logger.MyLogger) (*repositories, error) {
+func initRedisStorage(cfg *config.Config, logger *logger.MyLogger) (*storages, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:         cfg.Redis.Addr,
+		Password:     cfg.Redis.Password,
+		DB:           cfg.Redis.DB,
+		ReadTimeout:  cfg.Redis.Timeout,
+		WriteTimeout: cfg.Redis.Timeout,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RepositoryTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		logger.Error("Couldn't connect to redis", slog.String("addr", cfg.Redis.Addr), slog.Any("error", err))
+		return nil, errors.New("couldn't connect to redis")
+	}
+
+	if cfg.Shaping.Enabled {
+		logger.Warn("Redis bucket storage doesn't support shaping, requests over the limit are rejected")
+	}
+
+	ratelimiter, err := redislimiter.NewRateLimiter(client, cfg.Redis.KeyPrefix, cfg.UserConfig.Tokens, cfg.UserConfig.RatePerSec, logger)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	stop := func(ctx context.Context) {
+		if err := ratelimiter.Close(); err != nil {
+			logger.Error("Error while closing redis client", slog.Any("error", err))
+		}
+	}
+	return &storages{nil, ratelimiter, nil, nil, stop}, nil
+}
+
+func initMetrics(pool *pgxpool.Pool, storage *storages, cfg *config.Config) *metrics.Metrics {
+	m := metrics.New(cfg.Metrics)
+	if storage.BucketStorage != nil {
+		m.RegisterBuckets(storage.BucketStorage.Len)
+		m.RegisterEvictions(storage.BucketStorage.Evictions)
+	}
+	m.RegisterInFlight(storage.Concurrency.InFlight)
+	if storage.Adaptive != nil {
+		m.RegisterAdaptive(storage.Adaptive.Limit, storage.Adaptive.InFlight)
+	}
+	m.Register(metrics.NewPoolCollector(pool))
+
+	return m
+}
+
+func initRepositories(pool *pgxpool.Pool, metrics *metrics.Metrics, logger *logger.MyLogger) (*repositories, error) {
 	repo, err := repository.NewConfigRepository(pool, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	return &repositories{repo}, nil
+	instrumented, err := repository.NewInstrumentedRepository(repo, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repositories{instrumented}, nil
 }
 
 func initServices(repo *repositories, storage *storages, cfg *config.Config, logger *logger.MyLogger) (*services, error) {
-	service, err := service.NewService(cfg, logger, repo.configRepo, storage.BucketStorage)
+	service, err := service.NewService(cfg, logger, repo.configRepo, storage.RateLimiter, storage.Concurrency)
 	if err != nil {
 		return nil, err
 	}
@@ -86,24 +197,25 @@ func initServices(repo *repositories, storage *storages, cfg *config.Config, log
 	return &services{service}, nil
 }
 
-func initRatelimiter(storage *storages, cfg *config.Config, logger *logger.MyLogger) (*ratelimit.RateLimiter, error) {
-	ratelimiter, err := ratelimit.NewRateLimiter(storage.BucketStorage, cfg.UserConfig.Tokens, float64(cfg.UserConfig.RatePerSec))
+func initHandlers(s *services, storage *storages, metrics *metrics.Metrics, cfg *config.Config, logger *logger.MyLogger) (*Handlers, error) {
+	identity, err := identity.New(cfg.ClientIdentity)
 	if err != nil {
 		return nil, err
 	}
 
-	return ratelimiter, nil
-}
-
-func initHandlers(s *services, ratelimiter *ratelimit.RateLimiter, cfg *config.Config, logger *logger.MyLogger) (*Handlers, error) {
-	configHandler, err := handler.NewConfigHandler(cfg, logger, s.ratelimit)
+	configHandler, err := handler.NewConfigHandler(cfg, logger, s.ratelimit, identity, metrics)
 	if err != nil {
 		return nil, err
 	}
-	ratelimitHandler, err := handler.NewRateLimitHandler(cfg, logger, ratelimiter)
+	// typed nil pointer must not get into the interface
+	var adaptive handler.AdaptiveLimiter
+	if storage.Adaptive != nil {
+		adaptive = storage.Adaptive
+	}
+	ratelimitHandler, err := handler.NewRateLimitHandler(cfg, logger, identity, storage.RateLimiter, storage.Concurrency, adaptive, metrics)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Handlers{configHandler, ratelimitHandler}, nil
+	return &Handlers{configHandler, ratelimitHandler, metrics.Handler()}, nil
 }
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// AdminHandler returns a handler of the balancer admin API
+//
+// Servers are addressed by their id, which is listed by GET /backends.
+// Metrics are served apart from admin API, see MetricsHandler
+func AdminHandler(logger *logger.MyLogger, pool *ServerPool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /circuit-breakers", circuitBreakersHandler(logger, pool))
+	mux.HandleFunc("GET /backends", listBackendsHandler(logger, pool))
+	mux.HandleFunc("POST /backends", addBackendHandler(logger, pool))
+	mux.HandleFunc("DELETE /backends/{id}", backendHandler(logger, pool, func(s *Server) {
+		pool.RemoveServer(s)
+		logger.Info("Server removed", slog.String("URL", s.URL.String()))
+	}))
+	mux.HandleFunc("POST /backends/{id}/enable", backendHandler(logger, pool, func(s *Server) {
+		s.SetEnabled(true)
+		logger.Info("Server enabled", slog.String("URL", s.URL.String()))
+	}))
+	mux.HandleFunc("POST /backends/{id}/disable", backendHandler(logger, pool, func(s *Server) {
+		s.SetEnabled(false)
+		logger.Info("Server disabled", slog.String("URL", s.URL.String()))
+	}))
+	mux.HandleFunc("POST /backends/{id}/drain", backendHandler(logger, pool, func(s *Server) {
+		pool.DrainServer(s, pool.Config().ShutdownTimeout)
+	}))
+
+	return mux
+}
+
+// MetricsHandler returns a handler that serves Prometheus metrics of a pool on GET /metrics.
+// It has its own listener, so metrics can be scraped remotely without exposing admin API
+func MetricsHandler(pool *ServerPool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", pool.Metrics().Handler())
+	return mux
+}
+
+type breakerInfo struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+}
+
+// circuitBreakersHandler lists circuit breaker states of all servers in a pool
+func circuitBreakersHandler(logger *logger.MyLogger, pool *ServerPool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servers := pool.Servers()
+		breakers := make([]breakerInfo, 0, len(servers))
+		for _, s := range servers {
+			breakers = append(breakers, breakerInfo{s.URL.String(), s.BreakerState().String()})
+		}
+
+		writeJSON(logger, w, http.StatusOK, breakers)
+	}
+}
+
+type backendInfo struct {
+	ID             string  `json:"id"`
+	URL            string  `json:"url"`
+	Weight         int     `json:"weight"`
+	State          string  `json:"state"`
+	Healthy        bool    `json:"healthy"`
+	Ejected        bool    `json:"ejected"`
+	Breaker        string  `json:"breaker"`
+	ActiveRequests int64   `json:"active_requests"`
+	LatencyMs      float64 `json:"latency_ms"`
+}
+
+func newBackendInfo(s *Server) backendInfo {
+	return backendInfo{
+		ID:             s.ID,
+		URL:            s.URL.String(),
+		Weight:         s.GetWeight(),
+		State:          s.AdminState(),
+		Healthy:        s.GetHealth(),
+		Ejected:        s.IsEjected(),
+		Breaker:        s.BreakerState().String(),
+		ActiveRequests: s.ActiveRequests(),
+		LatencyMs:      s.Latency() / float64(time.Millisecond),
+	}
+}
+
+// listBackendsHandler lists all servers in a pool with their state
+func listBackendsHandler(logger *logger.MyLogger, pool *ServerPool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servers := pool.Servers()
+		backends := make([]backendInfo, 0, len(servers))
+		for _, s := range servers {
+			backends = append(backends, newBackendInfo(s))
+		}
+
+		writeJSON(logger, w, http.StatusOK, backends)
+	}
+}
+
+type addBackendRequest struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// addBackendHandler adds a new server into a pool
+func addBackendHandler(logger *logger.MyLogger, pool *ServerPool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req addBackendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			http.Error(w, "Invalid backend url", http.StatusBadRequest)
+			return
+		}
+		if req.Weight < 0 {
+			http.Error(w, "Weight must be positive", http.StatusBadRequest)
+			return
+		}
+
+		s := pool.NewServer(config.Upstream{URL: u, Weight: max(req.Weight, config.DefaultWeight)})
+		if err := pool.AddRuntimeServer(s); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrServerExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		logger.Info("Server added", slog.String("URL", s.URL.String()), slog.Int("weight", s.GetWeight()))
+		writeJSON(logger, w, http.StatusCreated, newBackendInfo(s))
+	}
+}
+
+// backendHandler applies an action to a server with id from the request path
+func backendHandler(logger *logger.MyLogger, pool *ServerPool, action func(s *Server)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := pool.GetServer(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Backend not found", http.StatusNotFound)
+			return
+		}
+
+		action(s)
+		writeJSON(logger, w, http.StatusOK, newBackendInfo(s))
+	}
+}
+
+func writeJSON(logger *logger.MyLogger, w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error while writing admin response", slog.Any("error", err))
+	}
+}
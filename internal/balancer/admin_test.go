@@ -0,0 +1,185 @@
+package balancer
+
+import (
+	"encoding/json"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdminTestPool(t *testing.T) (*ServerPool, http.Handler) {
+	t.Helper()
+
+	u, err := url.Parse("http://backend-0:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:            []config.Upstream{{URL: u, Weight: 2}},
+		Strategy:        config.StrategyRoundRobin,
+		ShutdownTimeout: time.Second,
+	})
+	return pool, AdminHandler(pool.logger, pool)
+}
+
+// adminRequest sends a request to admin API and decodes a JSON response into v if it is not nil
+func adminRequest(t *testing.T, h http.Handler, method, path, body string, v any) int {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil && w.Code < http.StatusBadRequest {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("couldn't decode response of %s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminListBackends(t *testing.T) {
+	pool, h := newAdminTestPool(t)
+
+	var backends []backendInfo
+	if code := adminRequest(t, h, http.MethodGet, "/backends", "", &backends); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	s := pool.Servers()[0]
+	want := backendInfo{ID: s.ID, URL: "http://backend-0:8080", Weight: 2, State: "active", Healthy: true, Breaker: "closed"}
+	if len(backends) != 1 || backends[0] != want {
+		t.Fatalf("backends = %+v, want %+v", backends, want)
+	}
+}
+
+func TestAdminAddBackend(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantWeight int
+	}{
+		{name: "with weight", body: `{"url": "http://backend-1:8080", "weight": 3}`, wantStatus: http.StatusCreated, wantWeight: 3},
+		{name: "default weight", body: `{"url": "http://backend-1:8080"}`, wantStatus: http.StatusCreated, wantWeight: 1},
+		{name: "invalid json", body: `{"url":`, wantStatus: http.StatusBadRequest},
+		{name: "url without host", body: `{"url": "backend-1"}`, wantStatus: http.StatusBadRequest},
+		{name: "unparsable url", body: `{"url": "http://[::1"}`, wantStatus: http.StatusBadRequest},
+		{name: "negative weight", body: `{"url": "http://backend-1:8080", "weight": -1}`, wantStatus: http.StatusBadRequest},
+		{name: "existing url", body: `{"url": "http://backend-0:8080"}`, wantStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, h := newAdminTestPool(t)
+
+			var added backendInfo
+			if code := adminRequest(t, h, http.MethodPost, "/backends", tt.body, &added); code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if n := len(pool.Servers()); n != 1 {
+					t.Fatalf("pool has %d servers after a rejected request, want 1", n)
+				}
+				return
+			}
+
+			s, ok := pool.GetServer(added.ID)
+			if !ok || s.URL.String() != added.URL || s.GetWeight() != tt.wantWeight || added.Weight != tt.wantWeight {
+				t.Fatalf("added backend = %+v, want it in the pool with weight %d", added, tt.wantWeight)
+			}
+			if len(pool.Servers()) != 2 || !s.IsAvailable() {
+				t.Fatal("added backend is not available in the pool")
+			}
+		})
+	}
+}
+
+func TestAdminBackendActions(t *testing.T) {
+	pool, h := newAdminTestPool(t)
+	s := pool.Servers()[0]
+	path := "/backends/" + s.ID
+
+	var info backendInfo
+	if code := adminRequest(t, h, http.MethodPost, path+"/disable", "", &info); code != http.StatusOK || info.State != "disabled" {
+		t.Fatalf("disable: status = %d, state = %q", code, info.State)
+	}
+	if s.IsAvailable() {
+		t.Fatal("disabled backend is available")
+	}
+
+	if code := adminRequest(t, h, http.MethodPost, path+"/enable", "", &info); code != http.StatusOK || info.State != "active" {
+		t.Fatalf("enable: status = %d, state = %q", code, info.State)
+	}
+	if !s.IsAvailable() {
+		t.Fatal("enabled backend is not available")
+	}
+
+	if code := adminRequest(t, h, http.MethodDelete, path, "", &info); code != http.StatusOK {
+		t.Fatalf("delete: status = %d", code)
+	}
+	if _, ok := pool.GetServer(s.ID); ok || len(pool.Servers()) != 0 {
+		t.Fatal("deleted backend is still in the pool")
+	}
+}
+
+func TestAdminDrainBackend(t *testing.T) {
+	pool, h := newAdminTestPool(t)
+	s := pool.Servers()[0]
+	s.active.Store(1)
+
+	var info backendInfo
+	if code := adminRequest(t, h, http.MethodPost, "/backends/"+s.ID+"/drain", "", &info); code != http.StatusOK || info.State != "draining" {
+		t.Fatalf("drain: status = %d, state = %q", code, info.State)
+	}
+	if s.IsAvailable() {
+		t.Fatal("draining backend receives new requests")
+	}
+
+	// the backend stays in the pool while its request is in flight
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := pool.GetServer(s.ID); !ok {
+		t.Fatal("backend is removed before its requests are done")
+	}
+
+	s.active.Store(0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := pool.GetServer(s.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("drained backend is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminUnknownBackend(t *testing.T) {
+	_, h := newAdminTestPool(t)
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodDelete, "/backends/unknown"},
+		{http.MethodPost, "/backends/unknown/enable"},
+		{http.MethodPost, "/backends/unknown/disable"},
+		{http.MethodPost, "/backends/unknown/drain"},
+	} {
+		if code := adminRequest(t, h, req.method, req.path, "", nil); code != http.StatusNotFound {
+			t.Fatalf("%s %s: status = %d, want 404", req.method, req.path, code)
+		}
+	}
+}
+
+func TestAdminCircuitBreakers(t *testing.T) {
+	_, h := newAdminTestPool(t)
+
+	var breakers []breakerInfo
+	if code := adminRequest(t, h, http.MethodGet, "/circuit-breakers", "", &breakers); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if want := (breakerInfo{"http://backend-0:8080", "closed"}); len(breakers) != 1 || breakers[0] != want {
+		t.Fatalf("breakers = %+v, want %+v", breakers, want)
+	}
+}
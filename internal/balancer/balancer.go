@@ -1,38 +1,110 @@
 package balancer
 
 import (
-	"ivanjabrony/cloud-test/internal/balancer/config"
 	"ivanjabrony/cloud-test/internal/logger"
+	"log/slog"
 	"net/http"
 )
 
-func GetAttemptsFromContext(r *http.Request) int {
-	if attempts, ok := r.Context().Value("Attempts").(int); ok {
-		return attempts
-	}
-	return 1
-}
-
-func GetRetryFromContext(r *http.Request) int {
-	if retry, ok := r.Context().Value("Retry").(int); ok {
-		return retry
-	}
-	return 0
-}
-
 // LoadBalancer return a func that balances request between available services and checks availability
-func LoadBalancer(logger *logger.MyLogger, cfg *config.Config, pool *ServerPool) func(w http.ResponseWriter, r *http.Request) {
+//
+// A request that failed with a gateway error is retried up to MaxRetries times on the same server
+// and then on other servers until MaxAttempts servers are tried, with exponential backoff between retries.
+// Only idempotent requests with a body small enough to be buffered are retried and only while retry budget allows
+//
+// Retry settings are taken from the pool config when a request comes, so reloaded config applies to new requests.
+// A chosen server may hold a trial slot of its circuit breaker for the request, the slot is released
+// if the request is not sent to the server after all
+func LoadBalancer(logger *logger.MyLogger, pool *ServerPool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		attempts := GetAttemptsFromContext(r)
-		if attempts > cfg.MaxAttempts {
-			logger.Warn("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-			http.Error(w, "Service not available", http.StatusServiceUnavailable)
-			return
+		cfg := pool.Config()
+		done := pool.retryBudget.StartRequest()
+		defer done()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		tries := 0
+		finish := pool.metrics.startRequest(r)
+		defer func() {
+			pool.metrics.observeAttempts(tries)
+			finish(rec.status)
+		}()
+
+		// body is buffered only if the request may be sent more than once
+		retryable := canRetry(cfg) && isRetryable(cfg.Retry, r) && bufferBody(r, cfg.Retry.MaxBodyBytes)
+
+		for number := 1; number <= cfg.MaxAttempts; number++ {
+			peer := pool.GetNextServer(r)
+			if peer == nil {
+				break
+			}
+
+			failed := 0 // requests sent to the server that failed
+			for retry := 0; retry <= cfg.MaxRetries; retry++ {
+				// the server has just been chosen as available, so it is checked again only before retries:
+				// its own trial slot reserved in circuit breaker would make it look busy
+				if retry > 0 && !peer.IsAvailable() {
+					// circuit breaker or outlier detection has taken the server out, try another one
+					break
+				}
+
+				retryDone := func() {}
+				if tries > 0 {
+					var ok bool
+					if retryDone, ok = pool.retryBudget.TryRetry(); !ok {
+						if retry == 0 {
+							peer.breaker.Release()
+						}
+						pool.metrics.observeBudgetExhausted()
+						logger.Warn("Retry budget exhausted", slog.String("client", r.RemoteAddr), slog.String("path", r.URL.Path))
+						http.Error(w, "Bad gateway", http.StatusBadGateway)
+						return
+					}
+					if !sleepContext(r.Context(), backoff(cfg.RetryTimeout, cfg.Retry.BackoffMax, tries)) {
+						if retry == 0 {
+							peer.breaker.Release()
+						}
+						retryDone()
+						return
+					}
+					rewindBody(r)
+					pool.metrics.observeRetry(peer)
+					logger.Info("Retrying request",
+						slog.String("client", r.RemoteAddr),
+						slog.String("path", r.URL.Path),
+						slog.String("URL", peer.URL.String()),
+						slog.Int("attempt", number),
+						slog.Int("retry", retry))
+				}
+
+				tries++
+				a := &attempt{number: number, retry: retry}
+				peer.ServeHTTP(w, withAttempt(r, a))
+				retryDone()
+
+				switch {
+				case a.err == nil:
+					return
+				case r.Context().Err() != nil:
+					// client has gone, nobody waits for a retry
+					return
+				case !retryable:
+					http.Error(w, "Bad gateway", http.StatusBadGateway)
+					return
+				}
+				failed++
+			}
+
+			// the server has failed all retries, mark this backend as down. A server that was taken out
+			// by circuit breaker or outlier detection before retries ran out is left to them
+			if failed > cfg.MaxRetries {
+				pool.ChangeServerStatus(peer.URL, false)
+			}
 		}
 
-		peer := pool.GetNextServer()
-		if peer != nil {
-			peer.ReverseProxy.ServeHTTP(w, r)
+		if tries > 0 {
+			logger.Warn("Max attempts reached, terminating", slog.String("client", r.RemoteAddr), slog.String("path", r.URL.Path))
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
 			return
 		}
 		http.Error(w, "Service not available", http.StatusServiceUnavailable)
@@ -0,0 +1,224 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadURL returns a URL nobody listens on, so requests to it fail with a gateway error
+func deadURL(t *testing.T) *url.URL {
+	t.Helper()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// newHalfOpenPool returns a pool of a failing server and a server with a half-open circuit breaker.
+// Round robin sends the first request to the failing server, so the retry goes to the half-open one
+func newHalfOpenPool(t *testing.T, retry config.Retry, retryTimeout time.Duration) (*ServerPool, *Server) {
+	t.Helper()
+
+	cfg := &config.Config{
+		URLs:         []config.Upstream{{URL: deadURL(t), Weight: 1}, {URL: deadURL(t), Weight: 1}},
+		Strategy:     config.StrategyRoundRobin,
+		MaxRetries:   0,
+		MaxAttempts:  2,
+		RetryTimeout: retryTimeout,
+		Retry:        retry,
+		CircuitBreaker: config.CircuitBreaker{
+			Enabled:          true,
+			Window:           time.Minute,
+			Buckets:          1,
+			MinRequests:      1,
+			ErrorRate:        0.5,
+			TimeoutRate:      0.5,
+			OpenTimeout:      time.Nanosecond,
+			HalfOpenRequests: 1,
+		},
+	}
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), cfg)
+
+	halfOpen := pool.Servers()[0]
+	halfOpen.breaker.Report(outcomeError)
+	time.Sleep(time.Millisecond)
+	if state := halfOpen.BreakerState(); state != StateHalfOpen {
+		t.Fatalf("breaker state = %s, want half-open", state)
+	}
+
+	return pool, halfOpen
+}
+
+// TestLoadBalancerReleasesUnusedTrialSlot checks that a trial slot of a half-open breaker is given back
+// when a request chooses the server but is not sent to it, otherwise the server stays half-open forever
+func TestLoadBalancerReleasesUnusedTrialSlot(t *testing.T) {
+	tests := []struct {
+		name         string
+		retry        config.Retry
+		retryTimeout time.Duration
+		timeout      time.Duration
+	}{
+		{
+			name:  "retry budget exhausted",
+			retry: config.Retry{BudgetPercent: 0, MinRetryConcurrency: 0},
+		},
+		{
+			name:         "request canceled during backoff",
+			retry:        config.Retry{BudgetPercent: 100, MinRetryConcurrency: 10, BackoffMax: time.Hour},
+			retryTimeout: time.Hour,
+			timeout:      50 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, halfOpen := newHalfOpenPool(t, tt.retry, tt.retryTimeout)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), tt.timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			LoadBalancer(pool.logger, pool)(httptest.NewRecorder(), r)
+
+			if !halfOpen.breaker.Ready() {
+				t.Fatal("trial slot of the half-open breaker is not released")
+			}
+			if state := halfOpen.BreakerState(); state != StateHalfOpen {
+				t.Fatalf("breaker state = %s, want half-open", state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	cb := NewCircuitBreaker(config.CircuitBreaker{
+		Window:           time.Minute,
+		Buckets:          1,
+		MinRequests:      1,
+		ErrorRate:        0.5,
+		TimeoutRate:      0.5,
+		OpenTimeout:      time.Nanosecond,
+		HalfOpenRequests: 1,
+	}, "test", logger.New(logger.EnvProd, logger.LogFormatText))
+	cb.Report(outcomeError)
+	time.Sleep(time.Millisecond)
+
+	if !cb.Allow() {
+		t.Fatal("half-open breaker refused the first trial request")
+	}
+	if cb.Allow() {
+		t.Fatal("half-open breaker allowed more trial requests than configured")
+	}
+	cb.Release()
+	if !cb.Allow() {
+		t.Fatal("released trial slot can't be reserved again")
+	}
+
+	// released slot doesn't count as a passed trial
+	cb.Release()
+	if state := cb.State(); state != StateHalfOpen {
+		t.Fatalf("breaker state = %s, want half-open", state)
+	}
+}
+
+// TestLoadBalancerKeepsHealthOfServerTakenOut checks that a server taken out by its circuit breaker
+// before retries ran out is not marked down, health checks would have to bring it back otherwise
+func TestLoadBalancerKeepsHealthOfServerTakenOut(t *testing.T) {
+	cfg := &config.Config{
+		URLs:        []config.Upstream{{URL: deadURL(t), Weight: 1}},
+		Strategy:    config.StrategyRoundRobin,
+		MaxRetries:  2,
+		MaxAttempts: 1,
+		Retry:       config.Retry{BudgetPercent: 100, MinRetryConcurrency: 10},
+		CircuitBreaker: config.CircuitBreaker{
+			Enabled:          true,
+			Window:           time.Minute,
+			Buckets:          1,
+			MinRequests:      1,
+			ErrorRate:        0.5,
+			TimeoutRate:      0.5,
+			OpenTimeout:      time.Hour,
+			HalfOpenRequests: 1,
+		},
+	}
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), cfg)
+	server := pool.Servers()[0]
+
+	LoadBalancer(pool.logger, pool)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if state := server.BreakerState(); state != StateOpen {
+		t.Fatalf("breaker state = %s, want open", state)
+	}
+	server.mu.RLock()
+	healthy := server.IsHealthy
+	server.mu.RUnlock()
+	if !healthy {
+		t.Fatal("server taken out by circuit breaker is marked down")
+	}
+}
+
+// TestLoadBalancerBuffersBodyOnlyForRetries checks that a request body is kept in memory only
+// if the request may be retried, and a buffered body is replayed on a retry
+func TestLoadBalancerBuffersBodyOnlyForRetries(t *testing.T) {
+	const body = "payload"
+
+	tests := []struct {
+		name         string
+		maxRetries   int
+		maxAttempts  int
+		failFirst    bool // first try goes to a dead server, so the request is replayed on the live one
+		wantBuffered bool
+	}{
+		{name: "no retries", maxRetries: 0, maxAttempts: 1, wantBuffered: false},
+		{name: "retries on the same server", maxRetries: 1, maxAttempts: 1, wantBuffered: true},
+		{name: "retries on other servers", maxRetries: 0, maxAttempts: 2, failFirst: true, wantBuffered: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				w.Write(b)
+			}))
+			defer backend.Close()
+			u, _ := url.Parse(backend.URL)
+
+			pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+				URLs:        []config.Upstream{{URL: u, Weight: 1}, {URL: deadURL(t), Weight: 1}},
+				Strategy:    config.StrategyRoundRobin,
+				MaxRetries:  tt.maxRetries,
+				MaxAttempts: tt.maxAttempts,
+				Retry:       config.Retry{MaxBodyBytes: 1 << 10, BudgetPercent: 100, MinRetryConcurrency: 10},
+			})
+			// round robin starts from the second server
+			if !tt.failFirst {
+				pool.Servers()[1].SetHealth(false)
+			}
+
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			LoadBalancer(pool.logger, pool)(w, r)
+
+			if buffered := r.GetBody != nil; buffered != tt.wantBuffered {
+				t.Fatalf("body buffered = %v, want %v", buffered, tt.wantBuffered)
+			}
+			if w.Code != http.StatusOK || w.Body.String() != body {
+				t.Fatalf("response = %d %q, want the body echoed by the live server", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerState is a state of a circuit breaker
+type BreakerState int
+
+const (
+	StateClosed   BreakerState = iota // requests pass, results are counted
+	StateOpen                         // requests are not sent to the server
+	StateHalfOpen                     // limited amount of trial requests is allowed
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// outcome is a result of a proxied request from the point of view of a circuit breaker
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeError
+	outcomeTimeout
+	outcomeIgnored // request was cancelled by client, it says nothing about the server
+)
+
+// responseOutcome classifies a response status
+func responseOutcome(status int) outcome {
+	if status >= http.StatusInternalServerError {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// errorOutcome classifies an error returned by a reverse proxy
+func errorOutcome(err error) outcome {
+	if errors.Is(err, context.Canceled) {
+		return outcomeIgnored
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return outcomeTimeout
+	}
+	return outcomeError
+}
+
+// windowBucket holds request results for a part of a rolling window
+type windowBucket struct {
+	start    time.Time
+	total    int
+	errors   int
+	timeouts int
+}
+
+// CircuitBreaker stops sending requests to a server when its error or timeout rate
+// within a rolling window is too high
+//
+// After open timeout the breaker becomes half-open and lets through a limited amount of trial requests:
+// if all of them succeed the breaker closes, any failure opens it again
+type CircuitBreaker struct {
+	cfg              config.CircuitBreaker
+	name             string
+	logger           *logger.MyLogger
+	state            BreakerState
+	openedAt         time.Time
+	buckets          []windowBucket
+	halfOpenInFlight int
+	halfOpenPassed   int
+	mu               sync.Mutex
+}
+
+func NewCircuitBreaker(cfg config.CircuitBreaker, name string, logger *logger.MyLogger) *CircuitBreaker {
+	return &CircuitBreaker{
+		cfg:     cfg,
+		name:    name,
+		logger:  logger,
+		buckets: make([]windowBucket, cfg.Buckets),
+	}
+}
+
+// UpdateConfig applies new thresholds to the breaker. Rolling window starts from scratch
+// if its size has changed
+func (cb *CircuitBreaker) UpdateConfig(cfg config.CircuitBreaker) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cfg.Window != cb.cfg.Window || cfg.Buckets != cb.cfg.Buckets {
+		cb.buckets = make([]windowBucket, cfg.Buckets)
+	}
+	cb.cfg = cfg
+}
+
+// State returns current state of the breaker
+func (cb *CircuitBreaker) State() BreakerState {
+	if cb == nil {
+		return StateClosed
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState(time.Now())
+	return cb.state
+}
+
+// Ready checks if a request could be sent through the breaker without reserving a trial slot
+func (cb *CircuitBreaker) Ready() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState(time.Now())
+	switch cb.state {
+	case StateOpen:
+		return false
+	case StateHalfOpen:
+		return cb.halfOpenInFlight < cb.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Allow checks if a request can be sent through the breaker and reserves a trial slot when half-open
+func (cb *CircuitBreaker) Allow() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState(time.Now())
+	switch cb.state {
+	case StateOpen:
+		return false
+	case StateHalfOpen:
+		if cb.halfOpenInFlight >= cb.cfg.HalfOpenRequests {
+			return false
+		}
+		cb.halfOpenInFlight++
+		return true
+	default:
+		return true
+	}
+}
+
+// Release gives back a trial slot reserved by Allow for a request that wasn't sent to the server
+func (cb *CircuitBreaker) Release() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == StateHalfOpen {
+		cb.halfOpenInFlight = max(cb.halfOpenInFlight-1, 0)
+	}
+}
+
+// Report records a result of a request that went through the breaker
+func (cb *CircuitBreaker) Report(res outcome) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	cb.refreshState(now)
+	switch cb.state {
+	case StateHalfOpen:
+		cb.halfOpenInFlight = max(cb.halfOpenInFlight-1, 0)
+		switch res {
+		case outcomeSuccess:
+			cb.halfOpenPassed++
+			if cb.halfOpenPassed >= cb.cfg.HalfOpenRequests {
+				cb.setState(StateClosed, now)
+			}
+		case outcomeError, outcomeTimeout:
+			cb.setState(StateOpen, now)
+		}
+	case StateClosed:
+		if res == outcomeIgnored {
+			return
+		}
+		b := cb.currentBucket(now)
+		b.total++
+		switch res {
+		case outcomeError:
+			b.errors++
+		case outcomeTimeout:
+			b.timeouts++
+		}
+		cb.checkRates(now)
+	}
+}
+
+// refreshState moves an open breaker to half-open state when open timeout is over
+func (cb *CircuitBreaker) refreshState(now time.Time) {
+	if cb.state == StateOpen && now.Sub(cb.openedAt) >= cb.cfg.OpenTimeout {
+		cb.setState(StateHalfOpen, now)
+	}
+}
+
+// setState changes the state and resets counters of the previous one
+func (cb *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+
+	cb.logger.Warn("Circuit breaker state changed",
+		slog.String("URL", cb.name),
+		slog.String("from", cb.state.String()),
+		slog.String("to", state.String()))
+
+	cb.state = state
+	cb.halfOpenInFlight, cb.halfOpenPassed = 0, 0
+	clear(cb.buckets)
+	if state == StateOpen {
+		cb.openedAt = now
+	}
+}
+
+// currentBucket returns a bucket of the rolling window for the moment, stale bucket is reset
+func (cb *CircuitBreaker) currentBucket(now time.Time) *windowBucket {
+	width := cb.cfg.Window / time.Duration(len(cb.buckets))
+	slot := now.Truncate(width)
+	b := &cb.buckets[int(slot.UnixNano()/int64(width))%len(cb.buckets)]
+	if !b.start.Equal(slot) {
+		*b = windowBucket{start: slot}
+	}
+	return b
+}
+
+// checkRates opens the breaker if error or timeout rate within the window exceeds configured limits
+func (cb *CircuitBreaker) checkRates(now time.Time) {
+	var total, errs, timeouts int
+	for _, b := range cb.buckets {
+		if now.Sub(b.start) >= cb.cfg.Window {
+			continue
+		}
+		total += b.total
+		errs += b.errors
+		timeouts += b.timeouts
+	}
+
+	if total == 0 || total < cb.cfg.MinRequests {
+		return
+	}
+
+	if float64(errs)/float64(total) >= cb.cfg.ErrorRate || float64(timeouts)/float64(total) >= cb.cfg.TimeoutRate {
+		cb.setState(StateOpen, now)
+	}
+}
@@ -1,25 +1,214 @@
 package config
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Supported balancing strategies
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConnections   = "least_connections"
+	StrategyP2CEWMA            = "p2c_ewma"
+	StrategyConsistentHash     = "consistent_hash"
+)
+
+// Supported sources of a consistent hashing key
+const (
+	HashKeySourceIP     = "ip"
+	HashKeySourceHeader = "header"
+	HashKeySourceCookie = "cookie"
+)
+
+// Supported health check modes
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+// Default health state transition thresholds
+const (
+	DefaultHealthRise = 2
+	DefaultHealthFall = 3
+)
+
+// DefaultAdminHost is an address admin API listens on if it isn't configured
+const DefaultAdminHost = "127.0.0.1"
+
+// DefaultMetricsHost is an address metrics are served on if it isn't configured
+const DefaultMetricsHost = "127.0.0.1"
+
+// DefaultWeight is a weight of an upstream that has no weight configured
+const DefaultWeight = 1
+
 type Config struct {
-	Env                 string        `json:"env"`
-	LogFormat           string        `json:"log_format"`
-	URLs                []*url.URL    `json:"urls"`
-	Port                int           `json:"port"`
-	MaxRetries          int           `json:"max_retries"`
-	MaxAttempts         int           `json:"max_attempts"`
-	ShutdownTimeout     time.Duration `json:"shutdown_timeout"`
-	RetryTimeout        time.Duration `json:"retry_timeout"`
-	HealthPoolTimeout   time.Duration `json:"health_pool_timeout"`
-	HealthServerTimeout time.Duration `json:"health_server_timeout"`
+	Env                 string           `json:"env"`
+	LogFormat           string           `json:"log_format"`
+	URLs                []Upstream       `json:"urls"`
+	Strategy            string           `json:"strategy"`
+	Port                int              `json:"port"`
+	MaxRetries          int              `json:"max_retries"`
+	MaxAttempts         int              `json:"max_attempts"`
+	ShutdownTimeout     time.Duration    `json:"shutdown_timeout"`
+	RetryTimeout        time.Duration    `json:"retry_timeout"`
+	HealthPoolTimeout   time.Duration    `json:"health_pool_timeout"`
+	HealthServerTimeout time.Duration    `json:"health_server_timeout"`
+	LatencyDecay        time.Duration    `json:"latency_decay"`
+	HashKey             HashKeyConfig    `json:"hash_key"`
+	Sticky              StickyConfig     `json:"sticky"`
+	HealthCheck         HealthCheck      `json:"health_check"`
+	OutlierDetection    OutlierDetection `json:"outlier_detection"`
+	CircuitBreaker      CircuitBreaker   `json:"circuit_breaker"`
+	UpstreamTimeout     time.Duration    `json:"upstream_timeout"` // max time to wait for response headers of a backend
+	AdminPort           int              `json:"admin_port"`       // admin API is disabled when port is 0
+	AdminHost           string           `json:"admin_host"`       // admin API has no auth, so it listens on loopback by default
+	Metrics             Metrics          `json:"metrics"`
+	Retry               Retry            `json:"retry"`
+	WatchInterval       time.Duration    `json:"config_watch_interval"` // config file is not watched when interval is 0
+}
+
+// Metrics configures a listener Prometheus metrics are served on, apart from admin API
+type Metrics struct {
+	Port int    `json:"port"` // metrics are not served when port is 0
+	Host string `json:"host"`
+}
+
+// Retry configures retries of requests that failed with gateway errors
+type Retry struct {
+	BackoffMax          time.Duration `json:"backoff_max"`           // max delay between retries
+	NonIdempotent       bool          `json:"non_idempotent"`        // retry requests with non idempotent methods too
+	MaxBodyBytes        int64         `json:"max_body_bytes"`        // bigger request bodies are not buffered and not retried
+	BudgetPercent       int           `json:"budget_percent"`        // retries in flight allowed as percent of requests in flight
+	MinRetryConcurrency int           `json:"min_retry_concurrency"` // retries in flight allowed regardless of budget percent
+}
+
+// CircuitBreaker configures per-server circuit breakers
+type CircuitBreaker struct {
+	Enabled          bool          `json:"enabled"`
+	Window           time.Duration `json:"window"`             // length of a rolling window
+	Buckets          int           `json:"buckets"`            // amount of parts the window is split into
+	MinRequests      int           `json:"min_requests"`       // requests within the window needed to trip
+	ErrorRate        float64       `json:"error_rate"`         // share of errors that trips the breaker
+	TimeoutRate      float64       `json:"timeout_rate"`       // share of timeouts that trips the breaker
+	OpenTimeout      time.Duration `json:"open_timeout"`       // time before open breaker becomes half-open
+	HalfOpenRequests int           `json:"half_open_requests"` // trial requests allowed in half-open state
+}
+
+// OutlierDetection configures passive health checks based on live traffic
+type OutlierDetection struct {
+	Enabled                   bool          `json:"enabled"`
+	Consecutive5xx            int           `json:"consecutive_5xx"`             // 0 disables ejection on consecutive 5xx
+	ConsecutiveGatewayFailure int           `json:"consecutive_gateway_failure"` // 0 disables ejection on consecutive gateway errors
+	Interval                  time.Duration `json:"interval"`                    // period of success rate analysis
+	BaseEjectionTime          time.Duration `json:"base_ejection_time"`
+	MaxEjectionTime           time.Duration `json:"max_ejection_time"`
+	MaxEjectionPercent        int           `json:"max_ejection_percent"`
+	SuccessRateMinimumHosts   int           `json:"success_rate_minimum_hosts"`
+	SuccessRateRequestVolume  int           `json:"success_rate_request_volume"`
+	SuccessRateStdevFactor    float64       `json:"success_rate_stdev_factor"`
+}
+
+// HealthCheck configures active health checks of pool servers
+type HealthCheck struct {
+	Mode             string            `json:"mode"` // tcp or http
+	Method           string            `json:"method"`
+	Path             string            `json:"path"`
+	Headers          map[string]string `json:"headers"`
+	ExpectedStatuses []StatusRange     `json:"expected_statuses"`
+	Body             string            `json:"body"`       // substring that response body must contain
+	BodyRegex        *regexp.Regexp    `json:"body_regex"` // expression that response body must match
+	Timeout          time.Duration     `json:"timeout"`
+	Rise             int               `json:"rise"`   // consecutive successful checks to mark server up
+	Fall             int               `json:"fall"`   // consecutive failed checks to mark server down
+	Jitter           time.Duration     `json:"jitter"` // max random delay of every server probe
+}
+
+// StatusRange is an inclusive range of http status codes
+type StatusRange struct {
+	From int
+	To   int
+}
+
+// Contains checks if status code is in the range
+func (sr StatusRange) Contains(status int) bool {
+	return status >= sr.From && status <= sr.To
+}
+
+// parseStatusRange parses status ranges like "200-299" or a single status code like "204"
+func parseStatusRange(s string) (StatusRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+
+	fromCode, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return StatusRange{}, fmt.Errorf("invalid status range %q: %w", s, err)
+	}
+	toCode, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return StatusRange{}, fmt.Errorf("invalid status range %q: %w", s, err)
+	}
+	if fromCode < 100 || toCode > 599 || fromCode > toCode {
+		return StatusRange{}, fmt.Errorf("invalid status range %q", s)
+	}
+
+	return StatusRange{fromCode, toCode}, nil
+}
+
+// HashKeyConfig describes where consistent hashing strategy takes a request key from
+type HashKeyConfig struct {
+	Source string `json:"source"` // ip, header or cookie
+	Name   string `json:"name"`   // name of a header or a cookie
+}
+
+// StickyConfig configures cookie based session affinity. It is disabled when Cookie is empty
+type StickyConfig struct {
+	Cookie string        `json:"cookie"`
+	TTL    time.Duration `json:"ttl"`
+}
+
+// Upstream is a backend server with its share of traffic
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+}
+
+// upstream is an unchecked upstream entry. In config file it can be either a plain url string
+// or an object with "url" and "weight" fields
+type upstream struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+func (u *upstream) UnmarshalJSON(b []byte) error {
+	var rawUrl string
+	if err := json.Unmarshal(b, &rawUrl); err == nil {
+		*u = upstream{URL: rawUrl, Weight: DefaultWeight}
+		return nil
+	}
+
+	type plain upstream
+	var v plain
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Weight == 0 {
+		v.Weight = DefaultWeight
+	}
+	*u = upstream(v)
+	return nil
 }
 
 type duration time.Duration
@@ -49,48 +238,279 @@ func (d *duration) UnmarshalJSON(b []byte) error {
 	}
 }
 
+// MustLoadConfig loads config from a file and stops the program if the config is invalid
 func MustLoadConfig(path string) *Config {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return cfg
+}
+
+// LoadConfig reads config from a file, applies default values and validates it
+func LoadConfig(path string) (*Config, error) {
 	type uncheckedUrlConfig struct {
-		Env                 string   `json:"env"`
-		LogFormat           string   `json:"log_format"`
-		URLs                []string `json:"urls"`
-		Port                int      `json:"port"`
-		MaxRetries          int      `json:"max_retries"`
-		MaxAttempts         int      `json:"max_attempts"`
-		ShutdownTimeout     duration `json:"shutdown_timeout"`
-		RetryTimeout        duration `json:"retry_timeout"`
-		HealthPoolTimeout   duration `json:"health_pool_timeout"`
-		HealthServerTimeout duration `json:"health_server_timeout"`
+		Env                 string        `json:"env"`
+		LogFormat           string        `json:"log_format"`
+		URLs                []upstream    `json:"urls"`
+		Strategy            string        `json:"strategy"`
+		Port                int           `json:"port"`
+		MaxRetries          int           `json:"max_retries"`
+		MaxAttempts         int           `json:"max_attempts"`
+		ShutdownTimeout     duration      `json:"shutdown_timeout"`
+		RetryTimeout        duration      `json:"retry_timeout"`
+		HealthPoolTimeout   duration      `json:"health_pool_timeout"`
+		HealthServerTimeout duration      `json:"health_server_timeout"`
+		LatencyDecay        duration      `json:"latency_decay"`
+		HashKey             HashKeyConfig `json:"hash_key"`
+		Sticky              struct {
+			Cookie string   `json:"cookie"`
+			TTL    duration `json:"ttl"`
+		} `json:"sticky"`
+		HealthCheck struct {
+			Mode             string            `json:"mode"`
+			Method           string            `json:"method"`
+			Path             string            `json:"path"`
+			Headers          map[string]string `json:"headers"`
+			ExpectedStatuses []string          `json:"expected_statuses"`
+			Body             string            `json:"body"`
+			BodyRegex        string            `json:"body_regex"`
+			Timeout          duration          `json:"timeout"`
+			Rise             int               `json:"rise"`
+			Fall             int               `json:"fall"`
+			Jitter           *duration         `json:"jitter"`
+		} `json:"health_check"`
+		OutlierDetection struct {
+			Enabled                   bool     `json:"enabled"`
+			Consecutive5xx            *int     `json:"consecutive_5xx"`
+			ConsecutiveGatewayFailure *int     `json:"consecutive_gateway_failure"`
+			Interval                  duration `json:"interval"`
+			BaseEjectionTime          duration `json:"base_ejection_time"`
+			MaxEjectionTime           duration `json:"max_ejection_time"`
+			MaxEjectionPercent        int      `json:"max_ejection_percent"`
+			SuccessRateMinimumHosts   int      `json:"success_rate_minimum_hosts"`
+			SuccessRateRequestVolume  int      `json:"success_rate_request_volume"`
+			SuccessRateStdevFactor    float64  `json:"success_rate_stdev_factor"`
+		} `json:"outlier_detection"`
+		CircuitBreaker struct {
+			Enabled          bool     `json:"enabled"`
+			Window           duration `json:"window"`
+			Buckets          int      `json:"buckets"`
+			MinRequests      int      `json:"min_requests"`
+			ErrorRate        float64  `json:"error_rate"`
+			TimeoutRate      float64  `json:"timeout_rate"`
+			OpenTimeout      duration `json:"open_timeout"`
+			HalfOpenRequests int      `json:"half_open_requests"`
+		} `json:"circuit_breaker"`
+		UpstreamTimeout duration `json:"upstream_timeout"`
+		AdminPort       int      `json:"admin_port"`
+		AdminHost       string   `json:"admin_host"`
+		Metrics         Metrics  `json:"metrics"`
+		Retry           struct {
+			BackoffMax          duration `json:"backoff_max"`
+			NonIdempotent       bool     `json:"non_idempotent"`
+			MaxBodyBytes        *int64   `json:"max_body_bytes"`
+			BudgetPercent       *int     `json:"budget_percent"`
+			MinRetryConcurrency *int     `json:"min_retry_concurrency"`
+		} `json:"retry"`
+		WatchInterval duration `json:"config_watch_interval"`
 	}
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		log.Fatalf("config file does not exist: %s", path)
+		return nil, fmt.Errorf("config file does not exist: %s", path)
 	}
 	file, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatalf("couldn't read config file: %s", path)
+		return nil, fmt.Errorf("couldn't read config file %s: %w", path, err)
 	}
 
 	var cfg uncheckedUrlConfig
 	if err := json.Unmarshal(file, &cfg); err != nil {
-		log.Fatalf("couldn't unmarshall config file: %s", path)
+		return nil, fmt.Errorf("couldn't unmarshall config file %s: %w", path, err)
 	}
 
-	parsedUrls := make([]*url.URL, 0, len(cfg.URLs))
+	parsedUrls := make([]Upstream, 0, len(cfg.URLs))
 
 	for _, u := range cfg.URLs {
-		parsedUrl, err := url.Parse(u)
+		parsedUrl, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse target url from config file %s: %w", path, err)
+		}
+		if u.Weight < 0 {
+			return nil, fmt.Errorf("weight of %s must be positive in config file: %s", u.URL, path)
+		}
+
+		parsedUrls = append(parsedUrls, Upstream{parsedUrl, u.Weight})
+	}
+
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastConnections, StrategyP2CEWMA, StrategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q in config file: %s", cfg.Strategy, path)
+	}
+
+	switch cfg.HashKey.Source {
+	case "":
+		cfg.HashKey.Source = HashKeySourceIP
+	case HashKeySourceIP:
+	case HashKeySourceHeader, HashKeySourceCookie:
+		if cfg.HashKey.Name == "" {
+			return nil, fmt.Errorf("hash key %s name must be set in config file: %s", cfg.HashKey.Source, path)
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash key source %q in config file: %s", cfg.HashKey.Source, path)
+	}
+
+	healthCheck := HealthCheck{
+		Mode:    cfg.HealthCheck.Mode,
+		Method:  cfg.HealthCheck.Method,
+		Path:    cfg.HealthCheck.Path,
+		Headers: cfg.HealthCheck.Headers,
+		Body:    cfg.HealthCheck.Body,
+		Timeout: time.Duration(cfg.HealthCheck.Timeout),
+		Rise:    cfg.HealthCheck.Rise,
+		Fall:    cfg.HealthCheck.Fall,
+	}
+	switch healthCheck.Mode {
+	case "":
+		healthCheck.Mode = HealthCheckTCP
+	case HealthCheckTCP, HealthCheckHTTP:
+	default:
+		return nil, fmt.Errorf("unknown health check mode %q in config file: %s", healthCheck.Mode, path)
+	}
+	if healthCheck.Method == "" {
+		healthCheck.Method = http.MethodGet
+	}
+	if healthCheck.Path == "" {
+		healthCheck.Path = "/"
+	}
+	if healthCheck.Timeout == 0 {
+		healthCheck.Timeout = time.Duration(cfg.HealthServerTimeout)
+	}
+	if healthCheck.Rise == 0 {
+		healthCheck.Rise = DefaultHealthRise
+	}
+	if healthCheck.Fall == 0 {
+		healthCheck.Fall = DefaultHealthFall
+	}
+	if healthCheck.Rise < 0 || healthCheck.Fall < 0 {
+		return nil, fmt.Errorf("health check rise and fall must be positive in config file: %s", path)
+	}
+	if cfg.HealthCheck.Jitter == nil {
+		healthCheck.Jitter = time.Duration(cfg.HealthPoolTimeout) / 5
+	} else {
+		healthCheck.Jitter = time.Duration(*cfg.HealthCheck.Jitter)
+	}
+	if healthCheck.Jitter < 0 || healthCheck.Jitter >= time.Duration(cfg.HealthPoolTimeout) {
+		return nil, fmt.Errorf("health check jitter must be less than health_pool_timeout in config file: %s", path)
+	}
+	for _, status := range cfg.HealthCheck.ExpectedStatuses {
+		statusRange, err := parseStatusRange(status)
 		if err != nil {
-			log.Fatalf("couldn't parse target url from config file: %s", path)
+			return nil, fmt.Errorf("couldn't parse expected health check status from config file %s: %v", path, err)
 		}
+		healthCheck.ExpectedStatuses = append(healthCheck.ExpectedStatuses, statusRange)
+	}
+	if len(healthCheck.ExpectedStatuses) == 0 {
+		healthCheck.ExpectedStatuses = []StatusRange{{200, 299}}
+	}
+	if cfg.HealthCheck.BodyRegex != "" {
+		healthCheck.BodyRegex, err = regexp.Compile(cfg.HealthCheck.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile health check body regex from config file %s: %v", path, err)
+		}
+	}
+
+	od := cfg.OutlierDetection
+	outlierDetection := OutlierDetection{
+		Enabled:                   od.Enabled,
+		Consecutive5xx:            5,
+		ConsecutiveGatewayFailure: 5,
+		Interval:                  cmp.Or(time.Duration(od.Interval), 10*time.Second),
+		BaseEjectionTime:          cmp.Or(time.Duration(od.BaseEjectionTime), 30*time.Second),
+		MaxEjectionTime:           cmp.Or(time.Duration(od.MaxEjectionTime), 300*time.Second),
+		MaxEjectionPercent:        cmp.Or(od.MaxEjectionPercent, 10),
+		SuccessRateMinimumHosts:   cmp.Or(od.SuccessRateMinimumHosts, 5),
+		SuccessRateRequestVolume:  cmp.Or(od.SuccessRateRequestVolume, 100),
+		SuccessRateStdevFactor:    cmp.Or(od.SuccessRateStdevFactor, 1.9),
+	}
+	if od.Consecutive5xx != nil {
+		outlierDetection.Consecutive5xx = *od.Consecutive5xx
+	}
+	if od.ConsecutiveGatewayFailure != nil {
+		outlierDetection.ConsecutiveGatewayFailure = *od.ConsecutiveGatewayFailure
+	}
+	if outlierDetection.Interval < 0 || outlierDetection.BaseEjectionTime < 0 || outlierDetection.MaxEjectionTime < outlierDetection.BaseEjectionTime {
+		return nil, fmt.Errorf("invalid outlier detection timings in config file: %s", path)
+	}
+	if outlierDetection.MaxEjectionPercent < 0 || outlierDetection.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("outlier detection max_ejection_percent must be between 0 and 100 in config file: %s", path)
+	}
 
-		parsedUrls = append(parsedUrls, parsedUrl)
+	cb := cfg.CircuitBreaker
+	circuitBreaker := CircuitBreaker{
+		Enabled:          cb.Enabled,
+		Window:           cmp.Or(time.Duration(cb.Window), 10*time.Second),
+		Buckets:          cmp.Or(cb.Buckets, 10),
+		MinRequests:      cmp.Or(cb.MinRequests, 20),
+		ErrorRate:        cmp.Or(cb.ErrorRate, 0.5),
+		TimeoutRate:      cmp.Or(cb.TimeoutRate, 0.5),
+		OpenTimeout:      cmp.Or(time.Duration(cb.OpenTimeout), 30*time.Second),
+		HalfOpenRequests: cmp.Or(cb.HalfOpenRequests, 3),
+	}
+	if circuitBreaker.Window <= 0 || circuitBreaker.Buckets <= 0 || circuitBreaker.Window < time.Duration(circuitBreaker.Buckets) ||
+		circuitBreaker.OpenTimeout <= 0 || circuitBreaker.HalfOpenRequests <= 0 {
+		return nil, fmt.Errorf("invalid circuit breaker settings in config file: %s", path)
+	}
+	if circuitBreaker.ErrorRate <= 0 || circuitBreaker.ErrorRate > 1 || circuitBreaker.TimeoutRate <= 0 || circuitBreaker.TimeoutRate > 1 {
+		return nil, fmt.Errorf("circuit breaker rates must be in (0, 1] in config file: %s", path)
+	}
+
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.MaxAttempts < 0 || cfg.MaxRetries < 0 || cfg.RetryTimeout < 0 {
+		return nil, fmt.Errorf("max_attempts, max_retries and retry_timeout must be positive in config file: %s", path)
+	}
+	retry := Retry{
+		BackoffMax:          cmp.Or(time.Duration(cfg.Retry.BackoffMax), time.Second),
+		NonIdempotent:       cfg.Retry.NonIdempotent,
+		MaxBodyBytes:        1 << 20,
+		BudgetPercent:       20,
+		MinRetryConcurrency: 3,
+	}
+	if cfg.Retry.MaxBodyBytes != nil {
+		retry.MaxBodyBytes = *cfg.Retry.MaxBodyBytes
+	}
+	if cfg.Retry.BudgetPercent != nil {
+		retry.BudgetPercent = *cfg.Retry.BudgetPercent
+	}
+	if cfg.Retry.MinRetryConcurrency != nil {
+		retry.MinRetryConcurrency = *cfg.Retry.MinRetryConcurrency
+	}
+	if retry.BackoffMax < time.Duration(cfg.RetryTimeout) || retry.MaxBodyBytes < 0 || retry.BudgetPercent < 0 || retry.MinRetryConcurrency < 0 {
+		return nil, fmt.Errorf("invalid retry settings in config file: %s", path)
+	}
+
+	if cfg.Metrics.Port < 0 || (cfg.Metrics.Port != 0 && (cfg.Metrics.Port == cfg.Port || cfg.Metrics.Port == cfg.AdminPort)) {
+		return nil, fmt.Errorf("metrics port must be positive and differ from port and admin_port in config file: %s", path)
+	}
+
+	if cfg.WatchInterval < 0 {
+		return nil, fmt.Errorf("config_watch_interval must be positive in config file: %s", path)
+	}
+	if cfg.HealthPoolTimeout <= 0 {
+		return nil, fmt.Errorf("health_pool_timeout must be positive in config file: %s", path)
 	}
 
 	return &Config{
 		cfg.Env,
 		cfg.LogFormat,
 		parsedUrls,
+		cfg.Strategy,
 		cfg.Port,
 		cfg.MaxRetries,
 		cfg.MaxAttempts,
@@ -98,5 +518,17 @@ func MustLoadConfig(path string) *Config {
 		time.Duration(cfg.RetryTimeout),
 		time.Duration(cfg.HealthPoolTimeout),
 		time.Duration(cfg.HealthServerTimeout),
-	}
+		time.Duration(cfg.LatencyDecay),
+		cfg.HashKey,
+		StickyConfig{cfg.Sticky.Cookie, time.Duration(cfg.Sticky.TTL)},
+		healthCheck,
+		outlierDetection,
+		circuitBreaker,
+		time.Duration(cfg.UpstreamTimeout),
+		cfg.AdminPort,
+		cmp.Or(cfg.AdminHost, DefaultAdminHost),
+		Metrics{cfg.Metrics.Port, cmp.Or(cfg.Metrics.Host, DefaultMetricsHost)},
+		retry,
+		time.Duration(cfg.WatchInterval),
+	}, nil
 }
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchConfig polls config file and calls onChange when its modification time or size changes.
+// It returns when ctx is done
+func WatchConfig(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				// file may be missing for a moment while an editor replaces it
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+
+			modTime, size = info.ModTime(), info.Size()
+			onChange()
+		}
+	}
+}
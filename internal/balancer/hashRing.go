@@ -0,0 +1,133 @@
+package balancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// pointsPerWeight is an amount of virtual nodes of a server per unit of weight (same as in ketama)
+const pointsPerWeight = 160
+
+type ringPoint struct {
+	hash   uint32
+	server *Server
+}
+
+// ConsistentHash is a ketama style consistent hashing strategy
+//
+// Every server is placed on a hash ring many times proportionally to its weight and a request
+// goes to the first healthy server clockwise from the hash of its key.
+// Adding or removing a server remaps only keys that belong to that server
+type ConsistentHash struct {
+	key     config.HashKeyConfig
+	members []*Server   // servers the ring was built from
+	weights []int       // weights of members when the ring was built
+	ring    []ringPoint // sorted by hash
+	mu      sync.RWMutex
+}
+
+func NewConsistentHash(key config.HashKeyConfig) *ConsistentHash {
+	return &ConsistentHash{key: key}
+}
+
+// Next returns the first healthy server on the ring for the request key
+func (ch *ConsistentHash) Next(r *http.Request, servers []*Server) *Server {
+	ring := ch.getRing(servers)
+	if len(ring) == 0 {
+		return nil
+	}
+
+	hash := hashKey(ch.requestKey(r))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+
+	// walk clockwise and skip unhealthy servers, every server is checked at most once
+	checked := make(map[*Server]bool, len(servers))
+	for i := 0; i < len(ring) && len(checked) < len(servers); i++ {
+		s := ring[(start+i)%len(ring)].server
+		if checked[s] {
+			continue
+		}
+		if s.IsAvailable() {
+			return s
+		}
+		checked[s] = true
+	}
+
+	return nil
+}
+
+// requestKey extracts a key from a request according to config.
+// Requests without a configured header or cookie are hashed by client ip
+func (ch *ConsistentHash) requestKey(r *http.Request) string {
+	switch ch.key.Source {
+	case config.HashKeySourceHeader:
+		if v := r.Header.Get(ch.key.Name); v != "" {
+			return v
+		}
+	case config.HashKeySourceCookie:
+		if c, err := r.Cookie(ch.key.Name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getRing returns a ring for the servers and rebuilds it if the set of servers or their weights have changed
+func (ch *ConsistentHash) getRing(servers []*Server) []ringPoint {
+	weights := make([]int, len(servers))
+	for i, s := range servers {
+		weights[i] = s.GetWeight()
+	}
+
+	ch.mu.RLock()
+	if slices.Equal(ch.members, servers) && slices.Equal(ch.weights, weights) {
+		ring := ch.ring
+		ch.mu.RUnlock()
+		return ring
+	}
+	ch.mu.RUnlock()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !slices.Equal(ch.members, servers) || !slices.Equal(ch.weights, weights) {
+		ch.members = slices.Clone(servers)
+		ch.weights = weights
+		ch.ring = buildRing(servers, weights)
+	}
+
+	return ch.ring
+}
+
+func buildRing(servers []*Server, weights []int) []ringPoint {
+	ring := make([]ringPoint, 0, len(servers)*pointsPerWeight)
+	for i, s := range servers {
+		points := weights[i] * pointsPerWeight
+		// every md5 digest gives 4 points on the ring
+		for i := 0; i < points/4; i++ {
+			digest := md5.Sum([]byte(s.URL.String() + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				ring = append(ring, ringPoint{binary.LittleEndian.Uint32(digest[j*4:]), s})
+			}
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hashKey(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
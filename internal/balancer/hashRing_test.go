@@ -0,0 +1,159 @@
+package balancer
+
+import (
+	"fmt"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const hashTestKeys = 10000
+
+// assignKeys returns servers consistent hashing chooses for every test key taken from a header
+func assignKeys(ch *ConsistentHash, servers []*Server) []*Server {
+	assigned := make([]*Server, hashTestKeys)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := range assigned {
+		r.Header.Set("X-User-ID", strconv.Itoa(i))
+		assigned[i] = ch.Next(r, servers)
+	}
+	return assigned
+}
+
+func newHashTestServers(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	servers := make([]*Server, n)
+	for i := range servers {
+		servers[i] = newTestServer(t, fmt.Sprintf("http://backend-%d:8080", i), 1)
+	}
+	return servers
+}
+
+// TestConsistentHashRemapsFewKeys checks that adding or removing a server moves only keys of that server
+func TestConsistentHashRemapsFewKeys(t *testing.T) {
+	const maxMoved = 0.15
+
+	servers := newHashTestServers(t, 11)
+	ch := NewConsistentHash(config.HashKeyConfig{Source: config.HashKeySourceHeader, Name: "X-User-ID"})
+	before := assignKeys(ch, servers[:10])
+
+	t.Run("server added", func(t *testing.T) {
+		added := servers[10]
+		after := assignKeys(ch, servers)
+
+		moved := 0
+		for i := range before {
+			if before[i] == after[i] {
+				continue
+			}
+			moved++
+			if after[i] != added {
+				t.Fatalf("key %d moved from %s to %s, keys may move only to the added server", i, before[i].URL, after[i].URL)
+			}
+		}
+		if share := float64(moved) / hashTestKeys; share == 0 || share > maxMoved {
+			t.Fatalf("%.1f%% of keys moved, want up to %.0f%%", share*100, maxMoved*100)
+		}
+	})
+
+	t.Run("server removed", func(t *testing.T) {
+		removed := servers[3]
+		after := assignKeys(ch, append(servers[:3:3], servers[4:10]...))
+
+		moved := 0
+		for i := range before {
+			if before[i] == after[i] {
+				continue
+			}
+			moved++
+			if before[i] != removed {
+				t.Fatalf("key %d moved from %s that is still in the pool", i, before[i].URL)
+			}
+		}
+		if share := float64(moved) / hashTestKeys; share == 0 || share > maxMoved {
+			t.Fatalf("%.1f%% of keys moved, want up to %.0f%%", share*100, maxMoved*100)
+		}
+	})
+}
+
+// TestConsistentHashWeights checks that a server gets a share of keys proportional to its weight
+func TestConsistentHashWeights(t *testing.T) {
+	servers := newHashTestServers(t, 3)
+	servers[0].SetWeight(2)
+
+	counts := make(map[*Server]int)
+	for _, s := range assignKeys(NewConsistentHash(config.HashKeyConfig{Source: config.HashKeySourceHeader, Name: "X-User-ID"}), servers) {
+		counts[s]++
+	}
+	// the heavy server expects a half of keys
+	if share := float64(counts[servers[0]]) / hashTestKeys; share < 0.4 || share > 0.6 {
+		t.Fatalf("server with weight 2 got %.1f%% of keys, want about 50%%", share*100)
+	}
+}
+
+// TestConsistentHashSkipsUnavailable checks that keys of an unavailable server go to the next servers on the ring
+// while the rest of keys stay where they were
+func TestConsistentHashSkipsUnavailable(t *testing.T) {
+	servers := newHashTestServers(t, 5)
+	ch := NewConsistentHash(config.HashKeyConfig{Source: config.HashKeySourceHeader, Name: "X-User-ID"})
+	before := assignKeys(ch, servers)
+
+	down := servers[2]
+	down.SetHealth(false)
+	after := assignKeys(ch, servers)
+	for i := range before {
+		switch {
+		case after[i] == nil || after[i] == down:
+			t.Fatalf("key %d is sent to %v, want an available server", i, after[i])
+		case before[i] != down && after[i] != before[i]:
+			t.Fatalf("key %d moved from %s that is available", i, before[i].URL)
+		}
+	}
+
+	// keys come back when the server is healthy again
+	down.SetHealth(true)
+	for i, s := range assignKeys(ch, servers) {
+		if s != before[i] {
+			t.Fatalf("key %d is sent to %s, want %s", i, s.URL, before[i].URL)
+		}
+	}
+
+	for _, s := range servers {
+		s.SetHealth(false)
+	}
+	if s := assignKeys(ch, servers)[0]; s != nil {
+		t.Fatalf("key is sent to %s while all servers are down", s.URL)
+	}
+}
+
+// TestConsistentHashKeySources checks that requests without a configured header or cookie are hashed by client ip
+func TestConsistentHashKeySources(t *testing.T) {
+	tests := []struct {
+		name string
+		key  config.HashKeyConfig
+		set  func(r *http.Request)
+		want string
+	}{
+		{"ip", config.HashKeyConfig{Source: config.HashKeySourceIP}, func(r *http.Request) {}, "192.0.2.1"},
+		{"header", config.HashKeyConfig{Source: config.HashKeySourceHeader, Name: "X-User-ID"},
+			func(r *http.Request) { r.Header.Set("X-User-ID", "42") }, "42"},
+		{"missing header", config.HashKeyConfig{Source: config.HashKeySourceHeader, Name: "X-User-ID"}, func(r *http.Request) {}, "192.0.2.1"},
+		{"cookie", config.HashKeyConfig{Source: config.HashKeySourceCookie, Name: "session"},
+			func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) }, "abc"},
+		{"missing cookie", config.HashKeyConfig{Source: config.HashKeySourceCookie, Name: "session"}, func(r *http.Request) {}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			tt.set(r)
+			if got := NewConsistentHash(tt.key).requestKey(r); got != tt.want {
+				t.Fatalf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
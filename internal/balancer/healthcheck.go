@@ -1,20 +1,21 @@
 package balancer
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"ivanjabrony/cloud-test/internal/balancer/config"
 	"ivanjabrony/cloud-test/internal/logger"
 	"log/slog"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"slices"
+	"sync"
 	"time"
 )
 
-const (
-	Attempts = "attempts"
-	Retries  = "retries"
-)
-
 func (s *Server) GetHealth() bool {
 	s.mu.RLock()
 	health := s.IsHealthy
@@ -23,52 +24,206 @@ func (s *Server) GetHealth() bool {
 	return health
 }
 
+// SetHealth changes health of a server immediately, consecutive probe counters start from scratch
 func (s *Server) SetHealth(health bool) {
 	s.mu.Lock()
 	s.IsHealthy = health
+	s.successes, s.failures = 0, 0
 	s.mu.Unlock()
 }
 
-// HealthCheck checks and updates Service availability
-func (s *Server) HealthCheck(logger *logger.MyLogger, cfg *config.Config) bool {
-	timeout := cfg.HealthServerTimeout
-	conn, err := net.DialTimeout("tcp", s.URL.Host, timeout)
+// maxHealthBodySize limits how much of a health check response body is read
+const maxHealthBodySize = 1 << 20
+
+// HealthChecker is an interface for active health checks of a server
+type HealthChecker interface {
+	Check(ctx context.Context, s *Server) error
+}
+
+// NewHealthChecker creates a health checker for a configured mode
+func NewHealthChecker(cfg config.HealthCheck) HealthChecker {
+	if cfg.Mode == config.HealthCheckHTTP {
+		return &HTTPChecker{cfg, &http.Client{
+			Timeout: cfg.Timeout,
+			// redirect is a valid answer of a backend, it must be checked against expected statuses as is
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}}
+	}
+
+	return &TCPChecker{cfg.Timeout}
+}
+
+// TCPChecker considers server healthy if it accepts tcp connections
+type TCPChecker struct {
+	timeout time.Duration
+}
+
+func (c *TCPChecker) Check(ctx context.Context, s *Server) error {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.URL.Host)
 	if err != nil {
-		logger.Error("Site unreachable", slog.Any("error", err))
+		return err
+	}
+
+	return conn.Close()
+}
+
+// HTTPChecker considers server healthy if it responds to a configured request
+// with an expected status and body
+type HTTPChecker struct {
+	cfg    config.HealthCheck
+	client *http.Client
+}
+
+func (c *HTTPChecker) Check(ctx context.Context, s *Server) error {
+	req, err := http.NewRequestWithContext(ctx, c.cfg.Method, s.URL.JoinPath(c.cfg.Path).String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.cfg.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !slices.ContainsFunc(c.cfg.ExpectedStatuses, func(sr config.StatusRange) bool { return sr.Contains(resp.StatusCode) }) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if c.cfg.Body == "" && c.cfg.BodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+	if err != nil {
+		return fmt.Errorf("couldn't read response body: %w", err)
+	}
+	if c.cfg.Body != "" && !bytes.Contains(body, []byte(c.cfg.Body)) {
+		return fmt.Errorf("response body doesn't contain %q", c.cfg.Body)
+	}
+	if c.cfg.BodyRegex != nil && !c.cfg.BodyRegex.Match(body) {
+		return fmt.Errorf("response body doesn't match %q", c.cfg.BodyRegex.String())
+	}
+
+	return nil
+}
+
+// HealthCheck checks Service availability
+func (s *Server) HealthCheck(ctx context.Context, logger *logger.MyLogger, checker HealthChecker) bool {
+	if err := checker.Check(ctx, s); err != nil {
+		logger.Debug("Health check failed", slog.String("URL", s.URL.String()), slog.Any("error", err))
 		return false
 	}
-	defer conn.Close()
 
 	return true
 }
 
+// reportProbe counts consecutive probe results and changes server health
+// only after rise successful or fall failed probes in a row. It returns true if health has changed
+func (s *Server) reportProbe(ok bool, rise, fall int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		s.successes++
+		s.failures = 0
+		if !s.IsHealthy && s.successes >= rise {
+			s.IsHealthy = true
+			return true
+		}
+		return false
+	}
+
+	s.failures++
+	s.successes = 0
+	if s.IsHealthy && s.failures >= fall {
+		s.IsHealthy = false
+		return true
+	}
+	return false
+}
+
 // HealthCheck checks and updates ServerPool availability
-func (p *ServerPool) HealthCheck(logger *logger.MyLogger, cfg *config.Config) {
-	for _, s := range p.servers {
+//
+// Every server is probed in its own goroutine after a random delay within configured jitter,
+// so backends are not hit at the same moment. It returns when all probes are done or ctx is cancelled
+func (p *ServerPool) HealthCheck(ctx context.Context, logger *logger.MyLogger) {
+	// all probes of a round use the same settings even if config is reloaded meanwhile
+	settings := p.settings.Load()
+
+	var wg sync.WaitGroup
+	for _, s := range p.Servers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe(ctx, logger, settings, p.metrics, s)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe waits for a random jitter delay and checks a single server
+func probe(ctx context.Context, logger *logger.MyLogger, settings *poolSettings, metrics *Metrics, s *Server) {
+	healthCfg := settings.cfg.HealthCheck
+	if healthCfg.Jitter > 0 {
+		delay := rand.N(healthCfg.Jitter)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	isHealthy := s.HealthCheck(ctx, logger, settings.checker)
+	if ctx.Err() != nil {
+		// probe was interrupted by shutdown, its result means nothing
+		return
+	}
+	metrics.observeHealthCheck(s, isHealthy)
+
+	if isHealthy && s.readmit(time.Now()) {
+		logger.Info("Ejected outlier re-admitted", slog.String("URL", s.URL.String()))
+	}
+
+	if s.reportProbe(isHealthy, healthCfg.Rise, healthCfg.Fall) {
 		status := "up"
-		isHealthy := s.HealthCheck(logger, cfg)
-		s.SetHealth(isHealthy)
 		if !isHealthy {
 			status = "down"
 		}
-
 		logger.Info(fmt.Sprintf("%s [%s]", s.URL.String(), status))
 	}
 }
 
 // HealthCheckRoutine is a goroutine that checks health of every server and updates it based on a Healthcheck func result
-func HealthCheckRoutine(ctx context.Context, logger *logger.MyLogger, cfg *config.Config, pool *ServerPool) { // logger
-	t := time.NewTicker(cfg.HealthPoolTimeout)
+//
+// Interval of checks follows reloaded config
+func HealthCheckRoutine(ctx context.Context, logger *logger.MyLogger, pool *ServerPool) {
+	interval := pool.Config().HealthPoolTimeout
+	t := time.NewTicker(interval)
 	defer t.Stop()
-	logger.Info("Ticker timout:", slog.Float64("seconds", cfg.HealthPoolTimeout.Seconds()))
+	logger.Info("Ticker timout:", slog.Float64("seconds", interval.Seconds()))
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-t.C:
-			logger.Info("Starting health check...")
-			pool.HealthCheck(logger, cfg)
-			logger.Info("Health check completed")
+			logger.Debug("Starting health check...")
+			pool.HealthCheck(ctx, logger)
+			logger.Debug("Health check completed")
+
+			if next := pool.Config().HealthPoolTimeout; next != interval {
+				interval = next
+				t.Reset(interval)
+				logger.Info("Ticker timout:", slog.Float64("seconds", interval.Seconds()))
+			}
 		}
 	}
 }
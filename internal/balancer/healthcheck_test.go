@@ -0,0 +1,249 @@
+package balancer
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPChecker(t *testing.T) {
+	success := []config.StatusRange{{From: 200, To: 299}}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		cfg     config.HealthCheck
+		wantErr bool
+	}{
+		{
+			name:    "expected status",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success},
+		},
+		{
+			name:    "unexpected status",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success},
+			wantErr: true,
+		},
+		{
+			name:    "one of several ranges",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTooManyRequests) },
+			cfg:     config.HealthCheck{ExpectedStatuses: append(success, config.StatusRange{From: 429, To: 429})},
+		},
+		{
+			name:    "redirect is not followed",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/ok", http.StatusFound) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success},
+			wantErr: true,
+		},
+		{
+			name:    "body contains substring",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"status":"ok"}`)) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success, Body: `"ok"`},
+		},
+		{
+			name:    "body lacks substring",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"status":"degraded"}`)) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success, Body: `"ok"`},
+			wantErr: true,
+		},
+		{
+			name:    "body matches regex",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("uptime: 42s")) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success, BodyRegex: regexp.MustCompile(`^uptime: \d+s$`)},
+		},
+		{
+			name:    "body doesn't match regex",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("starting")) },
+			cfg:     config.HealthCheck{ExpectedStatuses: success, BodyRegex: regexp.MustCompile(`^uptime: \d+s$`)},
+			wantErr: true,
+		},
+		{
+			name: "method, path and headers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead || r.URL.Path != "/base/healthz" || r.Host != "health.local" || r.Header.Get("X-Probe") != "1" {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			},
+			cfg: config.HealthCheck{
+				Method:           http.MethodHead,
+				Path:             "/healthz",
+				Headers:          map[string]string{"Host": "health.local", "X-Probe": "1"},
+				ExpectedStatuses: success,
+			},
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			},
+			cfg:     config.HealthCheck{ExpectedStatuses: success, Timeout: 10 * time.Millisecond},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			tt.cfg.Mode = config.HealthCheckHTTP
+			if tt.cfg.Method == "" {
+				tt.cfg.Method = http.MethodGet
+			}
+			server := newTestServer(t, srv.URL+"/base", 1)
+			err := NewHealthChecker(tt.cfg).Check(context.Background(), server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	checker := NewHealthChecker(config.HealthCheck{Mode: config.HealthCheckTCP, Timeout: time.Second})
+	if err := checker.Check(context.Background(), newTestServer(t, srv.URL, 1)); err != nil {
+		t.Fatalf("check of a listening server failed: %v", err)
+	}
+	if err := checker.Check(context.Background(), newTestServer(t, deadURL(t).String(), 1)); err == nil {
+		t.Fatal("check of a server nobody listens on passed")
+	}
+}
+
+func TestReportProbe(t *testing.T) {
+	const rise, fall = 2, 3
+
+	tests := []struct {
+		name    string
+		healthy bool
+		probes  []bool
+		want    []bool // health after every probe
+	}{
+		{
+			name: "healthy server goes down after fall failures", healthy: true,
+			probes: []bool{false, false, false},
+			want:   []bool{true, true, false},
+		},
+		{
+			name: "success resets failures", healthy: true,
+			probes: []bool{false, false, true, false, false, false},
+			want:   []bool{true, true, true, true, true, false},
+		},
+		{
+			name: "unhealthy server comes back after rise successes", healthy: false,
+			probes: []bool{true, true},
+			want:   []bool{false, true},
+		},
+		{
+			name: "failure resets successes", healthy: false,
+			probes: []bool{true, false, true, true},
+			want:   []bool{false, false, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "http://a", 1)
+			s.SetHealth(tt.healthy)
+
+			health := tt.healthy
+			for i, ok := range tt.probes {
+				changed := s.reportProbe(ok, rise, fall)
+				if got := s.GetHealth(); got != tt.want[i] || changed != (got != health) {
+					t.Fatalf("probe %d: health = %v, changed = %v, want health %v", i, got, changed, tt.want[i])
+				}
+				health = s.GetHealth()
+			}
+		})
+	}
+}
+
+// TestPoolHealthCheck checks that pool health checks apply rise and fall thresholds to a backend
+func TestPoolHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	pool := newHealthCheckPool(t, srv.URL, 0)
+	server := pool.Servers()[0]
+	ctx := context.Background()
+
+	healthy.Store(false)
+	for i, want := range []bool{true, true, false, false} {
+		pool.HealthCheck(ctx, pool.logger)
+		if got := server.GetHealth(); got != want {
+			t.Fatalf("failed check %d: health = %v, want %v", i+1, got, want)
+		}
+	}
+
+	healthy.Store(true)
+	for i, want := range []bool{false, true} {
+		pool.HealthCheck(ctx, pool.logger)
+		if got := server.GetHealth(); got != want {
+			t.Fatalf("successful check %d: health = %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+// TestPoolHealthCheckJitter checks that probes wait for a jitter delay and shutdown interrupts the wait
+func TestPoolHealthCheckJitter(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	pool := newHealthCheckPool(t, srv.URL, time.Hour)
+	server := pool.Servers()[0]
+	server.SetHealth(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	pool.HealthCheck(ctx, pool.logger)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("health check returned in %s after shutdown", elapsed)
+	}
+	if server.GetHealth() || server.successes != 0 {
+		t.Fatal("probe interrupted during jitter delay changed the server state")
+	}
+}
+
+func newHealthCheckPool(t *testing.T, rawURL string, jitter time.Duration) *ServerPool {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:     []config.Upstream{{URL: u, Weight: 1}},
+		Strategy: config.StrategyRoundRobin,
+		HealthCheck: config.HealthCheck{
+			Mode:             config.HealthCheckHTTP,
+			Method:           http.MethodGet,
+			Path:             "/",
+			ExpectedStatuses: []config.StatusRange{{From: 200, To: 299}},
+			Timeout:          time.Second,
+			Rise:             2,
+			Fall:             3,
+			Jitter:           jitter,
+		},
+	})
+}
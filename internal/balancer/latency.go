@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultLatencyDecay is used when latency decay is not configured
+const defaultLatencyDecay = 10 * time.Second
+
+// failureLatencyPenalty is the least latency observed for a request that failed
+const failureLatencyPenalty = time.Second
+
+// peakEWMA is an exponentially weighted moving average of a server's latency that reacts to spikes immediately
+//
+// Latency that is higher than the current average replaces it, lower latency is mixed in with a weight
+// that depends on the time passed since the previous observation. Without new observations
+// the average decays towards zero, so a server that was slow once gets a chance to prove itself again
+type peakEWMA struct {
+	decay float64   // time constant of the average in nanoseconds
+	cost  float64   // current average in nanoseconds
+	stamp time.Time // time of the last observation
+	mu    sync.Mutex
+}
+
+func newPeakEWMA(decay time.Duration) *peakEWMA {
+	if decay <= 0 {
+		decay = defaultLatencyDecay
+	}
+
+	return &peakEWMA{decay: float64(decay), stamp: time.Now()}
+}
+
+// Observe adds a new latency sample into the average
+func (e *peakEWMA) Observe(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(rtt)
+	if sample > e.cost {
+		e.cost = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / e.decay)
+		e.cost = e.cost*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+// Value returns the current average decayed by the time passed since the last observation
+func (e *peakEWMA) Value() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.cost * math.Exp(-float64(time.Since(e.stamp))/e.decay)
+}
@@ -0,0 +1,242 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects Prometheus metrics of a pool
+//
+// Counters and histograms are fed by LoadBalancer, reverse proxy hooks of servers and health checks.
+// Gauges of servers are read from the pool on every scrape, so removed servers disappear from them
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	inFlight        prometheus.Gauge
+	upstream        *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	attempts        prometheus.Histogram
+	retries         *prometheus.CounterVec
+	budgetExhausted prometheus.Counter
+	healthChecks    *prometheus.CounterVec
+}
+
+// NewMetrics creates metrics of a pool registered in their own registry
+func NewMetrics(pool *ServerPool) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_requests_total",
+			Help: "Requests handled by the balancer by method and status class of the response sent to a client.",
+		}, []string{"method", "code"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "balancer_in_flight_requests",
+			Help: "Requests that are being handled by the balancer, including waits between retries.",
+		}),
+		upstream: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_upstream_requests_total",
+			Help: "Requests proxied to backends by backend, method and status class, code is \"error\" if no response was received.",
+		}, []string{"backend", "method", "code"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "balancer_upstream_latency_seconds",
+			Help:    "Time between the start of proxying and receiving of response headers from a backend.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		attempts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "balancer_request_attempts",
+			Help:    "Amount of tries to proxy a request, including retries.",
+			Buckets: []float64{0, 1, 2, 3, 5, 8, 13},
+		}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_retries_total",
+			Help: "Retries of requests by backend they were sent to.",
+		}, []string{"backend"}),
+		budgetExhausted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "balancer_retry_budget_exhausted_total",
+			Help: "Retries that were not made because retry budget was exhausted.",
+		}),
+		healthChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "balancer_health_checks_total",
+			Help: "Active health checks by backend and result.",
+		}, []string{"backend", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.inFlight, m.upstream, m.upstreamLatency, m.attempts, m.retries, m.budgetExhausted, m.healthChecks,
+		&poolCollector{pool},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler returns a handler that serves metrics in Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// startRequest counts a request in flight, returned func must be called with a response status when the request is done
+func (m *Metrics) startRequest(r *http.Request) func(status int) {
+	if m == nil {
+		return func(int) {}
+	}
+
+	m.inFlight.Inc()
+	return func(status int) {
+		m.inFlight.Dec()
+		m.requests.WithLabelValues(methodLabel(r.Method), statusClass(status)).Inc()
+	}
+}
+
+// observeResponse records a response received from a backend
+func (m *Metrics) observeResponse(s *Server, resp *http.Response) {
+	if m == nil {
+		return
+	}
+
+	m.upstream.WithLabelValues(s.URL.String(), methodLabel(resp.Request.Method), statusClass(resp.StatusCode)).Inc()
+	if start, ok := resp.Request.Context().Value(startTimeKey).(time.Time); ok {
+		m.upstreamLatency.WithLabelValues(s.URL.String()).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeError records a request that got no response from a backend
+func (m *Metrics) observeError(s *Server, r *http.Request) {
+	if m == nil {
+		return
+	}
+
+	m.upstream.WithLabelValues(s.URL.String(), methodLabel(r.Method), "error").Inc()
+}
+
+// observeAttempts records amount of tries made to handle a request
+func (m *Metrics) observeAttempts(tries int) {
+	if m == nil {
+		return
+	}
+
+	m.attempts.Observe(float64(tries))
+}
+
+// observeRetry records a retry of a request sent to a server
+func (m *Metrics) observeRetry(s *Server) {
+	if m == nil {
+		return
+	}
+
+	m.retries.WithLabelValues(s.URL.String()).Inc()
+}
+
+// observeBudgetExhausted records a retry refused by retry budget
+func (m *Metrics) observeBudgetExhausted() {
+	if m == nil {
+		return
+	}
+
+	m.budgetExhausted.Inc()
+}
+
+// observeHealthCheck records a result of an active health check
+func (m *Metrics) observeHealthCheck(s *Server, ok bool) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.healthChecks.WithLabelValues(s.URL.String(), result).Inc()
+}
+
+// knownMethods limits method label values, so arbitrary methods of clients don't create new series
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClass returns a class of a status like 2xx, status 0 means that no response was written
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+var (
+	backendHealthyDesc = prometheus.NewDesc("balancer_backend_healthy",
+		"Health of a backend by active health checks, 1 if healthy.", []string{"backend"}, nil)
+	backendAvailableDesc = prometheus.NewDesc("balancer_backend_available",
+		"1 if a backend can receive new requests: healthy, not ejected, enabled, not draining and its circuit is not open.", []string{"backend"}, nil)
+	backendEjectedDesc = prometheus.NewDesc("balancer_backend_ejected",
+		"1 if a backend is ejected by outlier detection.", []string{"backend"}, nil)
+	backendInFlightDesc = prometheus.NewDesc("balancer_backend_in_flight_requests",
+		"Requests that are being proxied to a backend.", []string{"backend"}, nil)
+)
+
+// poolCollector reports current state of servers in a pool
+type poolCollector struct {
+	pool *ServerPool
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendHealthyDesc
+	ch <- backendAvailableDesc
+	ch <- backendEjectedDesc
+	ch <- backendInFlightDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.pool.Servers() {
+		backend := s.URL.String()
+		ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, boolToFloat(s.GetHealth()), backend)
+		ch <- prometheus.MustNewConstMetric(backendAvailableDesc, prometheus.GaugeValue, boolToFloat(s.IsAvailable()), backend)
+		ch <- prometheus.MustNewConstMetric(backendEjectedDesc, prometheus.GaugeValue, boolToFloat(s.IsEjected()), backend)
+		ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(s.ActiveRequests()), backend)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statusRecorder remembers a status of a response written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, reverse proxy uses it to flush streamed responses
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"io"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns metrics of a pool in Prometheus text format
+func scrape(t *testing.T, pool *ServerPool) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	MetricsHandler(pool).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status = %d, want 200", w.Code)
+	}
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	live := newBackend(t, "live")
+	dead := deadURL(t)
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:        []config.Upstream{{URL: live, Weight: 1}, {URL: dead, Weight: 1}},
+		Strategy:    config.StrategyRoundRobin,
+		MaxAttempts: 2,
+		Retry:       config.Retry{BudgetPercent: 100, MinRetryConcurrency: 10},
+		HealthCheck: config.HealthCheck{Mode: config.HealthCheckTCP, Fall: 1, Rise: 1},
+	})
+
+	// round robin starts from the dead server, so the request is retried on the live one
+	LoadBalancer(pool.logger, pool)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	pool.HealthCheck(t.Context(), pool.logger)
+
+	metrics := scrape(t, pool)
+	for _, want := range []string{
+		`balancer_requests_total{code="2xx",method="GET"} 1`,
+		`balancer_upstream_requests_total{backend="` + live.String() + `",code="2xx",method="GET"} 1`,
+		`balancer_upstream_requests_total{backend="` + dead.String() + `",code="error",method="GET"} 1`,
+		`balancer_upstream_latency_seconds_count{backend="` + live.String() + `"} 1`,
+		`balancer_request_attempts_count 1`,
+		`balancer_request_attempts_sum 2`,
+		`balancer_retries_total{backend="` + live.String() + `"} 1`,
+		`balancer_in_flight_requests 0`,
+		`balancer_health_checks_total{backend="` + live.String() + `",result="success"} 1`,
+		`balancer_health_checks_total{backend="` + dead.String() + `",result="failure"} 1`,
+		`balancer_backend_healthy{backend="` + live.String() + `"} 1`,
+		`balancer_backend_healthy{backend="` + dead.String() + `"} 0`,
+		`balancer_backend_available{backend="` + dead.String() + `"} 0`,
+		`balancer_backend_ejected{backend="` + live.String() + `"} 0`,
+		`balancer_backend_in_flight_requests{backend="` + live.String() + `"} 0`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+
+	// gauges of a removed server disappear
+	pool.RemoveServer(pool.Servers()[1])
+	if metrics := scrape(t, pool); strings.Contains(metrics, `balancer_backend_healthy{backend="`+dead.String()+`"}`) {
+		t.Fatal("metrics contain a removed server")
+	}
+}
+
+func TestMetricsBudgetExhausted(t *testing.T) {
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:        []config.Upstream{{URL: deadURL(t), Weight: 1}},
+		Strategy:    config.StrategyRoundRobin,
+		MaxRetries:  1,
+		MaxAttempts: 1,
+	})
+
+	LoadBalancer(pool.logger, pool)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	metrics := scrape(t, pool)
+	for _, want := range []string{
+		`balancer_retry_budget_exhausted_total 1`,
+		`balancer_requests_total{code="5xx",method="GET"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+// TestAdminHandlerHasNoMetrics checks that metrics are not served by admin API, so scraping them remotely
+// doesn't require exposing it
+func TestAdminHandlerHasNoMetrics(t *testing.T) {
+	_, h := newAdminTestPool(t)
+	if code := adminRequest(t, h, http.MethodGet, "/metrics", "", nil); code != http.StatusNotFound {
+		t.Fatalf("admin API /metrics status = %d, want 404", code)
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	if got := methodLabel("PROPFIND"); got != "OTHER" {
+		t.Fatalf("label of an unknown method = %q, want OTHER", got)
+	}
+	if got := methodLabel(http.MethodPatch); got != http.MethodPatch {
+		t.Fatalf("label of PATCH = %q", got)
+	}
+}
@@ -0,0 +1,218 @@
+package balancer
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+// outlierState is a passive health state of a server collected from live traffic
+type outlierState struct {
+	consecutive5xx     int
+	consecutiveGateway int
+	requests           int // requests in current detection interval
+	successes          int // successful requests in current detection interval
+	ejected            bool
+	ejectedUntil       time.Time
+	ejections          int // multiplier of ejection time, grows with every ejection
+}
+
+// OutlierDetector ejects servers that fail live requests and lets active health checks re-admit them
+//
+// A server is ejected after configured amount of consecutive 5xx responses or gateway errors,
+// or if its success rate is too low compared to the rest of the pool.
+// Ejection time grows exponentially with every ejection in a row
+type OutlierDetector struct {
+	cfg    config.OutlierDetection
+	pool   *ServerPool
+	logger *logger.MyLogger
+}
+
+func NewOutlierDetector(cfg config.OutlierDetection, pool *ServerPool, logger *logger.MyLogger) *OutlierDetector {
+	return &OutlierDetector{cfg, pool, logger}
+}
+
+// isGatewayError checks if status means that the server itself couldn't handle a request
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// ReportResponse records a response status of a server
+func (od *OutlierDetector) ReportResponse(s *Server, status int) {
+	if od == nil {
+		return
+	}
+
+	s.mu.Lock()
+	o := &s.outlier
+	o.requests++
+	if status < http.StatusInternalServerError {
+		o.successes++
+		o.consecutive5xx, o.consecutiveGateway = 0, 0
+		s.mu.Unlock()
+		return
+	}
+
+	o.consecutive5xx++
+	if isGatewayError(status) {
+		o.consecutiveGateway++
+	} else {
+		o.consecutiveGateway = 0
+	}
+	reason := od.consecutiveReason(o)
+	s.mu.Unlock()
+
+	if reason != "" {
+		od.eject(s, reason)
+	}
+}
+
+// ReportGatewayError records a failure to get any response from a server
+func (od *OutlierDetector) ReportGatewayError(s *Server) {
+	od.ReportResponse(s, http.StatusBadGateway)
+}
+
+// consecutiveReason returns a reason of ejection if consecutive errors reached configured limits
+func (od *OutlierDetector) consecutiveReason(o *outlierState) string {
+	switch {
+	case od.cfg.Consecutive5xx > 0 && o.consecutive5xx >= od.cfg.Consecutive5xx:
+		return "consecutive 5xx"
+	case od.cfg.ConsecutiveGatewayFailure > 0 && o.consecutiveGateway >= od.cfg.ConsecutiveGatewayFailure:
+		return "consecutive gateway failures"
+	}
+	return ""
+}
+
+// eject takes a server out of rotation unless too many servers of the pool are already ejected
+func (od *OutlierDetector) eject(s *Server, reason string) {
+	servers := od.pool.Servers()
+	ejected := 0
+	for _, server := range servers {
+		if server.IsEjected() {
+			ejected++
+		}
+	}
+	if ejected*100 >= od.cfg.MaxEjectionPercent*len(servers) {
+		od.logger.Warn("Outlier is not ejected, max ejection percent reached",
+			slog.String("URL", s.URL.String()), slog.String("reason", reason))
+		return
+	}
+
+	s.mu.Lock()
+	o := &s.outlier
+	if o.ejected {
+		s.mu.Unlock()
+		return
+	}
+	o.ejections++
+	ejectionTime := od.cfg.BaseEjectionTime * time.Duration(1<<min(o.ejections-1, 16))
+	ejectionTime = min(ejectionTime, od.cfg.MaxEjectionTime)
+	o.ejected = true
+	o.ejectedUntil = time.Now().Add(ejectionTime)
+	o.consecutive5xx, o.consecutiveGateway = 0, 0
+	s.mu.Unlock()
+
+	od.logger.Warn("Outlier ejected",
+		slog.String("URL", s.URL.String()),
+		slog.String("reason", reason),
+		slog.Duration("ejection_time", ejectionTime))
+}
+
+// readmit returns an ejected server into rotation after a successful active health check
+// if its ejection time is over. It returns true if the server was re-admitted
+func (s *Server) readmit(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.outlier.ejected || now.Before(s.outlier.ejectedUntil) {
+		return false
+	}
+	s.outlier.ejected = false
+	return true
+}
+
+// IsEjected checks if the server is ejected by outlier detection
+func (s *Server) IsEjected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.outlier.ejected
+}
+
+// detectSuccessRateOutliers ejects servers whose success rate over the last interval
+// is lower than the pool average by more than configured amount of standard deviations
+func (od *OutlierDetector) detectSuccessRateOutliers() {
+	type sample struct {
+		server *Server
+		rate   float64
+	}
+
+	servers := od.pool.Servers()
+	samples := make([]sample, 0, len(servers))
+	for _, s := range servers {
+		s.mu.Lock()
+		o := &s.outlier
+		if o.requests >= od.cfg.SuccessRateRequestVolume && o.requests > 0 && !o.ejected {
+			samples = append(samples, sample{s, float64(o.successes) / float64(o.requests)})
+		}
+		// ejection multiplier cools down while server behaves well
+		if !o.ejected && o.ejections > 0 && o.successes == o.requests {
+			o.ejections--
+		}
+		o.requests, o.successes = 0, 0
+		s.mu.Unlock()
+	}
+
+	if len(samples) == 0 || len(samples) < od.cfg.SuccessRateMinimumHosts {
+		return
+	}
+
+	var mean float64
+	for _, smp := range samples {
+		mean += smp.rate
+	}
+	mean /= float64(len(samples))
+
+	var variance float64
+	for _, smp := range samples {
+		variance += (smp.rate - mean) * (smp.rate - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(samples)))
+
+	threshold := mean - od.cfg.SuccessRateStdevFactor*stdev
+	for _, smp := range samples {
+		if smp.rate < threshold {
+			od.eject(smp.server, "low success rate")
+		}
+	}
+}
+
+// OutlierDetectionRoutine is a goroutine that periodically analyses success rate of servers in a pool
+//
+// Outlier detection may be enabled, disabled or reconfigured by config reload while the routine is running
+func OutlierDetectionRoutine(ctx context.Context, logger *logger.MyLogger, pool *ServerPool) {
+	interval := pool.Config().OutlierDetection.Interval
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	logger.Info("Outlier detection interval:", slog.Float64("seconds", interval.Seconds()))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if od := pool.outliers(); od != nil {
+				od.detectSuccessRateOutliers()
+			}
+
+			if next := pool.Config().OutlierDetection.Interval; next != interval {
+				interval = next
+				t.Reset(interval)
+				logger.Info("Outlier detection interval:", slog.Float64("seconds", interval.Seconds()))
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package balancer
+
+import (
+	"fmt"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testOutlierDetection = config.OutlierDetection{
+	Enabled:                   true,
+	Consecutive5xx:            3,
+	ConsecutiveGatewayFailure: 2,
+	Interval:                  time.Second,
+	BaseEjectionTime:          time.Minute,
+	MaxEjectionTime:           3 * time.Minute,
+	MaxEjectionPercent:        50,
+	SuccessRateMinimumHosts:   3,
+	SuccessRateRequestVolume:  10,
+	SuccessRateStdevFactor:    1.9,
+}
+
+// newOutlierPool returns a pool of n servers with outlier detection and its detector
+func newOutlierPool(t *testing.T, n int, cfg config.OutlierDetection) (*ServerPool, *OutlierDetector) {
+	t.Helper()
+
+	upstreams := make([]config.Upstream, n)
+	for i := range upstreams {
+		u, err := url.Parse(fmt.Sprintf("http://backend-%d:8080", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams[i] = config.Upstream{URL: u, Weight: 1}
+	}
+
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:             upstreams,
+		Strategy:         config.StrategyRoundRobin,
+		OutlierDetection: cfg,
+	})
+	return pool, pool.outliers()
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		wantEjected bool
+	}{
+		{"consecutive 5xx", []int{500, 500, 500}, true},
+		{"5xx interrupted by success", []int{500, 500, 200, 500, 500}, false},
+		{"client errors are successes", []int{500, 404, 500, 429, 500}, false},
+		{"consecutive gateway errors", []int{502, 504}, true},
+		{"gateway errors interrupted by 500", []int{503, 500}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, od := newOutlierPool(t, 4, testOutlierDetection)
+			s := pool.Servers()[0]
+			for _, status := range tt.statuses {
+				od.ReportResponse(s, status)
+			}
+
+			if s.IsEjected() != tt.wantEjected {
+				t.Fatalf("ejected = %v, want %v", s.IsEjected(), tt.wantEjected)
+			}
+			if s.IsAvailable() == tt.wantEjected {
+				t.Fatalf("available = %v while ejected = %v", s.IsAvailable(), tt.wantEjected)
+			}
+		})
+	}
+}
+
+func TestOutlierGatewayErrorsWithoutResponse(t *testing.T) {
+	pool, od := newOutlierPool(t, 4, testOutlierDetection)
+	s := pool.Servers()[0]
+
+	od.ReportGatewayError(s)
+	od.ReportGatewayError(s)
+	if !s.IsEjected() {
+		t.Fatal("server that failed to respond twice in a row is not ejected")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	pool, od := newOutlierPool(t, 4, testOutlierDetection)
+	servers := pool.Servers()
+
+	for _, s := range servers {
+		for range testOutlierDetection.Consecutive5xx {
+			od.ReportResponse(s, http.StatusInternalServerError)
+		}
+	}
+
+	ejected := 0
+	for _, s := range servers {
+		if s.IsEjected() {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("%d of 4 servers are ejected, want 50%%", ejected)
+	}
+}
+
+// TestOutlierEjectionTime checks that ejection time doubles with every ejection in a row up to the max
+// and an ejected server is re-admitted only after its ejection time
+func TestOutlierEjectionTime(t *testing.T) {
+	pool, od := newOutlierPool(t, 4, testOutlierDetection)
+	s := pool.Servers()[0]
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		ejectedAt := time.Now()
+		od.eject(s, "test")
+		ejectedUntil := s.outlier.ejectedUntil
+		if got := ejectedUntil.Sub(ejectedAt); got < want || got > want+time.Second {
+			t.Fatalf("ejection time = %s, want %s", got, want)
+		}
+
+		if s.readmit(ejectedUntil.Add(-time.Millisecond)) || !s.IsEjected() {
+			t.Fatal("server is re-admitted before its ejection time is over")
+		}
+		if !s.readmit(ejectedUntil) || s.IsEjected() {
+			t.Fatal("server is not re-admitted after its ejection time")
+		}
+	}
+}
+
+// TestOutlierSuccessRate checks that a server with a success rate far below the pool average is ejected
+// and servers with too few requests are not judged
+func TestOutlierSuccessRate(t *testing.T) {
+	pool, od := newOutlierPool(t, 6, testOutlierDetection)
+	servers := pool.Servers()
+
+	report := func(s *Server, requests, failures int) {
+		for i := range requests {
+			status := http.StatusOK
+			if i < failures {
+				status = http.StatusInternalServerError
+			}
+			// failures are spread, so consecutive errors don't eject the server
+			od.ReportResponse(s, status)
+			if status != http.StatusOK {
+				od.ReportResponse(s, http.StatusOK)
+			}
+		}
+	}
+
+	for _, s := range servers[:4] {
+		report(s, 20, 0)
+	}
+	report(servers[4], 20, 15) // success rate is 20/35
+	report(servers[5], 4, 4)   // 8 requests are too few to be judged
+
+	od.detectSuccessRateOutliers()
+
+	for i, s := range servers {
+		if want := i == 4; s.IsEjected() != want {
+			t.Fatalf("server %d: ejected = %v, want %v", i, s.IsEjected(), want)
+		}
+	}
+	if s := servers[0]; s.outlier.requests != 0 || s.outlier.successes != 0 {
+		t.Fatal("request counters are not reset after the interval")
+	}
+}
+
+func TestOutlierSuccessRateMinimumHosts(t *testing.T) {
+	pool, od := newOutlierPool(t, 2, testOutlierDetection)
+	servers := pool.Servers()
+
+	for range 20 {
+		od.ReportResponse(servers[0], http.StatusOK)
+		od.ReportResponse(servers[1], http.StatusOK)
+		od.ReportResponse(servers[1], http.StatusInternalServerError)
+	}
+	od.detectSuccessRateOutliers()
+
+	if servers[1].IsEjected() {
+		t.Fatal("server is ejected by success rate of a pool smaller than success_rate_minimum_hosts")
+	}
+}
+
+// TestOutlierReadmittedByHealthCheck checks that an active health check returns an ejected server
+// once its ejection time is over
+func TestOutlierReadmittedByHealthCheck(t *testing.T) {
+	pool := newHealthCheckPool(t, newBackend(t, "a").String(), 0)
+	cfg := *pool.Config()
+	cfg.OutlierDetection = testOutlierDetection
+	cfg.OutlierDetection.BaseEjectionTime = time.Millisecond
+	cfg.OutlierDetection.MaxEjectionTime = time.Millisecond
+	pool.Apply(&cfg)
+	s := pool.Servers()[0]
+
+	pool.outliers().ReportGatewayError(s)
+	pool.outliers().ReportGatewayError(s)
+	if !s.IsEjected() {
+		t.Fatal("server is not ejected")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	pool.HealthCheck(t.Context(), pool.logger)
+	if s.IsEjected() || !s.IsAvailable() {
+		t.Fatal("server is not re-admitted by a successful health check")
+	}
+}
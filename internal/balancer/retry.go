@@ -0,0 +1,165 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// attempt is a state of a single try to proxy a request, it is passed to the reverse proxy through context
+type attempt struct {
+	number int   // number of a server the request is tried on, starts from 1
+	retry  int   // number of a retry on the same server, starts from 0
+	err    error // gateway error, nil if the server has responded
+}
+
+func withAttempt(r *http.Request, a *attempt) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), attemptKey, a))
+}
+
+func attemptFromContext(r *http.Request) (*attempt, bool) {
+	a, ok := r.Context().Value(attemptKey).(*attempt)
+	return a, ok
+}
+
+// GetAttemptsFromContext returns a number of a server the request is tried on
+func GetAttemptsFromContext(r *http.Request) int {
+	if a, ok := attemptFromContext(r); ok {
+		return a.number
+	}
+	return 1
+}
+
+// GetRetryFromContext returns a number of a retry of the request on the same server
+func GetRetryFromContext(r *http.Request) int {
+	if a, ok := attemptFromContext(r); ok {
+		return a.retry
+	}
+	return 0
+}
+
+// idempotentMethods are methods that can be safely sent more than once (RFC 9110)
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// isRetryable checks if the request may be sent once again according to retry config.
+// Request with an Idempotency-Key header is considered idempotent regardless of its method
+func isRetryable(cfg config.Retry, r *http.Request) bool {
+	return cfg.NonIdempotent || idempotentMethods[r.Method] || r.Header.Get("Idempotency-Key") != ""
+}
+
+// canRetry checks if config allows to send a request more than once
+func canRetry(cfg *config.Config) bool {
+	return cfg.MaxRetries > 0 || cfg.MaxAttempts > 1
+}
+
+// bufferBody reads request body into memory so it can be replayed on retries.
+// It returns false if the body is bigger than the limit, in that case the body is left readable but not replayable
+func bufferBody(r *http.Request, limit int64) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		return false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// give back what was read so the request still can be proxied once
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false
+	}
+
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
+}
+
+// rewindBody prepares buffered request body for another try
+func rewindBody(r *http.Request) {
+	if r.GetBody != nil {
+		r.Body, _ = r.GetBody()
+	}
+}
+
+// backoff returns a delay before a retry: exponential growth from base up to max with equal jitter
+func backoff(base, maxDelay time.Duration, retry int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	delay := min(base<<min(retry-1, 30), maxDelay)
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// sleepContext waits for a delay and returns false if ctx is done earlier
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// RetryBudget limits retries in flight to a share of requests in flight,
+// so retries can't multiply load on a pool that is already failing
+type RetryBudget struct {
+	percent        atomic.Int64
+	minConcurrency atomic.Int64
+	requests       atomic.Int64
+	retries        atomic.Int64
+}
+
+func NewRetryBudget(cfg config.Retry) *RetryBudget {
+	b := &RetryBudget{}
+	b.Update(cfg)
+	return b
+}
+
+// Update changes limits of the budget, requests and retries in flight are kept
+func (b *RetryBudget) Update(cfg config.Retry) {
+	b.percent.Store(int64(cfg.BudgetPercent))
+	b.minConcurrency.Store(int64(cfg.MinRetryConcurrency))
+}
+
+// StartRequest counts a request in flight, returned func must be called when the request is done
+func (b *RetryBudget) StartRequest() func() {
+	b.requests.Add(1)
+	return func() { b.requests.Add(-1) }
+}
+
+// TryRetry reserves a retry if the budget allows it, returned func must be called when the retry is done
+func (b *RetryBudget) TryRetry() (func(), bool) {
+	allowed := max(b.minConcurrency.Load(), b.requests.Load()*b.percent.Load()/100)
+	if b.retries.Add(1) > allowed {
+		b.retries.Add(-1)
+		return nil, false
+	}
+
+	return func() { b.retries.Add(-1) }, true
+}
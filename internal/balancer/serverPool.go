@@ -2,110 +2,550 @@ package balancer
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"ivanjabrony/cloud-test/internal/balancer/config"
 	"ivanjabrony/cloud-test/internal/logger"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Server struct {
+	ID           string // stable identifier that is safe to expose to clients
 	URL          *url.URL
 	IsHealthy    bool
 	ReverseProxy *httputil.ReverseProxy
+	weight       atomic.Int64    // share of traffic for weighted strategies
+	active       atomic.Int64    // amount of requests that are being proxied right now
+	latency      *peakEWMA       // latency of proxied responses
+	successes    int             // consecutive successful health checks
+	failures     int             // consecutive failed health checks
+	outlier      outlierState    // state of passive health checks
+	breaker      *CircuitBreaker // nil if circuit breakers are disabled
+	disabled     bool            // taken out of rotation through admin API
+	draining     bool            // waits for requests in flight to finish before removal
+	drainGen     uint64          // number of the last drain, a canceled drain must not remove the server
+	configDrain  bool            // drained because the server was removed from config, not through admin API
+	runtime      bool            // added through admin API and not listed in config, config reloads keep it
 	mu           sync.RWMutex
 }
 
+type ctxKey int
+
+const (
+	startTimeKey ctxKey = iota
+	attemptKey
+)
+
+// ServeHTTP proxies request to the server and keeps track of in-flight requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.active.Add(1)
+	defer s.active.Add(-1)
+
+	ctx := context.WithValue(r.Context(), startTimeKey, time.Now())
+	s.ReverseProxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// observeLatency records the time passed between the start of proxying and receiving of response headers
+func (s *Server) observeLatency(resp *http.Response) {
+	if start, ok := resp.Request.Context().Value(startTimeKey).(time.Time); ok {
+		s.latency.Observe(time.Since(start))
+	}
+}
+
+// observeFailure records latency of a request the server failed to respond to. Failures are often fast,
+// so the time passed is raised to a penalty, otherwise a server that refuses connections would look the fastest
+func (s *Server) observeFailure(r *http.Request) {
+	if start, ok := r.Context().Value(startTimeKey).(time.Time); ok {
+		s.latency.Observe(max(time.Since(start), failureLatencyPenalty))
+	}
+}
+
+// IsAvailable checks if the server can receive new requests: it must be healthy, not ejected,
+// enabled, not draining and its circuit breaker must not be open
+func (s *Server) IsAvailable() bool {
+	s.mu.RLock()
+	available := s.IsHealthy && !s.outlier.ejected && !s.disabled && !s.draining
+	s.mu.RUnlock()
+
+	return available && s.breaker.Ready()
+}
+
+// SetEnabled takes the server out of rotation or returns it back
+func (s *Server) SetEnabled(enabled bool) {
+	s.mu.Lock()
+	s.disabled = !enabled
+	s.mu.Unlock()
+}
+
+// setDraining marks the server as draining and returns a number of this drain
+func (s *Server) setDraining(byConfig bool) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = true
+	s.configDrain = byConfig
+	s.drainGen++
+	return s.drainGen
+}
+
+// isConfigDrain checks if the server is draining because it was removed from config
+func (s *Server) isConfigDrain() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.draining && s.configDrain
+}
+
+// isDraining checks if a drain with the number is still going
+func (s *Server) isDraining(gen uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.draining && s.drainGen == gen
+}
+
+// isRuntime checks if the server was added through admin API and is not managed by config
+func (s *Server) isRuntime() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.runtime
+}
+
+// AdminState returns a state of the server set through admin API: active, disabled or draining
+func (s *Server) AdminState() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch {
+	case s.draining:
+		return "draining"
+	case s.disabled:
+		return "disabled"
+	default:
+		return "active"
+	}
+}
+
+// GetWeight returns the server's weight
+func (s *Server) GetWeight() int {
+	return int(s.weight.Load())
+}
+
+// SetWeight changes the server's share of traffic
+func (s *Server) SetWeight(weight int) {
+	s.weight.Store(int64(max(weight, config.DefaultWeight)))
+}
+
+// BreakerState returns state of the server's circuit breaker
+func (s *Server) BreakerState() BreakerState {
+	return s.breaker.State()
+}
+
+// Latency returns current peak EWMA latency of the server in nanoseconds
+func (s *Server) Latency() float64 {
+	return s.latency.Value()
+}
+
+// ActiveRequests returns amount of in-flight requests of the server
+func (s *Server) ActiveRequests() int64 {
+	return s.active.Load()
+}
+
 type ServerPool struct {
-	servers        []*Server
+	servers        []*Server // replaced on every change, so a taken snapshot is never modified
 	urlStrToServer map[string]*Server
-	curId          uint64
+	idToServer     map[string]*Server
+	settings       atomic.Pointer[poolSettings]
+	retryBudget    *RetryBudget
+	metrics        *Metrics
+	logger         *logger.MyLogger
+	transport      http.RoundTripper
+	mu             sync.RWMutex
+}
+
+// poolSettings is a part of the pool that depends on config and is replaced at once when config is reloaded
+type poolSettings struct {
+	cfg      *config.Config
+	strategy Strategy
+	checker  HealthChecker
+	outliers *OutlierDetector // nil if outlier detection is disabled
 }
 
 // Global is a main pool that contains all configured servers
 var Global ServerPool
 
-// NextIndex increases curId value atomicly
-func (p *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&p.curId, uint64(1)) % uint64(len(p.servers)))
+// ErrServerExists is returned when a server with the same URL is already in a pool
+var ErrServerExists = errors.New("server already exists")
+
+// Servers returns a snapshot of servers in the pool
+func (p *ServerPool) Servers() []*Server {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.servers
+}
+
+// GetServer finds a server by its id
+func (p *ServerPool) GetServer(id string) (*Server, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	s, ok := p.idToServer[id]
+	return s, ok
 }
 
 // AddServer adds server to the ServerPool
-func (p *ServerPool) AddServer(s *Server) {
-	p.servers = append(p.servers, s)
+func (p *ServerPool) AddServer(s *Server) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.urlStrToServer[s.URL.String()]; ok {
+		return ErrServerExists
+	}
+
+	servers := make([]*Server, 0, len(p.servers)+1)
+	p.servers = append(append(servers, p.servers...), s)
 	p.urlStrToServer[s.URL.String()] = s
+	p.idToServer[s.ID] = s
+	return nil
+}
+
+// AddRuntimeServer adds a server added through admin API to the ServerPool.
+// Such server is kept on config reloads until it is removed through admin API
+func (p *ServerPool) AddRuntimeServer(s *Server) error {
+	s.mu.Lock()
+	s.runtime = true
+	s.mu.Unlock()
+
+	return p.AddServer(s)
+}
+
+// RemoveServer removes server from the ServerPool, requests that are in flight are not interrupted
+func (p *ServerPool) RemoveServer(s *Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeServer(s)
+}
+
+// removeServer removes server from the ServerPool, must be called with locked mutex
+func (p *ServerPool) removeServer(s *Server) {
+	if p.idToServer[s.ID] != s {
+		return
+	}
+
+	p.servers = slices.DeleteFunc(slices.Clone(p.servers), func(server *Server) bool { return server == s })
+	delete(p.urlStrToServer, s.URL.String())
+	delete(p.idToServer, s.ID)
+}
+
+// DrainServer stops sending new requests to the server, waits for its requests in flight to finish
+// or the timeout to pass and removes it from the pool. The server is kept if the drain is canceled meanwhile
+func (p *ServerPool) DrainServer(s *Server, timeout time.Duration) {
+	p.drainServer(s, timeout, false)
+}
+
+// drainServer drains the server, byConfig tells that it is drained because it was removed from config
+func (p *ServerPool) drainServer(s *Server, timeout time.Duration, byConfig bool) {
+	gen := s.setDraining(byConfig)
+	p.logger.Info("Draining server", slog.String("URL", s.URL.String()), slog.Int64("active", s.ActiveRequests()))
+
+	go func() {
+		deadline := time.Now().Add(timeout)
+		t := time.NewTicker(100 * time.Millisecond)
+		defer t.Stop()
+		for s.isDraining(gen) && s.ActiveRequests() > 0 && time.Now().Before(deadline) {
+			<-t.C
+		}
+
+		// the check and the removal are done under the pool lock, so CancelDrain can't happen between them
+		p.mu.Lock()
+		drained := s.isDraining(gen)
+		if drained {
+			p.removeServer(s)
+		}
+		p.mu.Unlock()
+
+		if drained {
+			p.logger.Info("Server drained and removed", slog.String("URL", s.URL.String()), slog.Int64("active", s.ActiveRequests()))
+		}
+	}()
+}
+
+// CancelDrain returns a draining server into rotation. It returns false if the server is not draining
+// or has already been removed from the pool
+func (p *ServerPool) CancelDrain(s *Server) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.idToServer[s.ID] != s {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.draining {
+		return false
+	}
+	s.draining = false
+	return true
 }
 
 // ChangeServerStatus changes a status of a backend
 func (p *ServerPool) ChangeServerStatus(backendUrl *url.URL, health bool) {
-	p.urlStrToServer[backendUrl.String()].SetHealth(health)
+	p.mu.RLock()
+	s, ok := p.urlStrToServer[backendUrl.String()]
+	p.mu.RUnlock()
+
+	if ok {
+		s.SetHealth(health)
+	}
 }
 
-// GetNextServer finds a next avaliable server
-func (p *ServerPool) GetNextServer() *Server {
-	// loop entire backends to find out an Alive backend
-	next := p.NextIndex()
-	l := len(p.servers) + next // start from next and move a full cycle
+// GetNextServer finds a next avaliable server for a request
+//
+// If the request is pinned to a healthy server with an affinity cookie that server is returned,
+// otherwise the server is chosen using configured strategy
+//
+// Circuit breaker of a chosen server may refuse the request if it has no free trial slots,
+// in that case the choice is repeated
+func (p *ServerPool) GetNextServer(r *http.Request) *Server {
+	if s := p.pinnedServer(r); s != nil && s.breaker.Allow() {
+		return s
+	}
 
-	for i := next; i < l; i++ {
-		idx := i % len(p.servers)       // take an index by modding
-		if p.servers[idx].GetHealth() { // if we have an alive backend, use it and store if its not the original one
-			if i != next {
-				atomic.StoreUint64(&p.curId, uint64(idx))
-			}
-			return p.servers[idx]
+	strategy := p.settings.Load().strategy
+	servers := p.Servers()
+	for range servers {
+		s := strategy.Next(r, servers)
+		if s == nil {
+			return nil
+		}
+		if s.breaker.Allow() {
+			return s
 		}
 	}
 
 	return nil
 }
 
+// Metrics returns metrics of the pool
+func (p *ServerPool) Metrics() *Metrics {
+	return p.metrics
+}
+
+// Config returns current config of the pool
+func (p *ServerPool) Config() *config.Config {
+	return p.settings.Load().cfg
+}
+
+// outliers returns current outlier detector, nil if outlier detection is disabled
+func (p *ServerPool) outliers() *OutlierDetector {
+	return p.settings.Load().outliers
+}
+
+// NewServer creates a server for an upstream with a reverse proxy that reports results to the pool
+func (p *ServerPool) NewServer(upstream config.Upstream) *Server {
+	cfg := p.Config()
+	url := upstream.URL
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = p.transport
+	server := &Server{
+		ID:           serverID(url),
+		URL:          url,
+		IsHealthy:    true,
+		ReverseProxy: proxy,
+		latency:      newPeakEWMA(cfg.LatencyDecay),
+	}
+	server.SetWeight(upstream.Weight)
+	if cfg.CircuitBreaker.Enabled {
+		server.breaker = NewCircuitBreaker(cfg.CircuitBreaker, url.String(), p.logger)
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		server.observeLatency(resp)
+		p.metrics.observeResponse(server, resp)
+		p.outliers().ReportResponse(server, resp.StatusCode)
+		server.breaker.Report(responseOutcome(resp.StatusCode))
+		p.SetAffinity(resp, server)
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+		res := errorOutcome(err)
+		if res != outcomeIgnored {
+			server.observeFailure(request)
+			p.outliers().ReportGatewayError(server)
+		}
+		server.breaker.Report(res)
+		p.metrics.observeError(server, request)
+		p.logger.Error("Site unreachable", slog.String("URL", url.String()), slog.Any("error", err))
+
+		// load balancer decides if the request is retried, otherwise respond as usual reverse proxy does
+		if a, ok := attemptFromContext(request); ok {
+			a.err = err
+			return
+		}
+		writer.WriteHeader(http.StatusBadGateway)
+	}
+
+	return server
+}
+
+// newSettings builds pool settings from config. Strategy of the previous settings is kept
+// if it is configured the same way, so it doesn't lose its state
+func (p *ServerPool) newSettings(cfg *config.Config, prev *poolSettings) *poolSettings {
+	settings := &poolSettings{cfg: cfg, checker: NewHealthChecker(cfg.HealthCheck)}
+
+	if prev != nil && prev.cfg.Strategy == cfg.Strategy && prev.cfg.HashKey == cfg.HashKey {
+		settings.strategy = prev.strategy
+	} else {
+		strategy, err := NewStrategy(cfg)
+		if err != nil {
+			p.logger.Error("Couldn't configure balancing strategy, using round robin instead", slog.Any("error", err))
+			strategy = &RoundRobin{}
+		}
+		settings.strategy = strategy
+	}
+
+	if cfg.OutlierDetection.Enabled {
+		settings.outliers = NewOutlierDetector(cfg.OutlierDetection, p, p.logger)
+	}
+
+	return settings
+}
+
+// Apply reconfigures the pool with a new config
+//
+// Balancing, health check, outlier detection and retry settings are replaced at once.
+// Servers with new URLs are added, servers that are not in the config anymore are drained
+// and weights of the rest are updated. Servers added through admin API are kept, unless the config lists them:
+// then the config manages them from now on. A server that is back in the config while it is still draining
+// after an earlier reload stays in the pool, drains started through admin API go on.
+// Settings that can't be changed on the fly are ignored with a warning
+func (p *ServerPool) Apply(cfg *config.Config) {
+	prev := p.settings.Load()
+	warnRestartRequired(p.logger, prev.cfg, cfg)
+
+	p.settings.Store(p.newSettings(cfg, prev))
+	p.retryBudget.Update(cfg.Retry)
+
+	wanted := make(map[string]config.Upstream, len(cfg.URLs))
+	for _, u := range cfg.URLs {
+		wanted[u.URL.String()] = u
+	}
+
+	for _, s := range p.Servers() {
+		s.breaker.UpdateConfig(cfg.CircuitBreaker)
+
+		u, ok := wanted[s.URL.String()]
+		if !ok {
+			if !s.isRuntime() && s.AdminState() != "draining" {
+				p.drainServer(s, cfg.ShutdownTimeout, true)
+			}
+			continue
+		}
+
+		switch {
+		case s.isConfigDrain():
+			if !p.CancelDrain(s) {
+				// the server has been removed meanwhile, it is added again below
+				continue
+			}
+			p.logger.Info("Server is in the config again, drain canceled", slog.String("URL", s.URL.String()))
+		case s.AdminState() == "draining":
+			p.logger.Warn("Server is being drained through admin API, it will be added back on the next reload", slog.String("URL", s.URL.String()))
+			delete(wanted, s.URL.String())
+			continue
+		}
+		delete(wanted, s.URL.String())
+
+		s.mu.Lock()
+		s.runtime = false
+		s.mu.Unlock()
+		if s.GetWeight() != u.Weight {
+			p.logger.Info("Server weight changed", slog.String("URL", s.URL.String()), slog.Int("weight", u.Weight))
+			s.SetWeight(u.Weight)
+		}
+	}
+
+	for _, u := range cfg.URLs {
+		if _, ok := wanted[u.URL.String()]; !ok {
+			continue
+		}
+		if err := p.AddServer(p.NewServer(u)); err != nil {
+			p.logger.Error("Couldn't add server", slog.String("URL", u.URL.String()), slog.Any("error", err))
+			continue
+		}
+		p.logger.Info("Server added", slog.String("URL", u.URL.String()), slog.Int("weight", u.Weight))
+	}
+
+	p.logger.Info("Config applied", slog.Int("servers", len(p.Servers())), slog.String("strategy", cfg.Strategy))
+}
+
+// warnRestartRequired logs settings that differ in a new config but are applied only on start
+func warnRestartRequired(logger *logger.MyLogger, prev, next *config.Config) {
+	changed := make([]string, 0)
+	if prev.Port != next.Port {
+		changed = append(changed, "port")
+	}
+	if prev.AdminPort != next.AdminPort || prev.AdminHost != next.AdminHost {
+		changed = append(changed, "admin_port and admin_host")
+	}
+	if prev.Metrics != next.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if prev.Env != next.Env || prev.LogFormat != next.LogFormat {
+		changed = append(changed, "env and log_format")
+	}
+	if prev.UpstreamTimeout != next.UpstreamTimeout {
+		changed = append(changed, "upstream_timeout")
+	}
+	if prev.CircuitBreaker.Enabled != next.CircuitBreaker.Enabled {
+		changed = append(changed, "circuit_breaker.enabled")
+	}
+	if prev.LatencyDecay != next.LatencyDecay {
+		changed = append(changed, "latency_decay")
+	}
+	if prev.WatchInterval != next.WatchInterval {
+		changed = append(changed, "config_watch_interval")
+	}
+
+	if len(changed) > 0 {
+		logger.Warn("Some settings are applied only on restart", slog.Any("settings", changed))
+	}
+}
+
 // NewPool creates and fully configures new server pool.
 // Configuring a pool includes configuring all of inner servers, which URLs are provided via config file
 func NewPool(logger *logger.MyLogger, cfg *config.Config) *ServerPool {
 	logger.Info("Started configuring server pool")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.UpstreamTimeout
+
 	p := ServerPool{}
-	p.curId = 0
+	p.logger = logger
+	p.transport = transport
+	p.retryBudget = NewRetryBudget(cfg.Retry)
+	p.metrics = NewMetrics(&p)
+	p.settings.Store(p.newSettings(cfg, nil))
 	p.urlStrToServer = make(map[string]*Server, len(cfg.URLs))
+	p.idToServer = make(map[string]*Server, len(cfg.URLs))
 	p.servers = make([]*Server, 0, len(cfg.URLs))
 
-	for _, url := range cfg.URLs {
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
-			logger.Error(fmt.Sprintf("[%s] %v", url.Host, err))
-			logger.Error("Site unreachable", slog.Any("error", err))
-			retries := GetRetryFromContext(request)
-
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retries, retries+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
-			}
-
-			// after 3 retries, mark this backend as down
-			p.ChangeServerStatus(url, false)
-
-			// if the same request routing for few attempts with different backends, increase the count
-			attempts := GetAttemptsFromContext(request)
-			logger.Info("%s(%s) Attempting retry %d", request.RemoteAddr, request.URL.Path, slog.Int("Attempts", attempts))
-			ctx := context.WithValue(request.Context(), Retries, attempts+1)
-			LoadBalancer(logger, cfg, &p)(writer, request.WithContext(ctx))
+	for _, upstream := range cfg.URLs {
+		if err := p.AddServer(p.NewServer(upstream)); err != nil {
+			logger.Error("Couldn't configure server", slog.String("URL", upstream.URL.String()), slog.Any("error", err))
+			continue
 		}
-
-		p.AddServer(&Server{
-			URL:          url,
-			IsHealthy:    true,
-			ReverseProxy: proxy,
-		})
-		logger.Info("Configured server: %s", slog.String("URL", url.String()))
+		logger.Info("Configured server: %s", slog.String("URL", upstream.URL.String()), slog.Int("weight", upstream.Weight))
 	}
 
 	return &p
@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// newReloadTestPool returns a pool configured with upstreams and a func that builds its config with other upstreams
+func newReloadTestPool(t *testing.T, upstreams ...config.Upstream) (*ServerPool, func(upstreams ...config.Upstream) *config.Config) {
+	t.Helper()
+
+	newConfig := func(upstreams ...config.Upstream) *config.Config {
+		return &config.Config{
+			URLs:            upstreams,
+			Strategy:        config.StrategyRoundRobin,
+			ShutdownTimeout: 5 * time.Second,
+		}
+	}
+	return NewPool(logger.New(logger.EnvProd, logger.LogFormatText), newConfig(upstreams...)), newConfig
+}
+
+// waitRemoved waits until the server is removed from the pool
+func waitRemoved(t *testing.T, pool *ServerPool, s *Server) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if got, ok := pool.GetServer(s.ID); !ok || got != s {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server %s is not removed", s.URL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApplyUpdatesServers(t *testing.T) {
+	a := config.Upstream{URL: mustParseURL(t, "http://a:8080"), Weight: 1}
+	b := config.Upstream{URL: mustParseURL(t, "http://b:8080"), Weight: 1}
+	c := config.Upstream{URL: mustParseURL(t, "http://c:8080"), Weight: 1}
+	pool, newConfig := newReloadTestPool(t, a, b)
+	serverA, serverB := pool.Servers()[0], pool.Servers()[1]
+
+	a.Weight = 3
+	pool.Apply(newConfig(a, c))
+
+	if serverA.GetWeight() != 3 {
+		t.Fatalf("weight = %d, want 3", serverA.GetWeight())
+	}
+	if _, ok := pool.GetServer(serverID(c.URL)); !ok {
+		t.Fatal("new server is not added")
+	}
+	if serverB.AdminState() != "draining" {
+		t.Fatalf("removed server state = %s, want draining", serverB.AdminState())
+	}
+	waitRemoved(t, pool, serverB)
+}
+
+// TestApplyKeepsRuntimeServers checks that servers added through admin API survive reloads of a config
+// that doesn't list them, and the config manages them once it lists them
+func TestApplyKeepsRuntimeServers(t *testing.T) {
+	a := config.Upstream{URL: mustParseURL(t, "http://a:8080"), Weight: 1}
+	b := config.Upstream{URL: mustParseURL(t, "http://b:8080"), Weight: 1}
+	pool, newConfig := newReloadTestPool(t, a)
+
+	runtime := pool.NewServer(b)
+	if err := pool.AddRuntimeServer(runtime); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Weight = 2
+	pool.Apply(newConfig(a))
+	if s, ok := pool.GetServer(runtime.ID); !ok || s != runtime || !runtime.IsAvailable() {
+		t.Fatal("server added through admin API is removed by a config reload")
+	}
+
+	b.Weight = 3
+	pool.Apply(newConfig(a, b))
+	if s, _ := pool.GetServer(runtime.ID); s != runtime || runtime.GetWeight() != 3 {
+		t.Fatal("server listed in the config is not updated by it")
+	}
+
+	pool.Apply(newConfig(a))
+	if runtime.AdminState() != "draining" {
+		t.Fatalf("server removed from the config is %s, want draining", runtime.AdminState())
+	}
+}
+
+// TestApplyCancelsDrain checks that a server that is back in the config while it is still draining stays in the pool
+func TestApplyCancelsDrain(t *testing.T) {
+	a := config.Upstream{URL: mustParseURL(t, "http://a:8080"), Weight: 1}
+	b := config.Upstream{URL: mustParseURL(t, "http://b:8080"), Weight: 1}
+	pool, newConfig := newReloadTestPool(t, a, b)
+	serverB := pool.Servers()[1]
+	serverB.active.Store(1)
+
+	pool.Apply(newConfig(a))
+	if serverB.AdminState() != "draining" {
+		t.Fatalf("removed server state = %s, want draining", serverB.AdminState())
+	}
+
+	pool.Apply(newConfig(a, b))
+	if serverB.AdminState() != "active" || !serverB.IsAvailable() {
+		t.Fatalf("server back in the config is %s, want active", serverB.AdminState())
+	}
+
+	// the canceled drain doesn't remove the server when its requests are done
+	serverB.active.Store(0)
+	time.Sleep(300 * time.Millisecond)
+	if s, ok := pool.GetServer(serverB.ID); !ok || s != serverB || len(pool.Servers()) != 2 {
+		t.Fatal("server back in the config is removed by a canceled drain")
+	}
+}
+
+// TestApplyAddsDrainedServer checks that a server removed by a finished drain is added again by the config
+func TestApplyAddsDrainedServer(t *testing.T) {
+	a := config.Upstream{URL: mustParseURL(t, "http://a:8080"), Weight: 1}
+	b := config.Upstream{URL: mustParseURL(t, "http://b:8080"), Weight: 1}
+	pool, newConfig := newReloadTestPool(t, a, b)
+	serverB := pool.Servers()[1]
+
+	pool.Apply(newConfig(a))
+	waitRemoved(t, pool, serverB)
+
+	pool.Apply(newConfig(a, b))
+	s, ok := pool.GetServer(serverB.ID)
+	if !ok || s == serverB || !s.IsAvailable() {
+		t.Fatal("server back in the config is not added again")
+	}
+}
+
+// TestApplyKeepsAdminDrain checks that a reload doesn't cancel a drain started through admin API
+func TestApplyKeepsAdminDrain(t *testing.T) {
+	a := config.Upstream{URL: mustParseURL(t, "http://a:8080"), Weight: 1}
+	b := config.Upstream{URL: mustParseURL(t, "http://b:8080"), Weight: 1}
+	pool, newConfig := newReloadTestPool(t, a, b)
+	serverB := pool.Servers()[1]
+	serverB.active.Store(1)
+
+	pool.DrainServer(serverB, time.Second)
+	pool.Apply(newConfig(a, b))
+	if serverB.AdminState() != "draining" {
+		t.Fatalf("server drained through admin API is %s after a reload, want draining", serverB.AdminState())
+	}
+
+	serverB.active.Store(0)
+	waitRemoved(t, pool, serverB)
+}
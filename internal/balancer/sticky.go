@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// serverID derives a stable server identifier from its URL, so affinity cookies don't reveal backend addresses
+func serverID(u *url.URL) string {
+	h := fnv.New64a()
+	h.Write([]byte(u.String()))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// pinnedServer returns a healthy server the request is pinned to with an affinity cookie
+//
+// It returns nil if sticky sessions are disabled, there is no cookie or the pinned server is unhealthy,
+// so the request falls back to the balancing strategy
+func (p *ServerPool) pinnedServer(r *http.Request) *Server {
+	sticky := p.Config().Sticky
+	if sticky.Cookie == "" {
+		return nil
+	}
+
+	cookie, err := r.Cookie(sticky.Cookie)
+	if err != nil {
+		return nil
+	}
+
+	s, ok := p.GetServer(cookie.Value)
+	if !ok || !s.IsAvailable() {
+		return nil
+	}
+
+	return s
+}
+
+// SetAffinity pins the client to a server that has responded by adding an affinity cookie to the response
+// if sticky sessions are enabled. Servers that failed before are never pinned, as only the response
+// of the final server reaches the client
+func (p *ServerPool) SetAffinity(resp *http.Response, s *Server) {
+	sticky := p.Config().Sticky
+	if sticky.Cookie == "" {
+		return
+	}
+
+	if cookie, err := resp.Request.Cookie(sticky.Cookie); err == nil && cookie.Value == s.ID {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     sticky.Cookie,
+		Value:    s.ID,
+		Path:     "/",
+		MaxAge:   int(sticky.TTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if v := cookie.String(); v != "" {
+		resp.Header.Add("Set-Cookie", v)
+	}
+}
@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const stickyCookie = "lb"
+
+// newBackend starts a backend that answers with its name in X-Backend header
+func newBackend(t *testing.T, name string) *url.URL {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func newStickyPool(t *testing.T, urls ...*url.URL) *ServerPool {
+	t.Helper()
+
+	upstreams := make([]config.Upstream, 0, len(urls))
+	for _, u := range urls {
+		upstreams = append(upstreams, config.Upstream{URL: u, Weight: 1})
+	}
+	return NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:        upstreams,
+		Strategy:    config.StrategyRoundRobin,
+		MaxAttempts: 2,
+		Retry:       config.Retry{BudgetPercent: 100, MinRetryConcurrency: 10},
+		Sticky:      config.StickyConfig{Cookie: stickyCookie, TTL: time.Hour},
+	})
+}
+
+// serveSticky sends a request with an affinity cookie if it is not empty and returns the response
+func serveSticky(pool *ServerPool, cookie string) *http.Response {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: stickyCookie, Value: cookie})
+	}
+	w := httptest.NewRecorder()
+	LoadBalancer(pool.logger, pool)(w, r)
+	return w.Result()
+}
+
+// affinityCookies returns values of affinity cookies set by a response
+func affinityCookies(resp *http.Response) []string {
+	values := make([]string, 0, 1)
+	for _, c := range resp.Cookies() {
+		if c.Name == stickyCookie {
+			values = append(values, c.Value)
+		}
+	}
+	return values
+}
+
+func TestStickyCookieRoutesBack(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	pool := newStickyPool(t, a, b)
+	byName := map[string]*Server{"a": pool.Servers()[0], "b": pool.Servers()[1]}
+
+	resp := serveSticky(pool, "")
+	name := resp.Header.Get("X-Backend")
+	pinned := byName[name]
+	if cookies := affinityCookies(resp); pinned == nil || len(cookies) != 1 || cookies[0] != pinned.ID {
+		t.Fatalf("affinity cookies = %v, want a single cookie of server %q", cookies, name)
+	}
+
+	for range 5 {
+		resp := serveSticky(pool, pinned.ID)
+		if got := resp.Header.Get("X-Backend"); got != name {
+			t.Fatalf("pinned request is served by %s, want %s", got, name)
+		}
+		if cookies := affinityCookies(resp); len(cookies) != 0 {
+			t.Fatalf("affinity cookies = %v, a pinned client needs no new cookie", cookies)
+		}
+	}
+
+	// a pinned server that is down is replaced and the client is pinned to the new one
+	pinned.SetHealth(false)
+	resp = serveSticky(pool, pinned.ID)
+	other := resp.Header.Get("X-Backend")
+	if other == name || other == "" {
+		t.Fatalf("request pinned to an unhealthy server is served by %q", other)
+	}
+	if cookies := affinityCookies(resp); len(cookies) != 1 || cookies[0] != byName[other].ID {
+		t.Fatalf("affinity cookies = %v, want a single cookie of server %s", cookies, other)
+	}
+}
+
+// TestStickyCookieSetOnceOnRetry checks that a retried request is pinned only to the server that has responded
+func TestStickyCookieSetOnceOnRetry(t *testing.T) {
+	// round robin starts from the second server, so the first try fails and the request is retried
+	pool := newStickyPool(t, newBackend(t, "live"), deadURL(t))
+	live := pool.Servers()[0]
+
+	resp := serveSticky(pool, "")
+	if got := resp.Header.Get("X-Backend"); got != "live" {
+		t.Fatalf("request is served by %q, want live", got)
+	}
+	if cookies := affinityCookies(resp); len(cookies) != 1 || cookies[0] != live.ID {
+		t.Fatalf("affinity cookies = %v, want a single cookie of the live server %s", cookies, live.ID)
+	}
+}
+
+func TestStickyDisabled(t *testing.T) {
+	pool := newStickyPool(t, newBackend(t, "a"))
+	cfg := *pool.Config()
+	cfg.Sticky = config.StickyConfig{}
+	pool.Apply(&cfg)
+
+	if cookies := affinityCookies(serveSticky(pool, "")); len(cookies) != 0 {
+		t.Fatalf("affinity cookies = %v, want none with sticky sessions disabled", cookies)
+	}
+}
@@ -0,0 +1,218 @@
+package balancer
+
+import (
+	"fmt"
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy is an interface for balancing algorithms used by ServerPool
+//
+// Next must return one of the available servers or nil if there is none
+type Strategy interface {
+	Next(r *http.Request, servers []*Server) *Server
+}
+
+// NewStrategy creates a balancing strategy by its configured name
+func NewStrategy(cfg *config.Config) (Strategy, error) {
+	switch cfg.Strategy {
+	case "", config.StrategyRoundRobin:
+		return &RoundRobin{}, nil
+	case config.StrategyWeightedRoundRobin:
+		return NewWeightedRoundRobin(), nil
+	case config.StrategyLeastConnections:
+		return &LeastConnections{}, nil
+	case config.StrategyP2CEWMA:
+		return &P2CEWMA{}, nil
+	case config.StrategyConsistentHash:
+		return NewConsistentHash(cfg.HashKey), nil
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy: %s", cfg.Strategy)
+	}
+}
+
+// RoundRobin is a default strategy that iterates over servers one by one
+type RoundRobin struct {
+	curId uint64
+}
+
+// NextIndex increases curId value atomicly
+func (rr *RoundRobin) NextIndex(length int) int {
+	return int(atomic.AddUint64(&rr.curId, uint64(1)) % uint64(length))
+}
+
+// Next finds a next avaliable server
+func (rr *RoundRobin) Next(_ *http.Request, servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	// loop entire backends to find out an Alive backend
+	next := rr.NextIndex(len(servers))
+	l := len(servers) + next // start from next and move a full cycle
+
+	for i := next; i < l; i++ {
+		idx := i % len(servers)         // take an index by modding
+		if servers[idx].IsAvailable() { // if we have an alive backend, use it and store if its not the original one
+			if i != next {
+				atomic.StoreUint64(&rr.curId, uint64(idx))
+			}
+			return servers[idx]
+		}
+	}
+
+	return nil
+}
+
+// WeightedRoundRobin is a smooth weighted round robin strategy (the one used in nginx)
+//
+// On every pick each healthy server's current weight grows by its weight, the server with the biggest
+// current weight is chosen and its current weight is lowered by the total weight of healthy servers.
+// Unhealthy servers are not counted in the total, so their share is spread between the rest
+type WeightedRoundRobin struct {
+	current map[*Server]int
+	pool    []*Server // snapshot of the pool current weights were counted for
+	mu      sync.Mutex
+}
+
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{current: make(map[*Server]int)}
+}
+
+// Next finds a next avaliable server according to servers' weights
+func (wrr *WeightedRoundRobin) Next(_ *http.Request, servers []*Server) *Server {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	if !sameSnapshot(wrr.pool, servers) {
+		wrr.forgetRemoved(servers)
+	}
+
+	var best *Server
+	total := 0
+	for _, s := range servers {
+		if !s.IsAvailable() {
+			// server starts from scratch when it comes back to avoid a burst of requests
+			delete(wrr.current, s)
+			continue
+		}
+
+		weight := s.GetWeight()
+		wrr.current[s] += weight
+		total += weight
+		if best == nil || wrr.current[s] > wrr.current[best] {
+			best = s
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	wrr.current[best] -= total
+
+	return best
+}
+
+// forgetRemoved drops current weights of servers that are not in the pool anymore, must be called with locked mutex
+func (wrr *WeightedRoundRobin) forgetRemoved(servers []*Server) {
+	inPool := make(map[*Server]struct{}, len(servers))
+	for _, s := range servers {
+		inPool[s] = struct{}{}
+	}
+	for s := range wrr.current {
+		if _, ok := inPool[s]; !ok {
+			delete(wrr.current, s)
+		}
+	}
+	wrr.pool = servers
+}
+
+// sameSnapshot checks if two snapshots of a pool are the same slice.
+// Pool replaces its slice on every change, so a different slice means that servers were added or removed
+func sameSnapshot(a, b []*Server) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// LeastConnections is a strategy that chooses a healthy server with the least amount of in-flight requests
+//
+// Ties are broken randomly, so idle servers share load evenly
+type LeastConnections struct{}
+
+// Next finds a healthy server with the least amount of active requests
+func (lc *LeastConnections) Next(_ *http.Request, servers []*Server) *Server {
+	var best *Server
+	var bestActive int64
+	ties := 0
+	for _, s := range servers {
+		if !s.IsAvailable() {
+			continue
+		}
+
+		active := s.ActiveRequests()
+		switch {
+		case best == nil || active < bestActive:
+			best, bestActive, ties = s, active, 1
+		case active == bestActive:
+			// reservoir sampling gives every tied server the same chance
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = s
+			}
+		}
+	}
+
+	return best
+}
+
+// unknownLatencyPenalty is a cost of a busy server that has no latency observations yet
+const unknownLatencyPenalty = float64(time.Second)
+
+// P2CEWMA is a "power of two choices" strategy: it samples two random healthy servers
+// and chooses the one with the lower load, where load is a peak EWMA latency multiplied by in-flight requests
+//
+// It moves traffic away from servers that are alive but degraded, which TCP health checks can't notice
+type P2CEWMA struct{}
+
+// Next samples two healthy servers and returns the less loaded one
+func (p2c *P2CEWMA) Next(_ *http.Request, servers []*Server) *Server {
+	healthy := make([]*Server, 0, len(servers))
+	for _, s := range servers {
+		if s.IsAvailable() {
+			healthy = append(healthy, s)
+		}
+	}
+
+	switch len(healthy) {
+	case 0:
+		return nil
+	case 1:
+		return healthy[0]
+	}
+
+	i := rand.IntN(len(healthy))
+	j := rand.IntN(len(healthy) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := healthy[i], healthy[j]
+	if load(b) < load(a) {
+		return b
+	}
+	return a
+}
+
+// load estimates how long a new request to the server is going to take
+func load(s *Server) float64 {
+	cost := s.Latency()
+	active := s.ActiveRequests()
+	if cost == 0 && active != 0 {
+		return unknownLatencyPenalty + float64(active)
+	}
+
+	return cost * float64(active+1)
+}
@@ -0,0 +1,226 @@
+package balancer
+
+import (
+	"ivanjabrony/cloud-test/internal/balancer/config"
+	"ivanjabrony/cloud-test/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a healthy server that is not a part of any pool, enough for strategies
+func newTestServer(t *testing.T, rawURL string, weight int) *Server {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ID: serverID(u), URL: u, IsHealthy: true, latency: newPeakEWMA(0)}
+	s.SetWeight(weight)
+	return s
+}
+
+// pickNames makes n picks of a strategy and returns hosts of chosen servers, "-" if nothing is chosen
+func pickNames(strategy Strategy, servers []*Server, n int) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	names := make([]string, 0, n)
+	for range n {
+		s := strategy.Next(r, servers)
+		if s == nil {
+			names = append(names, "-")
+			continue
+		}
+		names = append(names, s.URL.Host)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestWeightedRoundRobinOrder(t *testing.T) {
+	a := newTestServer(t, "http://a", 5)
+	b := newTestServer(t, "http://b", 1)
+	c := newTestServer(t, "http://c", 1)
+	servers := []*Server{a, b, c}
+
+	// smooth weighted round robin spreads picks of the heavy server instead of sending them in a row
+	want := "a a b a c a a"
+	wrr := NewWeightedRoundRobin()
+	for round := range 3 {
+		if got := pickNames(wrr, servers, 7); got != want {
+			t.Fatalf("round %d: order = %q, want %q", round, got, want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSkipsUnavailable(t *testing.T) {
+	a := newTestServer(t, "http://a", 5)
+	b := newTestServer(t, "http://b", 1)
+	c := newTestServer(t, "http://c", 1)
+	servers := []*Server{a, b, c}
+
+	wrr := NewWeightedRoundRobin()
+	b.SetHealth(false)
+	// share of the unhealthy server is spread between the rest by their weights
+	if got, want := pickNames(wrr, servers, 6), "a a a c a a"; got != want {
+		t.Fatalf("order without b = %q, want %q", got, want)
+	}
+
+	// server that comes back starts from scratch and gets its share without a burst
+	b.SetHealth(true)
+	if got, want := pickNames(wrr, servers, 7), "a a b a c a a"; got != want {
+		t.Fatalf("order after b is back = %q, want %q", got, want)
+	}
+
+	a.SetHealth(false)
+	b.SetHealth(false)
+	c.SetHealth(false)
+	if got := pickNames(wrr, servers, 2); got != "- -" {
+		t.Fatalf("order without available servers = %q, want nothing chosen", got)
+	}
+}
+
+// TestWeightedRoundRobinForgetsRemoved checks that current weights of servers removed from the pool are dropped
+func TestWeightedRoundRobinForgetsRemoved(t *testing.T) {
+	a := newTestServer(t, "http://a", 2)
+	b := newTestServer(t, "http://b", 1)
+	c := newTestServer(t, "http://c", 1)
+
+	wrr := NewWeightedRoundRobin()
+	pickNames(wrr, []*Server{a, b, c}, 3)
+	pickNames(wrr, []*Server{a, b}, 1)
+
+	if _, ok := wrr.current[c]; ok || len(wrr.current) != 2 {
+		t.Fatalf("current weights = %v, removed server must be forgotten", wrr.current)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	a := newTestServer(t, "http://a", 1)
+	b := newTestServer(t, "http://b", 1)
+	c := newTestServer(t, "http://c", 1)
+	servers := []*Server{a, b, c}
+	lc := &LeastConnections{}
+
+	a.active.Store(3)
+	b.active.Store(1)
+	c.active.Store(2)
+	if got := pickNames(lc, servers, 3); got != "b b b" {
+		t.Fatalf("picks = %q, want the server with the least active requests", got)
+	}
+
+	b.SetHealth(false)
+	if got := pickNames(lc, servers, 3); got != "c c c" {
+		t.Fatalf("picks = %q, want the least busy of available servers", got)
+	}
+}
+
+// TestLeastConnectionsTieBreak checks that servers with the same amount of active requests share load evenly
+func TestLeastConnectionsTieBreak(t *testing.T) {
+	const picks = 3000
+
+	a := newTestServer(t, "http://a", 1)
+	b := newTestServer(t, "http://b", 1)
+	c := newTestServer(t, "http://c", 1)
+	busy := newTestServer(t, "http://busy", 1)
+	busy.active.Store(1)
+	servers := []*Server{a, busy, b, c}
+
+	counts := make(map[string]int)
+	for _, name := range strings.Fields(pickNames(&LeastConnections{}, servers, picks)) {
+		counts[name]++
+	}
+
+	if counts["busy"] != 0 {
+		t.Fatalf("busy server is chosen %d times", counts["busy"])
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		// every tied server expects a third of picks, the bounds are far from it to keep the test stable
+		if counts[name] < picks/4 || counts[name] > picks/2 {
+			t.Fatalf("picks = %v, tied servers must be chosen evenly", counts)
+		}
+	}
+}
+
+func TestP2CEWMA(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency []time.Duration // observed latency of servers a, b and c, 0 if nothing is observed
+		active  []int64
+		want    []string // servers that may be chosen
+	}{
+		{
+			name:    "slow server is never chosen",
+			latency: []time.Duration{100 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+			active:  []int64{0, 0, 0},
+			want:    []string{"b", "c"},
+		},
+		{
+			name:    "busy server loses to a slower idle one",
+			latency: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond},
+			active:  []int64{20, 0, 0},
+			want:    []string{"b", "c"},
+		},
+		{
+			name:    "busy server without observations loses",
+			latency: []time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond},
+			active:  []int64{1, 0, 0},
+			want:    []string{"b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]*Server, 0, 3)
+			for i, name := range []string{"a", "b", "c"} {
+				s := newTestServer(t, "http://"+name, 1)
+				if tt.latency[i] > 0 {
+					s.latency.Observe(tt.latency[i])
+				}
+				s.active.Store(tt.active[i])
+				servers = append(servers, s)
+			}
+
+			for _, name := range strings.Fields(pickNames(&P2CEWMA{}, servers, 100)) {
+				if !slices.Contains(tt.want, name) {
+					t.Fatalf("server %s is chosen, want one of %v", name, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestP2CEWMASkipsUnavailable(t *testing.T) {
+	a := newTestServer(t, "http://a", 1)
+	b := newTestServer(t, "http://b", 1)
+	b.latency.Observe(time.Second)
+	a.SetHealth(false)
+
+	if got := pickNames(&P2CEWMA{}, []*Server{a, b}, 3); got != "b b b" {
+		t.Fatalf("picks = %q, want the only available server", got)
+	}
+	b.SetHealth(false)
+	if got := pickNames(&P2CEWMA{}, []*Server{a, b}, 1); got != "-" {
+		t.Fatalf("picks = %q, want nothing chosen", got)
+	}
+}
+
+// TestFailedRequestLatency checks that a server that fails requests fast doesn't look like the fastest one
+func TestFailedRequestLatency(t *testing.T) {
+	pool := NewPool(logger.New(logger.EnvProd, logger.LogFormatText), &config.Config{
+		URLs:        []config.Upstream{{URL: deadURL(t), Weight: 1}},
+		Strategy:    config.StrategyP2CEWMA,
+		MaxAttempts: 1,
+	})
+	server := pool.Servers()[0]
+
+	LoadBalancer(pool.logger, pool)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// the penalty decays a little while the test runs
+	if latency := time.Duration(server.Latency()); latency < failureLatencyPenalty*9/10 {
+		t.Fatalf("latency of a failed request = %s, want at least %s", latency, failureLatencyPenalty)
+	}
+}
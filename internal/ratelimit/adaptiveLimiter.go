@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveSmoothing = 0.2 // share of a new estimate in the limit
+	adaptiveBackoff   = 0.9 // limit is multiplied by it when the target fails
+	sampleWindow      = 10  // samples averaged into short-term RTT, the limit is updated once per window
+	longRTTWindows    = 600 // windows averaged by long-term RTT
+)
+
+// AdaptiveLimiter is a global limit of requests in flight to the target that adapts to its latency
+//
+// It follows the gradient algorithm of Netflix concurrency-limits. Long-term RTT estimates latency
+// of a healthy target and short-term RTT, averaged over a window of samples, its current latency.
+// While the current latency is within tolerance of the long-term one, the limit grows by its square root;
+// when the target slows down the limit shrinks in proportion to the slowdown, down to a half per window.
+// Failures of the target shrink the limit multiplicatively as in AIMD
+type AdaptiveLimiter struct {
+	limit     float64
+	minLimit  float64
+	maxLimit  float64
+	tolerance float64 // how many times latency may grow before the limit shrinks
+	inFlight  int
+	longRTT   float64 // seconds
+	window    rttWindow
+	mu        sync.Mutex
+}
+
+// rttWindow accumulates samples until the limit is updated
+type rttWindow struct {
+	rttSum      float64 // seconds
+	samples     int
+	maxInFlight int // the most requests in flight seen in the window
+}
+
+func NewAdaptiveLimiter(initialLimit, minLimit, maxLimit int, tolerance float64) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		limit:     float64(initialLimit),
+		minLimit:  float64(minLimit),
+		maxLimit:  float64(maxLimit),
+		tolerance: tolerance,
+	}
+}
+
+// Acquire takes a slot for a request to the target if the limit is not exceeded.
+// Returned release must be called with the request's RTT when it is finished, dropped means
+// that the target failed to respond or is overloaded. Only the first call of release counts
+func (a *AdaptiveLimiter) Acquire() (release func(rtt time.Duration, dropped bool), ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.inFlight >= int(a.limit) {
+		return nil, false
+	}
+	a.inFlight++
+
+	var once sync.Once
+	return func(rtt time.Duration, dropped bool) {
+		once.Do(func() { a.onSample(rtt, dropped) })
+	}, true
+}
+
+// onSample frees a slot and adapts the limit to a finished request
+func (a *AdaptiveLimiter) onSample(rtt time.Duration, dropped bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inFlight := a.inFlight
+	a.inFlight--
+
+	if dropped {
+		a.limit = max(a.limit*adaptiveBackoff, a.minLimit)
+		return
+	}
+
+	// requests canceled by clients only free their slots
+	if rtt <= 0 {
+		return
+	}
+	w := &a.window
+	w.rttSum += rtt.Seconds()
+	w.samples++
+	w.maxInFlight = max(w.maxInFlight, inFlight)
+	if w.samples < sampleWindow {
+		return
+	}
+	shortRTT, maxInFlight := w.rttSum/float64(w.samples), w.maxInFlight
+	*w = rttWindow{}
+
+	if a.longRTT == 0 {
+		a.longRTT = shortRTT
+	} else {
+		a.longRTT += (shortRTT - a.longRTT) / longRTTWindows
+	}
+
+	// latency has returned to normal after an overload, long-term RTT catches up without waiting for averaging
+	if a.longRTT/shortRTT > 2 {
+		a.longRTT *= 0.95
+	}
+
+	// the limit isn't the bottleneck, there is nothing to learn about it
+	if float64(maxInFlight) < a.limit/2 {
+		return
+	}
+
+	gradient := max(0.5, min(1, a.tolerance*a.longRTT/shortRTT))
+	estimate := a.limit*gradient + math.Sqrt(a.limit)
+	a.limit = min(max(a.limit*(1-adaptiveSmoothing)+estimate*adaptiveSmoothing, a.minLimit), a.maxLimit)
+}
+
+// Limit returns the current limit of requests in flight
+func (a *AdaptiveLimiter) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return int(a.limit)
+}
+
+// InFlight returns amount of requests in flight to the target
+func (a *AdaptiveLimiter) InFlight() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.inFlight
+}
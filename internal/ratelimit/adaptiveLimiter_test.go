@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// adaptiveLoad keeps an adaptive limiter saturated and feeds it samples with given RTT,
+// so the limit is updated without timing of real requests
+type adaptiveLoad struct {
+	a    *AdaptiveLimiter
+	held []func(rtt time.Duration, dropped bool)
+}
+
+// fill takes all free slots of the limiter
+func (l *adaptiveLoad) fill() {
+	for {
+		release, ok := l.a.Acquire()
+		if !ok {
+			return
+		}
+		l.held = append(l.held, release)
+	}
+}
+
+// sample finishes a request in flight with rtt while the limit is saturated
+func (l *adaptiveLoad) sample(rtt time.Duration, dropped bool) {
+	l.fill()
+	release := l.held[len(l.held)-1]
+	l.held = l.held[:len(l.held)-1]
+	release(rtt, dropped)
+}
+
+// window feeds a window of samples, after which the limit is updated
+func (l *adaptiveLoad) window(rtt time.Duration) float64 {
+	for range sampleWindow {
+		l.sample(rtt, false)
+	}
+	return l.limit()
+}
+
+// limit returns the limit without rounding, as it grows by less than a request per window
+func (l *adaptiveLoad) limit() float64 {
+	l.a.mu.Lock()
+	defer l.a.mu.Unlock()
+
+	return l.a.limit
+}
+
+func TestAdaptiveLimiterGrowsWithSteadyLatency(t *testing.T) {
+	l := &adaptiveLoad{a: NewAdaptiveLimiter(20, 5, 1000, 1.5)}
+
+	prev := l.limit()
+	for i := range 10 {
+		limit := l.window(10 * time.Millisecond)
+		if limit <= prev {
+			t.Fatalf("window %d: limit = %.2f, want more than %.2f", i, limit, prev)
+		}
+		prev = limit
+	}
+
+	// latency within tolerance is steady too
+	if limit := l.window(14 * time.Millisecond); limit <= prev {
+		t.Fatalf("limit with latency within tolerance = %.2f, want more than %.2f", limit, prev)
+	}
+}
+
+func TestAdaptiveLimiterShrinksWithRisingLatency(t *testing.T) {
+	l := &adaptiveLoad{a: NewAdaptiveLimiter(100, 5, 1000, 1.5)}
+	for range 5 {
+		l.window(10 * time.Millisecond)
+	}
+
+	prev := l.limit()
+	for i := range 5 {
+		limit := l.window(100 * time.Millisecond)
+		if limit >= prev {
+			t.Fatalf("window %d: limit = %.2f, want less than %.2f", i, limit, prev)
+		}
+		// the limit shrinks at most by half per window
+		if limit < prev/2 {
+			t.Fatalf("window %d: limit = %.2f, shrank more than by half of %.2f", i, limit, prev)
+		}
+		prev = limit
+	}
+}
+
+func TestAdaptiveLimiterDrops(t *testing.T) {
+	a := NewAdaptiveLimiter(100, 5, 1000, 1.5)
+	for _, want := range []int{90, 81, 72} {
+		release, ok := a.Acquire()
+		if !ok {
+			t.Fatal("request under the limit is shed")
+		}
+		release(time.Second, true)
+		if limit := a.Limit(); limit != want {
+			t.Fatalf("limit after a failure = %d, want %d", limit, want)
+		}
+	}
+
+	// a canceled request and a second call of release change nothing
+	release, _ := a.Acquire()
+	release(0, false)
+	release(time.Second, true)
+	if limit, inFlight := a.Limit(), a.InFlight(); limit != 72 || inFlight != 0 {
+		t.Fatalf("limit = %d, in flight = %d after a canceled request, want 72 and 0", limit, inFlight)
+	}
+}
+
+func TestAdaptiveLimiterBounds(t *testing.T) {
+	t.Run("max", func(t *testing.T) {
+		l := &adaptiveLoad{a: NewAdaptiveLimiter(20, 5, 30, 1.5)}
+		for i := range 20 {
+			if limit := l.window(10 * time.Millisecond); limit > 30 {
+				t.Fatalf("window %d: limit = %.2f over max limit 30", i, limit)
+			}
+		}
+		if limit := l.a.Limit(); limit != 30 {
+			t.Fatalf("limit = %d, want max limit 30", limit)
+		}
+	})
+
+	t.Run("min with latency", func(t *testing.T) {
+		l := &adaptiveLoad{a: NewAdaptiveLimiter(20, 5, 1000, 1.5)}
+		l.window(10 * time.Millisecond)
+		for i := range 30 {
+			if limit := l.window(time.Second); limit < 5 {
+				t.Fatalf("window %d: limit = %.2f under min limit 5", i, limit)
+			}
+		}
+		if limit := l.a.Limit(); limit > 10 {
+			t.Fatalf("limit = %d, want it close to min limit 5", limit)
+		}
+	})
+
+	t.Run("min with failures", func(t *testing.T) {
+		l := &adaptiveLoad{a: NewAdaptiveLimiter(20, 5, 1000, 1.5)}
+		for range 50 {
+			l.sample(0, true)
+		}
+		if limit := l.a.Limit(); limit != 5 {
+			t.Fatalf("limit = %d, want min limit 5", limit)
+		}
+	})
+}
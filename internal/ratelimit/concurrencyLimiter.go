@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTooManyInFlight is returned if a client has too many requests in flight and no room in its queue
+var ErrTooManyInFlight = errors.New("too many requests in flight")
+
+// ConcurrencyLimiter limits how many requests of a client are in flight at once
+//
+// A request above the limit waits for a slot in the client's FIFO queue up to queueTimeout,
+// or is rejected right away if maxQueue is zero. A client's state is dropped as soon as it has
+// no requests in flight, so only active clients take memory
+type ConcurrencyLimiter struct {
+	defaultLimit int                  // 0 means no limit
+	limits       map[string]int       // clients' own limits
+	clients      map[string]*inFlight // clients with requests in flight
+	total        int                  // requests in flight of all clients
+	maxQueue     int
+	queueTimeout time.Duration
+	mu           sync.Mutex
+}
+
+// inFlight is a state of a client with requests in flight
+type inFlight struct {
+	active  int
+	waiters list.List // of chan struct{}, a slot is handed to a waiter by closing its channel
+}
+
+func NewConcurrencyLimiter(defaultLimit, maxQueue int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]int),
+		clients:      make(map[string]*inFlight),
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// limit returns a limit of a client, must be called with locked mutex
+func (cl *ConcurrencyLimiter) limit(client string) int {
+	if limit, ok := cl.limits[client]; ok {
+		return limit
+	}
+	return cl.defaultLimit
+}
+
+// Acquire takes a slot of a client, returned release must be called when the request is finished.
+// Release can be called more than once, only the first call frees the slot
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, client string) (release func(), err error) {
+	cl.mu.Lock()
+	limit := cl.limit(client)
+	if limit <= 0 {
+		cl.mu.Unlock()
+		return func() {}, nil
+	}
+
+	c, ok := cl.clients[client]
+	if !ok {
+		c = &inFlight{}
+		cl.clients[client] = c
+	}
+	if c.active < limit && c.waiters.Len() == 0 {
+		c.active++
+		cl.total++
+		cl.mu.Unlock()
+		return cl.releaser(client, c), nil
+	}
+	if c.waiters.Len() >= cl.maxQueue {
+		cl.mu.Unlock()
+		return nil, ErrTooManyInFlight
+	}
+
+	ready := make(chan struct{})
+	waiter := c.waiters.PushBack(ready)
+	cl.mu.Unlock()
+
+	timer := time.NewTimer(cl.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return cl.releaser(client, c), nil
+	case <-timer.C:
+		err = ErrTooManyInFlight
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	select {
+	case <-ready:
+		// the slot was handed over while the request was giving up, it goes to the next one
+		cl.release(client, c)
+	default:
+		c.waiters.Remove(waiter)
+		cl.drop(client, c)
+	}
+	return nil, err
+}
+
+// releaser returns a func that releases a slot of a client once
+func (cl *ConcurrencyLimiter) releaser(client string, c *inFlight) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+
+			cl.release(client, c)
+		})
+	}
+}
+
+// release hands a slot to the first waiter or frees it, must be called with locked mutex
+func (cl *ConcurrencyLimiter) release(client string, c *inFlight) {
+	limit := cl.limit(client)
+	if front := c.waiters.Front(); front != nil && (limit <= 0 || c.active <= limit) {
+		c.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+
+	c.active--
+	cl.total--
+	cl.drop(client, c)
+}
+
+// drop forgets a client without requests in flight, must be called with locked mutex
+func (cl *ConcurrencyLimiter) drop(client string, c *inFlight) {
+	if c.active == 0 && c.waiters.Len() == 0 && cl.clients[client] == c {
+		delete(cl.clients, client)
+	}
+}
+
+// Configure sets a client's own limit, zero limit means the default one.
+// Waiting requests that fit into a raised limit are let through
+func (cl *ConcurrencyLimiter) Configure(client string, maxInFlight int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if maxInFlight <= 0 {
+		delete(cl.limits, client)
+	} else {
+		cl.limits[client] = maxInFlight
+	}
+
+	c, ok := cl.clients[client]
+	if !ok {
+		return
+	}
+	limit := cl.limit(client)
+	for front := c.waiters.Front(); front != nil && (limit <= 0 || c.active < limit); front = c.waiters.Front() {
+		c.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		c.active++
+		cl.total++
+	}
+}
+
+// InFlight returns amount of requests in flight of all clients
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.total
+}
@@ -0,0 +1,273 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type acquired struct {
+	release func()
+	err     error
+}
+
+// acquireAsync acquires a slot of a client in a goroutine
+func acquireAsync(ctx context.Context, cl *ConcurrencyLimiter, client string) <-chan acquired {
+	ch := make(chan acquired, 1)
+	go func() {
+		release, err := cl.Acquire(ctx, client)
+		ch <- acquired{release, err}
+	}()
+	return ch
+}
+
+// queued returns amount of waiting requests of a client
+func queued(cl *ConcurrencyLimiter, client string) int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	c, ok := cl.clients[client]
+	if !ok {
+		return 0
+	}
+	return c.waiters.Len()
+}
+
+// waitQueued waits until n requests of a client are queued
+func waitQueued(t *testing.T, cl *ConcurrencyLimiter, client string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(cl, client) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued requests = %d, want %d", queued(cl, client), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mustAcquire(t *testing.T, cl *ConcurrencyLimiter, client string) func() {
+	t.Helper()
+
+	release, err := cl.Acquire(context.Background(), client)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	return release
+}
+
+// receive returns a result of an async acquire that must be done
+func receive(t *testing.T, ch <-chan acquired) acquired {
+	t.Helper()
+
+	select {
+	case a := <-ch:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("request is still waiting for a slot")
+		return acquired{}
+	}
+}
+
+// assertWaiting checks that a request still waits for a slot
+func assertWaiting(t *testing.T, ch <-chan acquired) {
+	t.Helper()
+
+	select {
+	case a := <-ch:
+		t.Fatalf("waiting request is done with error %v", a.err)
+	default:
+	}
+}
+
+// TestConcurrencyLimiterFIFO checks that released slots are handed to waiting requests in order of arrival
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, 3, time.Hour)
+	release := mustAcquire(t, cl, "client")
+
+	waiters := make([]<-chan acquired, 3)
+	for i := range waiters {
+		waiters[i] = acquireAsync(context.Background(), cl, "client")
+		waitQueued(t, cl, "client", i+1)
+	}
+
+	for i, w := range waiters {
+		assertWaiting(t, w)
+		release()
+		a := receive(t, w)
+		if a.err != nil {
+			t.Fatalf("waiter %d: %v", i, a.err)
+		}
+		for _, next := range waiters[i+1:] {
+			assertWaiting(t, next)
+		}
+		if n := cl.InFlight(); n != 1 {
+			t.Fatalf("waiter %d: in flight = %d, want 1", i, n)
+		}
+		release = a.release
+	}
+
+	release()
+	release() // only the first call frees the slot
+	if n := cl.InFlight(); n != 0 {
+		t.Fatalf("in flight after release = %d, want 0", n)
+	}
+	if len(cl.clients) != 0 {
+		t.Fatalf("clients without requests in flight are kept: %v", cl.clients)
+	}
+}
+
+// TestConcurrencyLimiterQueueTimeout checks that a request is rejected if its slot isn't freed in queue_timeout
+// or the queue is full
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	const queueTimeout = 20 * time.Millisecond
+	cl := NewConcurrencyLimiter(1, 1, queueTimeout)
+	release := mustAcquire(t, cl, "client")
+
+	waiter := acquireAsync(context.Background(), cl, "client")
+	waitQueued(t, cl, "client", 1)
+	if _, err := cl.Acquire(context.Background(), "client"); !errors.Is(err, ErrTooManyInFlight) {
+		t.Fatalf("request over the full queue: error = %v, want %v", err, ErrTooManyInFlight)
+	}
+
+	start := time.Now()
+	if a := receive(t, waiter); !errors.Is(a.err, ErrTooManyInFlight) {
+		t.Fatalf("timed out request: error = %v, want %v", a.err, ErrTooManyInFlight)
+	}
+	if waited := time.Since(start); waited > queueTimeout+time.Second {
+		t.Fatalf("request waited for %s, queue timeout is %s", waited, queueTimeout)
+	}
+	if n := queued(cl, "client"); n != 0 {
+		t.Fatalf("queued requests after timeout = %d, want 0", n)
+	}
+
+	release()
+	if n := cl.InFlight(); n != 0 {
+		t.Fatalf("in flight after release = %d, want 0", n)
+	}
+
+	// without a queue requests over the limit are rejected right away
+	cl = NewConcurrencyLimiter(1, 0, time.Hour)
+	defer mustAcquire(t, cl, "client")()
+	if _, err := cl.Acquire(context.Background(), "client"); !errors.Is(err, ErrTooManyInFlight) {
+		t.Fatalf("request without a queue: error = %v, want %v", err, ErrTooManyInFlight)
+	}
+	if _, err := cl.Acquire(context.Background(), "other"); err != nil {
+		t.Fatalf("request of another client: %v", err)
+	}
+}
+
+// TestConcurrencyLimiterCancel checks that a request canceled while queued leaves the queue
+// and doesn't take the slot of the next one
+func TestConcurrencyLimiterCancel(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, 2, time.Hour)
+	release := mustAcquire(t, cl, "client")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := acquireAsync(ctx, cl, "client")
+	waitQueued(t, cl, "client", 1)
+	next := acquireAsync(context.Background(), cl, "client")
+	waitQueued(t, cl, "client", 2)
+
+	cancel()
+	if a := receive(t, canceled); !errors.Is(a.err, context.Canceled) {
+		t.Fatalf("canceled request: error = %v, want %v", a.err, context.Canceled)
+	}
+	waitQueued(t, cl, "client", 1)
+
+	release()
+	a := receive(t, next)
+	if a.err != nil {
+		t.Fatalf("request after the canceled one: %v", a.err)
+	}
+	a.release()
+	if n := cl.InFlight(); n != 0 {
+		t.Fatalf("in flight after release = %d, want 0", n)
+	}
+}
+
+// TestConcurrencyLimiterConfigure checks that a changed limit applies to requests in flight:
+// a lowered one hands slots over only when requests fit into it, a raised one lets waiting requests through
+func TestConcurrencyLimiterConfigure(t *testing.T) {
+	t.Run("lower", func(t *testing.T) {
+		cl := NewConcurrencyLimiter(2, 1, time.Hour)
+		first, second := mustAcquire(t, cl, "client"), mustAcquire(t, cl, "client")
+		waiter := acquireAsync(context.Background(), cl, "client")
+		waitQueued(t, cl, "client", 1)
+
+		cl.Configure("client", 1)
+		first()
+		// two requests were in flight, the slot isn't handed over until one of them is left
+		assertWaiting(t, waiter)
+		if n := queued(cl, "client"); n != 1 {
+			t.Fatalf("queued requests = %d, want 1", n)
+		}
+		if n := cl.InFlight(); n != 1 {
+			t.Fatalf("in flight = %d, want 1", n)
+		}
+
+		second()
+		a := receive(t, waiter)
+		if a.err != nil {
+			t.Fatal(a.err)
+		}
+		// a request over the lowered limit is queued, canceled context makes it give up right away
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := cl.Acquire(ctx, "client"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("request over the lowered limit: error = %v, want %v", err, context.Canceled)
+		}
+		a.release()
+
+		// zero limit brings the default one back
+		cl.Configure("client", 0)
+		release1, release2 := mustAcquire(t, cl, "client"), mustAcquire(t, cl, "client")
+		release1()
+		release2()
+	})
+
+	t.Run("raise", func(t *testing.T) {
+		cl := NewConcurrencyLimiter(1, 3, time.Hour)
+		release := mustAcquire(t, cl, "client")
+		waiters := make([]<-chan acquired, 3)
+		for i := range waiters {
+			waiters[i] = acquireAsync(context.Background(), cl, "client")
+			waitQueued(t, cl, "client", i+1)
+		}
+
+		cl.Configure("client", 3)
+		first, second := receive(t, waiters[0]), receive(t, waiters[1])
+		if first.err != nil || second.err != nil {
+			t.Fatalf("waiters under the raised limit: %v, %v", first.err, second.err)
+		}
+		assertWaiting(t, waiters[2])
+		if n := cl.InFlight(); n != 3 {
+			t.Fatalf("in flight = %d, want 3", n)
+		}
+
+		release()
+		third := receive(t, waiters[2])
+		if third.err != nil {
+			t.Fatal(third.err)
+		}
+		for _, r := range []func(){first.release, second.release, third.release} {
+			r()
+		}
+		if n := cl.InFlight(); n != 0 {
+			t.Fatalf("in flight after release = %d, want 0", n)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		cl := NewConcurrencyLimiter(0, 0, time.Hour)
+		cl.Configure("limited", 1)
+		defer mustAcquire(t, cl, "limited")()
+		if _, err := cl.Acquire(context.Background(), "limited"); !errors.Is(err, ErrTooManyInFlight) {
+			t.Fatalf("request over the client's limit: error = %v, want %v", err, ErrTooManyInFlight)
+		}
+		for range 10 {
+			mustAcquire(t, cl, "other")
+		}
+	})
+}
@@ -4,30 +4,118 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"ivanjabrony/cloud-test/internal/ratelimit"
 	"log"
+	"net/netip"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Env                    string        `json:"env"`
-	LogFormat              string        `json:"log_format"`
-	TargetURL              *url.URL      `json:"target_url"`
-	Port                   int           `json:"port"`
-	MaxRetries             int           `json:"max_retries"`
-	RepositoryTimeout      time.Duration `json:"repository_timeout"`
-	BucketConfigureTimeout time.Duration `json:"bucket_configure_timeout"`
-	ShutdownTimeout        time.Duration `json:"shutdown_timeout"`
-	UserConfig             UserConfig    `json:"user_config"`
-	DB                     DBConfig      `json:"db"`
+	Env                    string            `json:"env"`
+	LogFormat              string            `json:"log_format"`
+	TargetURL              *url.URL          `json:"target_url"`
+	Port                   int               `json:"port"`
+	MaxRetries             int               `json:"max_retries"`
+	RepositoryTimeout      time.Duration     `json:"repository_timeout"`
+	BucketConfigureTimeout time.Duration     `json:"bucket_configure_timeout"`
+	ShutdownTimeout        time.Duration     `json:"shutdown_timeout"`
+	UserConfig             UserConfig        `json:"user_config"`
+	DB                     DBConfig          `json:"db"`
+	Metrics                MetricsConfig     `json:"metrics"`
+	BucketStorage          StorageConfig     `json:"bucket_storage"`
+	Redis                  RedisConfig       `json:"redis"`
+	Shaping                ShapingConfig     `json:"shaping"`
+	Concurrency            ConcurrencyConfig `json:"concurrency"`
+	AdaptiveConcurrency    AdaptiveConfig    `json:"adaptive_concurrency"`
+	ClientIdentity         IdentityConfig    `json:"client_identity"`
+}
+
+// Sources of client identity
+const (
+	IdentityRemoteIP    = "remote_ip"    // address of the connection
+	IdentityForwardedIP = "forwarded_ip" // client address from Forwarded or X-Forwarded-For set by trusted proxies
+	IdentityHeader      = "header"       // value of a header set by trusted proxies, written as "header:X-Client-ID"
+)
+
+// defaultIPv6Prefix is a prefix of a typical IPv6 subnet of a single client
+const defaultIPv6Prefix = 64
+
+// IdentityConfig configures how clients of requests are identified
+type IdentityConfig struct {
+	Sources        []string       `json:"sources"`         // several sources make a composite identity, remote_ip by default
+	TrustedProxies []netip.Prefix `json:"trusted_proxies"` // forwarded headers are honoured only from these addresses
+	IPv6Prefix     int            `json:"ipv6_prefix"`     // IPv6 addresses are cut to this prefix length, 64 by default
+}
+
+// AdaptiveConfig configures a global limit of requests in flight to the target that adapts to its latency
+type AdaptiveConfig struct {
+	Enabled      bool    `json:"enabled"`
+	InitialLimit int     `json:"initial_limit"`
+	MinLimit     int     `json:"min_limit"`
+	MaxLimit     int     `json:"max_limit"`
+	Tolerance    float64 `json:"tolerance"` // how many times latency may grow before the limit shrinks, 1.5 by default
+}
+
+// ConcurrencyConfig configures what happens to requests of a client above its limit of requests in flight
+type ConcurrencyConfig struct {
+	MaxQueue     int           `json:"max_queue"`     // max amount of requests waiting for a slot, 0 rejects them right away
+	QueueTimeout time.Duration `json:"queue_timeout"` // requests that wait longer are rejected
+}
+
+// ShapingConfig configures shaping mode, in which requests over the limit wait in a client's queue instead of being rejected
+type ShapingConfig struct {
+	Enabled  bool          `json:"enabled"`
+	MaxQueue int           `json:"max_queue"` // max amount of waiting requests of a client
+	MaxDelay time.Duration `json:"max_delay"` // requests that would wait longer are rejected
+}
+
+// RedisConfig configures connection to Redis that is used by redis bucket storage
+type RedisConfig struct {
+	Addr      string        `json:"addr"`
+	DB        int           `json:"db"`
+	KeyPrefix string        `json:"key_prefix"`
+	Timeout   time.Duration `json:"timeout"`
+	Password  string        `json:"-"`
 }
 
 type UserConfig struct {
-	Tokens     int     `json:"tokens"`
-	RatePerSec float64 `json:"rate_per_sec"`
+	Tokens      int     `json:"tokens"`
+	RatePerSec  float64 `json:"rate_per_sec"`
+	Algorithm   string  `json:"algorithm"`     // token_bucket by default
+	MaxInFlight int     `json:"max_in_flight"` // requests of a client in flight at once, 0 means no limit
+}
+
+// Implementations of in-memory bucket storage
+const (
+	StorageMutex   = "mutex"    // map with a single mutex
+	StorageSharded = "sharded"  // maps partitioned by hash of a key, each with its own mutex
+	StorageSyncMap = "sync_map" // sync.Map
+	StorageRedis   = "redis"    // buckets are shared by all replicas through Redis
+)
+
+// StorageConfig configures implementation of in-memory bucket storage and eviction of buckets from it
+type StorageConfig struct {
+	Type            string        `json:"type"`             // mutex by default
+	Shards          int           `json:"shards"`           // amount of shards of sharded storage
+	IdleTTL         time.Duration `json:"idle_ttl"`         // full buckets that are not used for this time are evicted, 0 disables eviction
+	CleanupInterval time.Duration `json:"cleanup_interval"` // how often idle buckets are looked for
+	MaxBuckets      int           `json:"max_buckets"`      // the least recently used bucket is evicted above this limit, 0 means no limit
 }
 
+// MetricsConfig configures Prometheus metrics and a listener they are served on
+type MetricsConfig struct {
+	ClientLabels bool   `json:"client_labels"` // label decisions by client, off by default to keep cardinality low
+	TopClients   int    `json:"top_clients"`   // amount of the most active clients that are labelled
+	Port         int    `json:"port"`          // metrics are not served when port is 0
+	Host         string `json:"host"`          // metrics listener is apart from the rate limited one and listens on loopback by default
+}
+
+// DefaultMetricsHost is an address metrics are served on if it isn't configured
+const DefaultMetricsHost = "127.0.0.1"
+
 type DBConfig struct {
 	MaxConns        int32         `json:"max_conns"`
 	MinConns        int32         `json:"min_conns"`
@@ -91,6 +179,35 @@ func MustLoadConfig(path string) *Config {
 			Port            string   `json:"-"`
 			Name            string   `json:"-"`
 		}
+		Metrics MetricsConfig `json:"metrics"`
+		Redis   struct {
+			Addr      string   `json:"addr"`
+			DB        int      `json:"db"`
+			KeyPrefix string   `json:"key_prefix"`
+			Timeout   duration `json:"timeout"`
+		} `json:"redis"`
+		BucketStorage struct {
+			Type            string   `json:"type"`
+			Shards          int      `json:"shards"`
+			IdleTTL         duration `json:"idle_ttl"`
+			CleanupInterval duration `json:"cleanup_interval"`
+			MaxBuckets      int      `json:"max_buckets"`
+		} `json:"bucket_storage"`
+		Shaping struct {
+			Enabled  bool     `json:"enabled"`
+			MaxQueue int      `json:"max_queue"`
+			MaxDelay duration `json:"max_delay"`
+		} `json:"shaping"`
+		Concurrency struct {
+			MaxQueue     int      `json:"max_queue"`
+			QueueTimeout duration `json:"queue_timeout"`
+		} `json:"concurrency"`
+		AdaptiveConcurrency AdaptiveConfig `json:"adaptive_concurrency"`
+		ClientIdentity      struct {
+			Sources        []string `json:"sources"`
+			TrustedProxies []string `json:"trusted_proxies"`
+			IPv6Prefix     int      `json:"ipv6_prefix"`
+		} `json:"client_identity"`
 	}
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -111,12 +228,109 @@ func MustLoadConfig(path string) *Config {
 		log.Fatalf("couldn't parse target url from config file: %s", path)
 	}
 
+	if cfg.UserConfig.Tokens <= 0 || cfg.UserConfig.RatePerSec <= 0 {
+		log.Fatalf("user_config tokens and rate_per_sec must be positive in config file: %s", path)
+	}
+	if cfg.UserConfig.Algorithm == "" {
+		cfg.UserConfig.Algorithm = ratelimit.AlgorithmTokenBucket
+	}
+	if !ratelimit.IsAlgorithm(cfg.UserConfig.Algorithm) {
+		log.Fatalf("unknown user_config algorithm %q in config file: %s", cfg.UserConfig.Algorithm, path)
+	}
+
+	if cfg.BucketStorage.IdleTTL < 0 || cfg.BucketStorage.MaxBuckets < 0 {
+		log.Fatalf("bucket_storage idle_ttl and max_buckets must be positive in config file: %s", path)
+	}
+	switch cfg.BucketStorage.Type {
+	case "":
+		cfg.BucketStorage.Type = StorageMutex
+	case StorageMutex, StorageSharded, StorageSyncMap:
+	case StorageRedis:
+		if cfg.Redis.Addr == "" {
+			log.Fatalf("redis addr is required for redis bucket_storage in config file: %s", path)
+		}
+	default:
+		log.Fatalf("unknown bucket_storage type %q in config file: %s", cfg.BucketStorage.Type, path)
+	}
+	if cfg.BucketStorage.Type == StorageRedis && cfg.UserConfig.Algorithm != ratelimit.AlgorithmTokenBucket {
+		log.Fatalf("redis bucket_storage supports only token_bucket user_config algorithm in config file: %s", path)
+	}
+	if cfg.BucketStorage.Shards < 0 {
+		log.Fatalf("bucket_storage shards must be positive in config file: %s", path)
+	}
+	if cfg.BucketStorage.CleanupInterval <= 0 {
+		cfg.BucketStorage.CleanupInterval = cfg.BucketStorage.IdleTTL
+	}
+
+	if cfg.Metrics.TopClients < 0 {
+		log.Fatalf("metrics top_clients must be positive in config file: %s", path)
+	}
+	if cfg.Metrics.Port < 0 || (cfg.Metrics.Port != 0 && cfg.Metrics.Port == cfg.Port) {
+		log.Fatalf("metrics port must be positive and differ from port in config file: %s", path)
+	}
+	if cfg.Metrics.Host == "" {
+		cfg.Metrics.Host = DefaultMetricsHost
+	}
+
+	if cfg.Shaping.Enabled && (cfg.Shaping.MaxQueue <= 0 || cfg.Shaping.MaxDelay <= 0) {
+		log.Fatalf("shaping max_queue and max_delay must be positive in config file: %s", path)
+	}
+
+	if cfg.UserConfig.MaxInFlight < 0 || cfg.Concurrency.MaxQueue < 0 {
+		log.Fatalf("user_config max_in_flight and concurrency max_queue must be positive in config file: %s", path)
+	}
+	if cfg.Concurrency.MaxQueue > 0 && cfg.Concurrency.QueueTimeout <= 0 {
+		log.Fatalf("concurrency queue_timeout must be positive if max_queue is set in config file: %s", path)
+	}
+
+	if adaptive := &cfg.AdaptiveConcurrency; adaptive.Enabled {
+		if adaptive.MinLimit <= 0 || adaptive.MinLimit > adaptive.InitialLimit || adaptive.InitialLimit > adaptive.MaxLimit {
+			log.Fatalf("adaptive_concurrency limits must be positive and min_limit <= initial_limit <= max_limit in config file: %s", path)
+		}
+		if adaptive.Tolerance == 0 {
+			adaptive.Tolerance = 1.5
+		}
+		if adaptive.Tolerance < 1 {
+			log.Fatalf("adaptive_concurrency tolerance must be at least 1 in config file: %s", path)
+		}
+	}
+
+	identity := cfg.ClientIdentity
+	if len(identity.Sources) == 0 {
+		identity.Sources = []string{IdentityRemoteIP}
+	}
+	for _, s := range identity.Sources {
+		name, header, _ := strings.Cut(s, ":")
+		if name != IdentityRemoteIP && name != IdentityForwardedIP && (name != IdentityHeader || header == "") {
+			log.Fatalf("unknown client_identity source %q in config file: %s", s, path)
+		}
+	}
+	if identity.IPv6Prefix == 0 {
+		identity.IPv6Prefix = defaultIPv6Prefix
+	}
+	if identity.IPv6Prefix < 0 || identity.IPv6Prefix > 128 {
+		log.Fatalf("client_identity ipv6_prefix must be between 1 and 128 in config file: %s", path)
+	}
+	trustedProxies, err := parsePrefixes(identity.TrustedProxies)
+	if err != nil {
+		log.Fatalf("couldn't parse client_identity trusted_proxies from config file: %s: %v", path, err)
+	}
+	for _, s := range identity.Sources {
+		if strings.HasPrefix(s, IdentityHeader+":") && len(trustedProxies) == 0 {
+			log.Fatalf("client_identity source %q needs trusted_proxies in config file: %s", s, path)
+		}
+	}
+
 	cfg.DB.Password = os.Getenv("DATABASE_PASSWORD")
 	cfg.DB.User = os.Getenv("DATABASE_USER")
 	cfg.DB.Host = os.Getenv("DATABASE_HOST")
 	cfg.DB.Port = os.Getenv("DATABASE_PORT")
 	cfg.DB.Name = os.Getenv("DATABASE_NAME")
 
+	if cfg.Redis.KeyPrefix == "" {
+		cfg.Redis.KeyPrefix = "ratelimit:"
+	}
+
 	return &Config{
 		cfg.Env,
 		cfg.LogFormat,
@@ -135,5 +349,57 @@ func MustLoadConfig(path string) *Config {
 			cfg.DB.Host,
 			cfg.DB.Port,
 			cfg.DB.Name},
+		cfg.Metrics,
+		StorageConfig{
+			cfg.BucketStorage.Type,
+			cfg.BucketStorage.Shards,
+			time.Duration(cfg.BucketStorage.IdleTTL),
+			time.Duration(cfg.BucketStorage.CleanupInterval),
+			cfg.BucketStorage.MaxBuckets,
+		},
+		RedisConfig{
+			cfg.Redis.Addr,
+			cfg.Redis.DB,
+			cfg.Redis.KeyPrefix,
+			time.Duration(cfg.Redis.Timeout),
+			os.Getenv("REDIS_PASSWORD"),
+		},
+		ShapingConfig{
+			cfg.Shaping.Enabled,
+			cfg.Shaping.MaxQueue,
+			time.Duration(cfg.Shaping.MaxDelay),
+		},
+		ConcurrencyConfig{
+			cfg.Concurrency.MaxQueue,
+			time.Duration(cfg.Concurrency.QueueTimeout),
+		},
+		cfg.AdaptiveConcurrency,
+		IdentityConfig{
+			identity.Sources,
+			trustedProxies,
+			identity.IPv6Prefix,
+		},
+	}
+}
+
+// parsePrefixes parses CIDRs, a single address is a prefix of its full length
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
+	return prefixes, nil
 }
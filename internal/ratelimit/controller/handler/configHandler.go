@@ -5,43 +5,84 @@ import (
 	"encoding/json"
 	"errors"
 	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"ivanjabrony/cloud-test/internal/ratelimit/dto"
 	"net/http"
 )
 
 type ConfigHandler struct {
-	cfg    *config.Config
-	logger *logger.MyLogger
-	rl     RateLimitService
+	cfg     *config.Config
+	logger  *logger.MyLogger
+	rl      RateLimitService
+	ids     IDNormalizer
+	metrics ConfigMetrics
+}
+
+// IDNormalizer brings client identities given by users to the form clients are identified with
+type IDNormalizer interface {
+	NormalizeID(id string) string
 }
 
 type RateLimitService interface {
 	CreateOrUpdateConfig(ctx context.Context, userConfig *dto.UserConfig) error
 }
 
-func NewConfigHandler(cfg *config.Config, logger *logger.MyLogger, rl RateLimitService) (*ConfigHandler, error) {
-	if cfg == nil || logger == nil || rl == nil {
+// ConfigMetrics records calls of the configuration API
+type ConfigMetrics interface {
+	ObserveConfigRequest(status int)
+}
+
+func NewConfigHandler(cfg *config.Config, logger *logger.MyLogger, rl RateLimitService, ids IDNormalizer, metrics ConfigMetrics) (*ConfigHandler, error) {
+	if cfg == nil || logger == nil || rl == nil || ids == nil || metrics == nil {
 		return nil, errors.New("nil values in handler constructor")
 	}
-	return &ConfigHandler{cfg, logger, rl}, nil
+	return &ConfigHandler{cfg, logger, rl, ids, metrics}, nil
 }
 
 func (c *ConfigHandler) UpdateConfiguration(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	defer func() { c.metrics.ObserveConfigRequest(status) }()
+
 	var req dto.UserConfig
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		status = http.StatusBadRequest
+		http.Error(w, "Invalid request", status)
 		return
 	}
 
 	if req.Capacity <= 0 || req.RatePerSec <= 0 {
-		http.Error(w, "Capacity and rate must be positive", http.StatusBadRequest)
+		status = http.StatusBadRequest
+		http.Error(w, "Capacity and rate must be positive", status)
+		return
+	}
+
+	if req.MaxInFlight < 0 {
+		status = http.StatusBadRequest
+		http.Error(w, "Max in flight must be positive", status)
 		return
 	}
 
+	if !ratelimit.IsAlgorithm(req.Algorithm) {
+		status = http.StatusBadRequest
+		http.Error(w, "Unknown algorithm", status)
+		return
+	}
+
+	// redis keeps only token buckets, a config with another algorithm must not be saved
+	if c.cfg.BucketStorage.Type == config.StorageRedis && req.Algorithm != "" && req.Algorithm != ratelimit.AlgorithmTokenBucket {
+		status = http.StatusBadRequest
+		http.Error(w, "Redis bucket storage supports only token_bucket algorithm", status)
+		return
+	}
+
+	// an IPv6 address is stored as the prefix its requests are counted by
+	req.Ip = c.ids.NormalizeID(req.Ip)
+
 	err := c.rl.CreateOrUpdateConfig(r.Context(), &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
 		return
 	}
 
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit/config"
+	"ivanjabrony/cloud-test/internal/ratelimit/dto"
+	"ivanjabrony/cloud-test/internal/ratelimit/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testService records configs saved through it
+type testService struct {
+	saved []dto.UserConfig
+}
+
+func (s *testService) CreateOrUpdateConfig(_ context.Context, userConfig *dto.UserConfig) error {
+	s.saved = append(s.saved, *userConfig)
+	return nil
+}
+
+// testNormalizer keeps identities as they are
+type testNormalizer struct{}
+
+func (testNormalizer) NormalizeID(id string) string {
+	return id
+}
+
+func TestUpdateConfigurationAlgorithm(t *testing.T) {
+	tests := []struct {
+		name       string
+		storage    string
+		algorithm  string
+		wantStatus int
+	}{
+		{"memory gcra", config.StorageMutex, "gcra", http.StatusOK},
+		{"memory unknown", config.StorageMutex, "leaky_bucket", http.StatusBadRequest},
+		{"redis token bucket", config.StorageRedis, "token_bucket", http.StatusOK},
+		{"redis default", config.StorageRedis, "", http.StatusOK},
+		{"redis gcra", config.StorageRedis, "gcra", http.StatusBadRequest},
+		{"redis sliding window", config.StorageRedis, "sliding_window_log", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{BucketStorage: config.StorageConfig{Type: tt.storage}}
+			service := &testService{}
+			h, err := NewConfigHandler(cfg, logger.New(logger.EnvProd, logger.LogFormatText), service, testNormalizer{}, metrics.New(config.MetricsConfig{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := `{"ip": "192.0.2.1", "capacity": 10, "rate_per_sec": 1, "algorithm": "` + tt.algorithm + `"}`
+			rec := httptest.NewRecorder()
+			h.UpdateConfiguration(rec, httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %q", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if saved := len(service.saved) == 1; saved != (tt.wantStatus == http.StatusOK) {
+				t.Fatalf("saved configs = %+v, want saved only with status 200", service.saved)
+			}
+		})
+	}
+}
@@ -2,69 +2,254 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"strconv"
+	"time"
 )
 
 type RateLimiter interface {
-	Allow(ctx context.Context, ip string) bool
+	Allow(ctx context.Context, ip string) ratelimit.Decision
+	Wait(ctx context.Context, ip string, maxQueue int, maxDelay time.Duration) (ratelimit.Decision, error)
+	CancelReservation(ctx context.Context, ip string)
 }
 
+// ClientIdentifier identifies clients of requests
+type ClientIdentifier interface {
+	ClientID(r *http.Request) string
+}
+
+// ConcurrencyLimiter limits requests of a client in flight
+type ConcurrencyLimiter interface {
+	Acquire(ctx context.Context, client string) (release func(), err error)
+}
+
+// AdaptiveLimiter is a global limit of requests in flight to the target that adapts to its latency
+type AdaptiveLimiter interface {
+	Acquire() (release func(rtt time.Duration, dropped bool), ok bool)
+}
+
+// RateLimitMetrics records decisions of the rate limiter and latency of the target
+type RateLimitMetrics interface {
+	ObserveDecision(client string, allowed bool)
+	ObserveProxy(status int, duration time.Duration)
+	ObserveShaping(delay time.Duration)
+	ObserveInFlightDenied()
+	ObserveAdaptiveShed()
+}
+
+// RateLimitProxy proxies requests to the target, sheds them if adaptive limit is exceeded
 type RateLimitProxy struct {
 	targetURL *url.URL
 	proxy     *httputil.ReverseProxy
+	adaptive  AdaptiveLimiter // nil if adaptive concurrency limit is disabled
+	logger    *logger.MyLogger
+	metrics   RateLimitMetrics
 }
 
 type RateLimitHandler struct {
 	cfg         *config.Config
 	logger      *logger.MyLogger
 	proxy       *RateLimitProxy
+	identity    ClientIdentifier
 	rateLimiter RateLimiter
+	concurrency ConcurrencyLimiter
+	metrics     RateLimitMetrics
 }
 
-func NewRateLimitHandler(cfg *config.Config, logger *logger.MyLogger, ratelimiter RateLimiter) (*RateLimitHandler, error) {
-	if cfg == nil || logger == nil || ratelimiter == nil {
+// NewRateLimitHandler creates a handler that proxies allowed requests to the target, adaptive may be nil
+func NewRateLimitHandler(cfg *config.Config, logger *logger.MyLogger, identity ClientIdentifier, ratelimiter RateLimiter, concurrency ConcurrencyLimiter, adaptive AdaptiveLimiter, metrics RateLimitMetrics) (*RateLimitHandler, error) {
+	if cfg == nil || logger == nil || identity == nil || ratelimiter == nil || concurrency == nil || metrics == nil {
 		return nil, errors.New("nil values in handler constructor")
 	}
 
-	return &RateLimitHandler{cfg, logger, newRateLimitProxy(cfg.TargetURL), ratelimiter}, nil
+	return &RateLimitHandler{cfg, logger, newRateLimitProxy(cfg.TargetURL, logger, adaptive, metrics), identity, ratelimiter, concurrency, metrics}, nil
+}
+
+type ctxKey int
+
+const proxyRequestKey ctxKey = iota
+
+// proxyRequest is a request proxied to the target, it is filled when response headers are received
+type proxyRequest struct {
+	start  time.Time
+	rtt    time.Duration
+	status int // 0 if no response was received
 }
 
-func newRateLimitProxy(url *url.URL) *RateLimitProxy {
+// newRateLimitProxy creates a proxy to the target that reports latency of its responses
+func newRateLimitProxy(url *url.URL, logger *logger.MyLogger, adaptive AdaptiveLimiter, metrics RateLimitMetrics) *RateLimitProxy {
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// the client is limited by the rate limiter, limits of the target must not be mixed with its headers
+		for _, h := range rateLimitHeaders {
+			resp.Header.Del(h)
+		}
+		if req, ok := resp.Request.Context().Value(proxyRequestKey).(*proxyRequest); ok {
+			req.rtt, req.status = time.Since(req.start), resp.StatusCode
+			metrics.ObserveProxy(req.status, req.rtt)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if req, ok := r.Context().Value(proxyRequestKey).(*proxyRequest); ok {
+			req.rtt, req.status = time.Since(req.start), 0
+			metrics.ObserveProxy(req.status, req.rtt)
+		}
+		logger.Error("Target unreachable", slog.String("URL", url.String()), slog.Any("error", err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
 	return &RateLimitProxy{
 		targetURL: url,
-		proxy:     httputil.NewSingleHostReverseProxy(url),
+		proxy:     proxy,
+		adaptive:  adaptive,
+		logger:    logger,
+		metrics:   metrics,
+	}
+}
+
+// ServeHTTP proxies request to the target.
+// With adaptive limit, a request above it is shed with 503 and RTT of a proxied one adapts the limit
+func (p *RateLimitProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.serve(w, r, func() {})
+}
+
+// serve is ServeHTTP that calls onShed if the request is shed
+func (p *RateLimitProxy) serve(w http.ResponseWriter, r *http.Request, onShed func()) {
+	req := &proxyRequest{start: time.Now()}
+	ctx := context.WithValue(r.Context(), proxyRequestKey, req)
+
+	if p.adaptive == nil {
+		p.proxy.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	release, ok := p.adaptive.Acquire()
+	if !ok {
+		onShed()
+		p.metrics.ObserveAdaptiveShed()
+		p.logger.Warn("Adaptive concurrency limit exceeded, request is shed")
+		writeRetryLater(p.logger, w, http.StatusServiceUnavailable, "target is overloaded", time.Second)
+		return
 	}
+
+	defer func() {
+		// canceled requests tell nothing about the target
+		if req.status == 0 && r.Context().Err() != nil {
+			release(0, false)
+			return
+		}
+		dropped := req.status == 0 || req.status == http.StatusServiceUnavailable || req.status == http.StatusGatewayTimeout
+		release(req.rtt, dropped)
+	}()
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
 func (rl *RateLimitHandler) RateLimit(w http.ResponseWriter, r *http.Request) {
-	clientIP := strings.Split(getClientID(r), ":")[0]
+	clientID := rl.identity.ClientID(r)
 
-	// check rate limit
-	if !rl.rateLimiter.Allow(r.Context(), clientIP) {
-		rl.logger.Warn("Rate limit exceeded", slog.String("client", clientIP))
-		w.WriteHeader(http.StatusTooManyRequests)
+	// check rate limit, the token is given back if the request is rejected by concurrency limits
+	decision, cancel, err := rl.check(r.Context(), clientID)
+	if err != nil {
+		// the client has gone, nobody would read a response
+		rl.logger.Debug("Request canceled while waiting in queue", slog.String("client", clientID), slog.Any("error", err))
+		return
+	}
+	rl.metrics.ObserveDecision(clientID, decision.Allowed)
+	setRateLimitHeaders(w.Header(), decision)
+	if !decision.Allowed {
+		rl.logger.Warn("Rate limit exceeded", slog.String("client", clientID))
+		writeRateLimitExceeded(rl.logger, w, decision)
 		return
 	}
 
+	// slot is released when the proxy returns: the target has responded, failed or the client has gone
+	release, err := rl.concurrency.Acquire(r.Context(), clientID)
+	if err != nil {
+		cancel()
+	}
+	if errors.Is(err, ratelimit.ErrTooManyInFlight) {
+		rl.metrics.ObserveInFlightDenied()
+		rl.logger.Warn("Too many requests in flight", slog.String("client", clientID))
+		writeRetryLater(rl.logger, w, http.StatusTooManyRequests, "too many requests in flight", time.Second)
+		return
+	}
+	if err != nil {
+		rl.logger.Debug("Request canceled while waiting for a slot", slog.String("client", clientID), slog.Any("error", err))
+		return
+	}
+	defer release()
+
 	rl.logger.Debug("Proxying request",
-		slog.String("client", clientIP),
+		slog.String("client", clientID),
 		slog.String("path", r.URL.Path),
 		slog.String("target", rl.proxy.targetURL.String()))
 
 	// retranslating request
-	rl.proxy.proxy.ServeHTTP(w, r)
+	rl.proxy.serve(w, r, cancel)
+}
+
+// check checks the client's limit, in shaping mode a request over the limit waits in the client's queue.
+// Returned cancel gives back the token taken by an allowed request
+func (rl *RateLimitHandler) check(ctx context.Context, clientID string) (decision ratelimit.Decision, cancel func(), err error) {
+	cancel = func() { rl.rateLimiter.CancelReservation(context.WithoutCancel(ctx), clientID) }
+	shaping := rl.cfg.Shaping
+	if !shaping.Enabled {
+		return rl.rateLimiter.Allow(ctx, clientID), cancel, nil
+	}
+
+	start := time.Now()
+	decision, err = rl.rateLimiter.Wait(ctx, clientID, shaping.MaxQueue, shaping.MaxDelay)
+	if err == nil && decision.Allowed {
+		rl.metrics.ObserveShaping(time.Since(start))
+	}
+	return decision, cancel, err
+}
+
+// rateLimitHeaders are headers of the IETF RateLimit draft set by setRateLimitHeaders
+var rateLimitHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}
+
+// setRateLimitHeaders reports a state of the client's limit with headers of the IETF RateLimit draft
+func setRateLimitHeaders(h http.Header, d ratelimit.Decision) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+type rateLimitError struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after"` // seconds
+}
+
+// writeRateLimitExceeded writes 429 response with Retry-After header and JSON body
+func writeRateLimitExceeded(logger *logger.MyLogger, w http.ResponseWriter, d ratelimit.Decision) {
+	writeRetryLater(logger, w, http.StatusTooManyRequests, "rate limit exceeded", d.RetryAfter)
+}
+
+// writeRetryLater writes a response with a status, an error message and time until retry
+func writeRetryLater(logger *logger.MyLogger, w http.ResponseWriter, status int, message string, retryAfter time.Duration) {
+	// at least a second, clients treat zero as "retry immediately"
+	seconds := max(ceilSeconds(retryAfter), 1)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(rateLimitError{message, seconds})
+	if err != nil {
+		logger.Error("Error while writing response", slog.Any("error", err))
+	}
 }
 
-func getClientID(r *http.Request) string {
-	// if id := r.Header.Get("X-Client-ID"); id != "" {
-	// 	return id
-	// }
-	return r.RemoteAddr
+// ceilSeconds rounds a duration up to whole seconds, as headers carry only integer seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
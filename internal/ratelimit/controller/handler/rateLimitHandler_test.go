@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"ivanjabrony/cloud-test/internal/ratelimit/config"
+	"ivanjabrony/cloud-test/internal/ratelimit/metrics"
+	"ivanjabrony/cloud-test/internal/ratelimit/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testClient = "192.0.2.1"
+
+// testIdentity identifies every request as the same client
+type testIdentity string
+
+func (id testIdentity) ClientID(*http.Request) string {
+	return string(id)
+}
+
+// newTestRateLimiter returns an in-memory token bucket rate limiter
+func newTestRateLimiter(t *testing.T, capacity int, ratePerSec float64) *ratelimit.RateLimiter {
+	t.Helper()
+
+	rl, err := ratelimit.NewRateLimiter(storage.NewBucketStorage(0, 0, 0), capacity, ratePerSec, ratelimit.AlgorithmTokenBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+// newTestHandler returns a handler that proxies requests to target, adaptive may be nil
+func newTestHandler(t *testing.T, cfg *config.Config, target http.Handler, rl RateLimiter, concurrency ConcurrencyLimiter, adaptive AdaptiveLimiter) *RateLimitHandler {
+	t.Helper()
+
+	srv := httptest.NewServer(target)
+	t.Cleanup(srv.Close)
+	targetURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.TargetURL = targetURL
+
+	h, err := NewRateLimitHandler(cfg, logger.New(logger.EnvProd, logger.LogFormatText), testIdentity(testClient),
+		rl, concurrency, adaptive, metrics.New(config.MetricsConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func serve(h *RateLimitHandler) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.RateLimit(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec
+}
+
+// TestRateLimitHeadersReplaceTarget checks that RateLimit headers of the target don't reach the client next to the limiter's ones
+func TestRateLimitHeadersReplaceTarget(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "1000")
+		w.Header().Set("RateLimit-Remaining", "999")
+		w.Header().Set("RateLimit-Reset", "60")
+		w.Header().Set("X-Target", "yes")
+	})
+	h := newTestHandler(t, &config.Config{}, target, newTestRateLimiter(t, 5, 1), ratelimit.NewConcurrencyLimiter(0, 0, 0), nil)
+
+	rec := serve(h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	want := map[string]string{"RateLimit-Limit": "5", "RateLimit-Remaining": "4", "RateLimit-Reset": "1", "X-Target": "yes"}
+	for name, value := range want {
+		if got := rec.Header().Values(name); len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %q, want [%s]", name, got, value)
+		}
+	}
+}
+
+// TestCanceledWaitWritesNothing checks that no response is written to a client that has gone while its request was queued
+func TestCanceledWaitWritesNothing(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	cfg := &config.Config{Shaping: config.ShapingConfig{Enabled: true, MaxQueue: 10, MaxDelay: time.Hour}}
+	h := newTestHandler(t, cfg, target, newTestRateLimiter(t, 1, 1), ratelimit.NewConcurrencyLimiter(0, 0, 0), nil)
+
+	if rec := serve(h); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	h.RateLimit(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if len(rec.Header()) != 0 || rec.Body.Len() != 0 {
+		t.Fatalf("canceled request: headers %v, body %q, want nothing written", rec.Header(), rec.Body.String())
+	}
+}
+
+// rejectingConcurrency rejects every request as if its client had too many requests in flight
+type rejectingConcurrency struct{}
+
+func (rejectingConcurrency) Acquire(context.Context, string) (func(), error) {
+	return nil, ratelimit.ErrTooManyInFlight
+}
+
+// rejectingAdaptive sheds every request as if the target were overloaded
+type rejectingAdaptive struct{}
+
+func (rejectingAdaptive) Acquire() (func(time.Duration, bool), bool) {
+	return nil, false
+}
+
+// TestRejectedRequestGivesTokenBack checks that a request allowed by the rate limit and rejected
+// by a concurrency limit doesn't take the client's token, with and without shaping
+func TestRejectedRequestGivesTokenBack(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("rejected request reached the target")
+	})
+	tests := []struct {
+		name        string
+		concurrency ConcurrencyLimiter
+		adaptive    AdaptiveLimiter
+		wantStatus  int
+	}{
+		{"in flight", rejectingConcurrency{}, nil, http.StatusTooManyRequests},
+		{"adaptive", ratelimit.NewConcurrencyLimiter(0, 0, 0), rejectingAdaptive{}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		for _, shaping := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/shaping %v", tt.name, shaping), func(t *testing.T) {
+				cfg := &config.Config{Shaping: config.ShapingConfig{Enabled: shaping, MaxQueue: 10, MaxDelay: time.Second}}
+				// tokens are not refilled during the test
+				rl := newTestRateLimiter(t, 2, 0.001)
+				h := newTestHandler(t, cfg, target, rl, tt.concurrency, tt.adaptive)
+
+				for i := range 3 {
+					if rec := serve(h); rec.Code != tt.wantStatus {
+						t.Fatalf("request %d: status = %d, want %d", i, rec.Code, tt.wantStatus)
+					}
+				}
+				if d := rl.Allow(context.Background(), testClient); !d.Allowed || d.Remaining != 1 {
+					t.Fatalf("decision after rejected requests = %+v, want allowed with 1 remaining", d)
+				}
+			})
+		}
+	}
+}
+
+// TestInFlightLimit checks that a request over the client's limit of requests in flight gets 429 and doesn't reach the target
+func TestInFlightLimit(t *testing.T) {
+	var proxied atomic.Int32
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proxied.Add(1) })
+	concurrency := ratelimit.NewConcurrencyLimiter(1, 0, 0)
+	h := newTestHandler(t, &config.Config{}, target, newTestRateLimiter(t, 10, 1), concurrency, nil)
+
+	// the client's only slot is taken by a request in flight
+	release, err := concurrency.Acquire(context.Background(), testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	var body rateLimitError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body != (rateLimitError{"too many requests in flight", 1}) {
+		t.Fatalf("body = %+v, want too many requests in flight with retry after 1", body)
+	}
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("RateLimit-Limit") != "10" {
+		t.Fatalf("headers = %v, want Retry-After 1 and RateLimit-Limit 10", rec.Header())
+	}
+	if proxied.Load() != 0 {
+		t.Fatal("rejected request reached the target")
+	}
+
+	release()
+	if rec := serve(h); rec.Code != http.StatusOK || proxied.Load() != 1 {
+		t.Fatalf("request after release: status = %d, proxied %d, want 200 and proxied", rec.Code, proxied.Load())
+	}
+	if n := concurrency.InFlight(); n != 0 {
+		t.Fatalf("in flight after the proxied request = %d, want 0", n)
+	}
+}
+
+// TestAdaptiveShed checks that a request over the adaptive limit is shed with 503 and doesn't reach the target
+func TestAdaptiveShed(t *testing.T) {
+	var proxied atomic.Int32
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proxied.Add(1) })
+	adaptive := ratelimit.NewAdaptiveLimiter(1, 1, 1, 1.5)
+	h := newTestHandler(t, &config.Config{}, target, newTestRateLimiter(t, 10, 1), ratelimit.NewConcurrencyLimiter(0, 0, 0), adaptive)
+
+	// the only slot of the target is taken by a request in flight
+	release, ok := adaptive.Acquire()
+	if !ok {
+		t.Fatal("adaptive limit is exceeded without requests")
+	}
+
+	rec := serve(h)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var body rateLimitError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body != (rateLimitError{"target is overloaded", 1}) {
+		t.Fatalf("body = %+v, want target is overloaded with retry after 1", body)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+	}
+	if proxied.Load() != 0 {
+		t.Fatal("shed request reached the target")
+	}
+
+	release(0, false)
+	if rec := serve(h); rec.Code != http.StatusOK || proxied.Load() != 1 {
+		t.Fatalf("request after release: status = %d, proxied %d, want 200 and proxied", rec.Code, proxied.Load())
+	}
+	if n := adaptive.InFlight(); n != 0 {
+		t.Fatalf("in flight after the proxied request = %d, want 0", n)
+	}
+}
+
+// TestAdaptiveFailures checks that the adaptive limit drops by 10% when the target is overloaded or unreachable
+func TestAdaptiveFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     http.HandlerFunc
+		wantStatus int
+		wantLimit  int
+	}{
+		{"ok", func(w http.ResponseWriter, r *http.Request) {}, http.StatusOK, 100},
+		{"internal error", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, http.StatusInternalServerError, 100},
+		{"unavailable", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) }, http.StatusServiceUnavailable, 90},
+		{"gateway timeout", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusGatewayTimeout) }, http.StatusGatewayTimeout, 90},
+		{"no response", func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }, http.StatusBadGateway, 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adaptive := ratelimit.NewAdaptiveLimiter(100, 5, 1000, 1.5)
+			h := newTestHandler(t, &config.Config{}, tt.target, newTestRateLimiter(t, 10, 1), ratelimit.NewConcurrencyLimiter(0, 0, 0), adaptive)
+
+			if rec := serve(h); rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if limit, inFlight := adaptive.Limit(), adaptive.InFlight(); limit != tt.wantLimit || inFlight != 0 {
+				t.Fatalf("limit = %d, in flight = %d, want %d and 0", limit, inFlight, tt.wantLimit)
+			}
+		})
+	}
+}
@@ -2,21 +2,28 @@ package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"ivanjabrony/cloud-test/internal/logger"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 )
 
 // RLRouter routes requests to a dedicated handlers based on a path
 //
 // - If its a POST request with /config path then it routes to a ConfigHandler
 // - If its anything else then it routes to a RateLimitHandler
+//
+// Prometheus metrics are served by a separate server on metrics port, so they are neither
+// rate limited nor exposed to clients of the target
 type RLRouter struct {
-	cfg    *config.Config
-	logger *logger.MyLogger
-	server *http.Server
+	cfg           *config.Config
+	logger        *logger.MyLogger
+	server        *http.Server
+	metricsServer *http.Server // nil if metrics are not served
 }
 
 type ConfigHandler interface {
@@ -27,18 +34,35 @@ type RateLimitHandler interface {
 	RateLimit(w http.ResponseWriter, r *http.Request)
 }
 
-func NewRouter(cfg *config.Config, logger *logger.MyLogger, configHandler ConfigHandler, rlHandler RateLimitHandler) *RLRouter {
+func NewRouter(cfg *config.Config, logger *logger.MyLogger, configHandler ConfigHandler, rlHandler RateLimitHandler, metricsHandler http.Handler) *RLRouter {
 	r := http.NewServeMux()
 
 	r.HandleFunc("POST /config", configHandler.UpdateConfiguration)
 	r.HandleFunc("/", rlHandler.RateLimit)
 
 	server := http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", cfg.Port), Handler: r}
-	return &RLRouter{cfg, logger, &server}
+
+	var metricsServer *http.Server
+	if cfg.Metrics.Port != 0 {
+		m := http.NewServeMux()
+		m.Handle("GET /metrics", metricsHandler)
+		metricsServer = &http.Server{Addr: net.JoinHostPort(cfg.Metrics.Host, strconv.Itoa(cfg.Metrics.Port)), Handler: m}
+	}
+
+	return &RLRouter{cfg, logger, &server, metricsServer}
 }
 
-// Run starts an http server on a configured port
+// Run starts an http server on a configured port and a metrics server if it is configured
 func (s *RLRouter) Run() error {
+	if s.metricsServer != nil {
+		go func() {
+			s.logger.Info("Started serving metrics", slog.String("address", s.metricsServer.Addr))
+			if err := s.metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("Error while serving metrics", slog.Any("error", err))
+			}
+		}()
+	}
+
 	s.logger.Info("Started serving on configured port", slog.Int("port", s.cfg.Port))
 	return s.server.ListenAndServe()
 }
@@ -50,5 +74,10 @@ func (s *RLRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Stop shuts down an http server
 func (s *RLRouter) Stop(ctx context.Context) error {
 	s.logger.Info("Started shutting down router")
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			s.logger.Error("Error while shutting down metrics server", slog.Any("error", err))
+		}
+	}
 	return s.server.Shutdown(ctx)
 }
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Decision is a result of a rate limit check with a state of a client's limit after the check
+type Decision struct {
+	Allowed    bool
+	Limit      int           // max amount of requests a client can make at once
+	Remaining  int           // requests a client can make right now
+	Reset      time.Duration // time until the limit is fully restored
+	RetryAfter time.Duration // time until the next request is allowed, zero if it is allowed right now
+}
+
+// NewDecision describes a state of a token bucket with capacity, available tokens and rate after a check.
+// Available tokens are negative if they are reserved for queued requests
+func NewDecision(allowed bool, capacity int, available, ratePerSec float64) Decision {
+	d := Decision{
+		Allowed:   allowed,
+		Limit:     capacity,
+		Remaining: max(int(available), 0),
+		Reset:     tokensDuration(float64(capacity)-available, ratePerSec),
+	}
+	if !allowed {
+		d.RetryAfter = tokensDuration(1-available, ratePerSec)
+	}
+	return d
+}
+
+// tokensDuration returns time needed to refill an amount of tokens with a rate
+func tokensDuration(tokens, ratePerSec float64) time.Duration {
+	if tokens <= 0 || ratePerSec <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(tokens / ratePerSec * float64(time.Second)))
+}
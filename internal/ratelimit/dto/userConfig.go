@@ -1,7 +1,9 @@
 package dto
 
 type UserConfig struct {
-	Ip         string  `json:"ip" bd:"ip"`
-	Capacity   int     `json:"capacity" bd:"capacity"`
-	RatePerSec float64 `json:"rate_per_sec" bd:"rate_per_sec"`
+	Ip          string  `json:"ip" bd:"ip"`
+	Capacity    int     `json:"capacity" bd:"capacity"`
+	RatePerSec  float64 `json:"rate_per_sec" bd:"rate_per_sec"`
+	Algorithm   string  `json:"algorithm" bd:"algorithm"`         // empty means default algorithm from config
+	MaxInFlight int     `json:"max_in_flight" bd:"max_in_flight"` // zero means default limit from config
 }
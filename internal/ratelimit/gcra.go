@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// GCRA is the Generic Cell Rate Algorithm, a token bucket that keeps a single timestamp
+//
+// Requests are expected to arrive once per emission interval 1/rate. Theoretical arrival time (TAT)
+// is the time the limit would be fully restored at, a request is allowed if it doesn't push TAT
+// further than capacity intervals from now, so capacity is a burst. Decisions are the same as
+// of TokenBucket with the same capacity and rate, but the state is cheap to keep and to share
+type GCRA struct {
+	capacity   int
+	ratePerSec float64
+	tat        time.Time // theoretical arrival time, the limit is fully restored at it
+	lastUsed   time.Time
+	mu         sync.Mutex
+}
+
+// NewGCRA creates a limiter with a fully restored limit
+func NewGCRA(capacity int, ratePerSec float64) *GCRA {
+	now := time.Now()
+	return &GCRA{
+		capacity:   capacity,
+		ratePerSec: ratePerSec,
+		tat:        now,
+		lastUsed:   now,
+	}
+}
+
+// interval returns emission interval in seconds, time in which one request is restored
+func (g *GCRA) interval() float64 {
+	if g.ratePerSec <= 0 {
+		// zero rate never restores the limit, all intervals together must still fit into a Duration
+		return foreverWindow.Seconds() / float64(max(g.capacity, 1))
+	}
+	return 1 / g.ratePerSec
+}
+
+// available returns amount of requests a client can make at now, negative if requests are reserved ahead
+func (g *GCRA) available(now time.Time) float64 {
+	return float64(g.capacity) - max(g.tat.Sub(now).Seconds(), 0)/g.interval()
+}
+
+// take moves TAT by one interval, must be called with locked mutex
+func (g *GCRA) take(now time.Time) {
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(time.Duration(g.interval() * float64(time.Second)))
+}
+
+// allow is Allow at now, must be called with locked mutex
+func (g *GCRA) allow(now time.Time) Decision {
+	g.lastUsed = now
+
+	available := g.available(now)
+	allowed := available >= 1
+	if allowed {
+		g.take(now)
+		available--
+	}
+
+	return NewDecision(allowed, g.capacity, available, g.ratePerSec)
+}
+
+func (g *GCRA) Allow() Decision {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.allow(time.Now())
+}
+
+// Reserve takes the next interval for a request even if it has to wait for it, see TokenBucket.Reserve
+func (g *GCRA) Reserve(maxQueue int, maxDelay time.Duration) (Decision, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.reserve(time.Now(), maxQueue, maxDelay)
+}
+
+// reserve is Reserve at now, must be called with locked mutex
+func (g *GCRA) reserve(now time.Time, maxQueue int, maxDelay time.Duration) (Decision, time.Duration) {
+	available := g.available(now)
+	if available >= 1 {
+		return g.allow(now), 0
+	}
+
+	g.lastUsed = now
+	queued := int(math.Ceil(-available))
+	delay := tokensDuration(1-available, g.ratePerSec)
+	if g.ratePerSec <= 0 || queued >= maxQueue || delay > maxDelay {
+		return NewDecision(false, g.capacity, available, g.ratePerSec), 0
+	}
+
+	g.take(now)
+	return NewDecision(true, g.capacity, available-1, g.ratePerSec), delay
+}
+
+// CancelReservation gives back the interval of a request that stopped waiting
+func (g *GCRA) CancelReservation() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tat = g.tat.Add(-time.Duration(g.interval() * float64(time.Second)))
+}
+
+// UpdateConfig changes capacity and rate, available requests are kept as TokenBucket keeps its tokens
+func (g *GCRA) UpdateConfig(newCapacity int, newRatePerSec float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	available := min(max(g.available(now), 0), float64(newCapacity))
+
+	g.capacity = newCapacity
+	g.ratePerSec = newRatePerSec
+	debt := (float64(newCapacity) - available) * g.interval()
+	g.tat = now.Add(time.Duration(debt * float64(time.Second)))
+	g.lastUsed = now
+}
+
+func (g *GCRA) LastUsed() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.lastUsed
+}
+
+// IsIdle checks if a limiter was not used for ttl and its limit is fully restored
+func (g *GCRA) IsIdle(now time.Time, ttl time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return now.Sub(g.lastUsed) >= ttl && !g.tat.After(now)
+}
+
+func (g *GCRA) Algorithm() string {
+	return AlgorithmGCRA
+}
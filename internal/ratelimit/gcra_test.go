@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// TestGCRAMatchesTokenBucket checks that GCRA makes the same decisions as TokenBucket with the same config
+// on random arrival sequences. Both limiters are driven by an injected clock, so the test doesn't depend on timing
+func TestGCRAMatchesTokenBucket(t *testing.T) {
+	const (
+		sequences = 1000
+		requests  = 300
+		// GCRA keeps time in whole nanoseconds and the token bucket keeps tokens in floats,
+		// a request that arrives right at a refill may be decided differently by them
+		boundary = time.Microsecond
+	)
+
+	rates := []float64{0.5, 1, 3, 10, 100, 1000}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for seed := range uint64(sequences) {
+		r := rand.New(rand.NewPCG(seed, seed))
+		capacity := 1 + r.IntN(20)
+		rate := rates[r.IntN(len(rates))]
+		if r.IntN(2) == 0 {
+			rate *= 0.5 + r.Float64()
+		}
+		interval := time.Duration(float64(time.Second) / rate)
+
+		tb := &TokenBucket{capacity: capacity, ratePerSec: rate, available: float64(capacity), lastRefill: start}
+		g := &GCRA{capacity: capacity, ratePerSec: rate, tat: start, lastUsed: start}
+
+		now := start
+		for i := range requests {
+			// bursts of simultaneous requests, requests faster and slower than the rate and long pauses
+			switch r.IntN(4) {
+			case 0:
+			case 1:
+				now = now.Add(time.Duration(r.Int64N(int64(interval))))
+			case 2:
+				now = now.Add(interval + time.Duration(r.Int64N(int64(interval))))
+			case 3:
+				now = now.Add(time.Duration(r.Int64N(int64(interval) * int64(capacity+1))))
+			}
+
+			want, got := tb.allow(now), g.allow(now)
+			if got.Allowed == want.Allowed {
+				continue
+			}
+			denied := got
+			if got.Allowed {
+				denied = want
+			}
+			if denied.RetryAfter <= 0 || denied.RetryAfter > boundary {
+				t.Fatalf("seed %d, capacity %d, rate %v, request %d at %s: gcra decision = %+v, token bucket decision = %+v",
+					seed, capacity, rate, i, now.Sub(start), got, want)
+			}
+			// the states differ by a token after the boundary, GCRA continues from the state of the bucket
+			g.tat = now.Add(time.Duration((float64(capacity) - tb.available) / rate * float64(time.Second)))
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"ivanjabrony/cloud-test/internal/ratelimit/config"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// separator joins parts of a composite identity
+const separator = "|"
+
+// Extractor identifies clients of requests, so their limits are counted separately
+//
+// An identity is built from one or several sources, several sources make a composite identity.
+// Forwarded headers and headers of header sources are honoured only if a request came from a trusted proxy,
+// otherwise any client could choose its own identity. IPv6 addresses are cut to a prefix, as a single client usually owns
+// a whole subnet. A missing header is replaced with the client's address
+type Extractor struct {
+	sources    []source
+	trusted    []netip.Prefix
+	ipv6Prefix int
+}
+
+// source returns a part of an identity of a request
+type source func(e *Extractor, r *http.Request) string
+
+func New(cfg config.IdentityConfig) (*Extractor, error) {
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ipv6 prefix length %d", cfg.IPv6Prefix)
+	}
+
+	e := &Extractor{trusted: cfg.TrustedProxies, ipv6Prefix: cfg.IPv6Prefix}
+	for _, s := range cfg.Sources {
+		name, header, _ := strings.Cut(s, ":")
+		switch name {
+		case config.IdentityRemoteIP:
+			e.sources = append(e.sources, (*Extractor).remoteIPSource)
+		case config.IdentityForwardedIP:
+			e.sources = append(e.sources, (*Extractor).forwardedIPSource)
+		case config.IdentityHeader:
+			if header == "" {
+				return nil, errors.New("header source needs a header name")
+			}
+			if len(cfg.TrustedProxies) == 0 {
+				return nil, errors.New("header source needs trusted proxies that set the header")
+			}
+			e.sources = append(e.sources, headerSource(http.CanonicalHeaderKey(header)))
+		default:
+			return nil, fmt.Errorf("unknown client identity source %q", s)
+		}
+	}
+	if len(e.sources) == 0 {
+		e.sources = append(e.sources, (*Extractor).remoteIPSource)
+	}
+
+	return e, nil
+}
+
+// ClientID returns an identity of a request's client
+func (e *Extractor) ClientID(r *http.Request) string {
+	if len(e.sources) == 1 {
+		return e.sources[0](e, r)
+	}
+
+	parts := make([]string, len(e.sources))
+	for i, s := range e.sources {
+		parts[i] = s(e, r)
+	}
+	return strings.Join(parts, separator)
+}
+
+// NormalizeID brings an identity given by a user to the form ClientID returns,
+// so IPv4-mapped addresses become IPv4 and IPv6 addresses are cut to the prefix
+func (e *Extractor) NormalizeID(id string) string {
+	addr, err := netip.ParseAddr(id)
+	if err != nil {
+		return id
+	}
+	return e.format(addr.Unmap())
+}
+
+func (e *Extractor) remoteIPSource(r *http.Request) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return e.format(addr)
+}
+
+func (e *Extractor) forwardedIPSource(r *http.Request) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return e.format(e.forwardedAddr(r, addr))
+}
+
+// headerSource returns a source of a header value set by a trusted proxy, a client of an untrusted peer is identified by address
+func headerSource(header string) source {
+	return func(e *Extractor, r *http.Request) string {
+		if addr, ok := remoteAddr(r); ok && e.isTrusted(addr) {
+			if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+				return v
+			}
+		}
+		return e.forwardedIPSource(r)
+	}
+}
+
+// forwardedAddr returns an address of the client behind trusted proxies
+//
+// Proxies append the address they got a request from, so the chain is walked from the right
+// and the first untrusted address is the client. Anything to the left of it could be forged by the client
+func (e *Extractor) forwardedAddr(r *http.Request, remote netip.Addr) netip.Addr {
+	if !e.isTrusted(remote) {
+		return remote
+	}
+
+	chain := forwardedChain(r.Header)
+	addr := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		next, err := parseForwardedAddr(chain[i])
+		if err != nil {
+			// unknown or obfuscated address, the last known one is as far as the chain can be trusted
+			return addr
+		}
+		addr = next
+		if !e.isTrusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+func (e *Extractor) isTrusted(addr netip.Addr) bool {
+	for _, p := range e.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// format returns a string form of an address, IPv6 addresses are cut to the prefix
+func (e *Extractor) format(addr netip.Addr) string {
+	if addr.Is4() || e.ipv6Prefix == 128 {
+		return addr.String()
+	}
+
+	prefix, err := addr.Prefix(e.ipv6Prefix)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// remoteAddr parses an address of the connection
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedChain returns addresses of clients and proxies a request has passed, Forwarded is preferred to X-Forwarded-For
+func forwardedChain(h http.Header) []string {
+	var chain []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, element := range strings.Split(v, ",") {
+				chain = append(chain, forwardedFor(element))
+			}
+		}
+		return chain
+	}
+
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// forwardedFor returns a value of the for parameter of a Forwarded element
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseForwardedAddr parses an address of a forwarded chain, it may have a port and brackets around IPv6
+func parseForwardedAddr(s string) (netip.Addr, error) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"ivanjabrony/cloud-test/internal/ratelimit/config"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func newTestExtractor(t *testing.T, sources []string, ipv6Prefix int) *Extractor {
+	t.Helper()
+
+	e, err := New(config.IdentityConfig{
+		Sources:        sources,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8:ffff::/48")},
+		IPv6Prefix:     ipv6Prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestClientID(t *testing.T) {
+	tests := []struct {
+		name       string
+		sources    []string
+		ipv6Prefix int
+		remote     string
+		headers    map[string][]string
+		want       string
+	}{
+		{"remote ipv4", []string{"remote_ip"}, 64, "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"remote ignores forwarded headers", []string{"remote_ip"}, 64, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "10.0.0.1"},
+		{"remote ipv4-mapped", []string{"remote_ip"}, 64, "[::ffff:203.0.113.5]:1234", nil, "203.0.113.5"},
+		{"remote ipv6 truncated to /64", []string{"remote_ip"}, 64, "[2001:db8:1:2:3:4:5:6]:1234", nil, "2001:db8:1:2::/64"},
+		{"remote ipv6 truncated to /48", []string{"remote_ip"}, 48, "[2001:db8:1:2:3:4:5:6]:1234", nil, "2001:db8:1::/48"},
+		{"remote ipv6 full address", []string{"remote_ip"}, 128, "[2001:db8:1:2:3:4:5:6]:1234", nil, "2001:db8:1:2:3:4:5:6"},
+		{"remote without port", []string{"remote_ip"}, 64, "203.0.113.5", nil, "203.0.113.5"},
+		{"remote unparsable", []string{"remote_ip"}, 64, "pipe", nil, "pipe"},
+
+		{"xff spoofed by untrusted peer", []string{"forwarded_ip"}, 64, "203.0.113.5:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.5"},
+		{"forwarded spoofed by untrusted peer", []string{"forwarded_ip"}, 64, "203.0.113.5:1234",
+			map[string][]string{"Forwarded": {"for=1.2.3.4"}}, "203.0.113.5"},
+		{"xff from trusted proxy", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"xff forged left of the client", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4, 10.0.0.2"}}, "1.2.3.4"},
+		{"xff in several headers", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6", "1.2.3.4"}}, "1.2.3.4"},
+		{"every hop trusted", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"trusted proxy without headers", []string{"forwarded_ip"}, 64, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"forwarded preferred to xff", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=1.2.3.4;proto=https"}, "X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4"},
+		{"forwarded parameters in any case and order", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"proto=https; FOR=1.2.3.4, for=10.0.0.2"}}, "1.2.3.4"},
+		{"forwarded ipv4 with port", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="1.2.3.4:4711"`}}, "1.2.3.4"},
+		{"forwarded bracketed ipv6 with port", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="[2001:db8:1:2::5]:4711"`}}, "2001:db8:1:2::/64"},
+		{"forwarded bracketed ipv6", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="[2001:db8:1:2::5]"`}}, "2001:db8:1:2::/64"},
+		{"forwarded ipv4-mapped", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="[::ffff:1.2.3.4]"`}}, "1.2.3.4"},
+		{"ipv6 trusted proxy", []string{"forwarded_ip"}, 64, "[2001:db8:ffff::1]:1234",
+			map[string][]string{"X-Forwarded-For": {"2001:db8:1:2::5"}}, "2001:db8:1:2::/64"},
+
+		{"forwarded obfuscated", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+		{"forwarded unknown", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=unknown"}}, "10.0.0.1"},
+		{"forwarded without for", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"proto=https;host=example.com"}}, "10.0.0.1"},
+		{"forwarded empty", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for="}}, "10.0.0.1"},
+		{"forwarded garbage behind a trusted hop", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=1.2.3.4, for=garbage, for=10.0.0.2"}}, "10.0.0.2"},
+		{"xff garbage", []string{"forwarded_ip"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, not-an-ip"}}, "10.0.0.1"},
+
+		{"composite", []string{"forwarded_ip", "header:X-Client-ID"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Client-Id": {" batch "}}, "1.2.3.4|batch"},
+		{"header missing", []string{"header:X-Client-ID"}, 64, "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"header from untrusted peer", []string{"header:X-Client-ID"}, 64, "203.0.113.5:1234",
+			map[string][]string{"X-Client-Id": {"victim"}}, "203.0.113.5"},
+		{"composite from untrusted peer", []string{"forwarded_ip", "header:X-Client-ID"}, 64, "203.0.113.5:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Client-Id": {"victim"}}, "203.0.113.5|203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExtractor(t, tt.sources, tt.ipv6Prefix)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for name, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(name, v)
+				}
+			}
+
+			if got := e.ClientID(r); got != tt.want {
+				t.Fatalf("client id = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"203.0.113.5", "203.0.113.5"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"::ffff:203.0.113.5", "203.0.113.5"},
+		{"2001:db8:1:2::/64", "2001:db8:1:2::/64"},
+		{"client-a", "client-a"},
+		{"", ""},
+	}
+
+	e := newTestExtractor(t, nil, 64)
+	for _, tt := range tests {
+		if got := e.NormalizeID(tt.id); got != tt.want {
+			t.Errorf("normalized %q = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, sources := range [][]string{{"header"}, {"header:"}, {"cookie:session"}, {"remote_ip", "mac"}} {
+		if _, err := New(config.IdentityConfig{Sources: sources, IPv6Prefix: 64}); err == nil {
+			t.Errorf("sources %q: error = nil, want an error", sources)
+		}
+	}
+	// without trusted proxies any client could set the header
+	if _, err := New(config.IdentityConfig{Sources: []string{"header:X-Client-ID"}, IPv6Prefix: 64}); err == nil {
+		t.Error("header source without trusted proxies: error = nil, want an error")
+	}
+	for _, prefix := range []int{-1, 129} {
+		if _, err := New(config.IdentityConfig{IPv6Prefix: prefix}); err == nil {
+			t.Errorf("ipv6 prefix %d: error = nil, want an error", prefix)
+		}
+	}
+}
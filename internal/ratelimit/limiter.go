@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rate limiting algorithms
+const (
+	AlgorithmTokenBucket          = "token_bucket"           // allows bursts up to capacity, refills with rate
+	AlgorithmSlidingWindowLog     = "sliding_window_log"     // exactly capacity requests per rolling window, no burst
+	AlgorithmSlidingWindowCounter = "sliding_window_counter" // approximation of sliding window log with two counters
+	AlgorithmGCRA                 = "gcra"                   // token bucket that keeps only theoretical arrival time
+)
+
+// Limiter is a limit of a single client
+//
+// Every algorithm is configured with capacity and rate. Sliding windows allow capacity requests
+// per window of capacity/rate, so capacity 60 with rate 1 means 60 requests per rolling minute
+type Limiter interface {
+	// Allow checks if a request is allowed and counts it if it is
+	Allow() Decision
+	// UpdateConfig changes capacity and rate keeping counted requests
+	UpdateConfig(capacity int, ratePerSec float64)
+	// LastUsed returns time of the last check or update
+	LastUsed() time.Time
+	// IsIdle checks if a limiter was not used for ttl and is no different from a new one
+	IsIdle(now time.Time, ttl time.Duration) bool
+	// Algorithm returns the name of the algorithm
+	Algorithm() string
+}
+
+// Reserver is a limiter that can queue requests instead of rejecting them
+type Reserver interface {
+	// Reserve counts a request that is allowed after the returned delay,
+	// it is rejected if maxQueue requests already wait or delay would exceed maxDelay
+	Reserve(maxQueue int, maxDelay time.Duration) (Decision, time.Duration)
+	// CancelReservation gives back a request that stopped waiting before its delay passed
+	// or was allowed and then rejected by another limit
+	CancelReservation()
+}
+
+// IsAlgorithm checks if algorithm is known, empty algorithm means default one
+func IsAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "", AlgorithmTokenBucket, AlgorithmSlidingWindowLog, AlgorithmSlidingWindowCounter, AlgorithmGCRA:
+		return true
+	}
+	return false
+}
+
+// NewLimiter creates a limiter of an algorithm
+func NewLimiter(algorithm string, capacity int, ratePerSec float64) (Limiter, error) {
+	switch algorithm {
+	case AlgorithmTokenBucket:
+		return NewTokenBucket(capacity, ratePerSec), nil
+	case AlgorithmSlidingWindowLog:
+		return NewSlidingWindowLog(capacity, ratePerSec), nil
+	case AlgorithmSlidingWindowCounter:
+		return NewSlidingWindowCounter(capacity, ratePerSec), nil
+	case AlgorithmGCRA:
+		return NewGCRA(capacity, ratePerSec), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", algorithm)
+	}
+}
+
+// foreverWindow is a window of a limit that is never restored
+const foreverWindow = 100 * 365 * 24 * time.Hour
+
+// windowDuration returns a window in which capacity requests are allowed with a rate.
+// The window is at least a nanosecond, so it can divide time, and at most foreverWindow
+func windowDuration(capacity int, ratePerSec float64) time.Duration {
+	if ratePerSec <= 0 {
+		// zero rate never restores the limit, window must still leave room for arithmetic
+		return foreverWindow
+	}
+
+	window := float64(capacity) / ratePerSec * float64(time.Second)
+	if window >= float64(foreverWindow) {
+		return foreverWindow
+	}
+	return max(time.Duration(window), time.Nanosecond)
+}
+
+// until returns time from now till t, zero if t has passed
+func until(now, t time.Time) time.Duration {
+	return max(t.Sub(now), 0)
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWindowDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		rate     float64
+		want     time.Duration
+	}{
+		{name: "regular", capacity: 10, rate: 5, want: 2 * time.Second},
+		{name: "rounded to zero", capacity: 1, rate: 1e10, want: time.Nanosecond},
+		{name: "zero capacity", capacity: 0, rate: 1, want: time.Nanosecond},
+		{name: "infinite rate", capacity: 10, rate: math.Inf(1), want: time.Nanosecond},
+		{name: "zero rate", capacity: 10, rate: 0, want: foreverWindow},
+		{name: "longer than forever", capacity: math.MaxInt32, rate: 1e-9, want: foreverWindow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := windowDuration(tt.capacity, tt.rate); got != tt.want {
+				t.Fatalf("windowDuration(%d, %v) = %s, want %s", tt.capacity, tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSlidingWindowsWithTinyWindow checks that sliding windows work with a window that would round to zero
+func TestSlidingWindowsWithTinyWindow(t *testing.T) {
+	limiters := map[string]Limiter{
+		"counter": NewSlidingWindowCounter(1, 1e10),
+		"log":     NewSlidingWindowLog(1, 1e10),
+	}
+	updated := map[string]Limiter{
+		"counter": NewSlidingWindowCounter(10, 10),
+		"log":     NewSlidingWindowLog(10, 10),
+	}
+	for name, l := range updated {
+		l.UpdateConfig(1, 1e10)
+		limiters[name+" updated"] = l
+	}
+
+	for name, l := range limiters {
+		t.Run(name, func(t *testing.T) {
+			for range 3 {
+				// the window is over long before the next request
+				time.Sleep(time.Microsecond)
+				if d := l.Allow(); !d.Allowed {
+					t.Fatalf("request is denied with a window of a nanosecond: %+v", d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"ivanjabrony/cloud-test/internal/ratelimit/config"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultTopClients is used when client labels are enabled but amount of labelled clients is not configured
+const defaultTopClients = 100
+
+// Metrics collects Prometheus metrics of the rate limiter
+//
+// Decisions are counted without client label by default. If client labels are enabled,
+// only the most active clients are labelled, so cardinality of metrics stays bounded
+type Metrics struct {
+	registry       *prometheus.Registry
+	decisions      *prometheus.CounterVec
+	clients        *topClients // nil if client labels are disabled
+	configRequests *prometheus.CounterVec
+	repository     *prometheus.HistogramVec
+	proxyLatency   *prometheus.HistogramVec
+	shapingDelay   prometheus.Histogram
+	inFlightDenied prometheus.Counter
+	adaptiveShed   prometheus.Counter
+}
+
+func New(cfg config.MetricsConfig) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_requests_total",
+			Help: "Requests checked by the rate limiter by decision: allowed or denied.",
+		}, []string{"decision"}),
+		configRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_config_requests_total",
+			Help: "Calls of the configuration API by status class of a response.",
+		}, []string{"code"}),
+		repository: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimiter_repository_duration_seconds",
+			Help:    "Duration of configuration repository operations by operation and result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "result"}),
+		proxyLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimiter_proxy_latency_seconds",
+			Help:    "Time between the start of proxying and receiving of response headers from the target by status class, code is \"error\" if no response was received.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+		shapingDelay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ratelimiter_shaping_delay_seconds",
+			Help:    "Time requests waited in queues of clients in shaping mode.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inFlightDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimiter_in_flight_denied_total",
+			Help: "Requests rejected because their clients had too many requests in flight.",
+		}),
+		adaptiveShed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimiter_adaptive_shed_total",
+			Help: "Requests shed with 503 because the adaptive limit of requests in flight to the target was exceeded.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.decisions, m.configRequests, m.repository, m.proxyLatency, m.shapingDelay, m.inFlightDenied, m.adaptiveShed,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if cfg.ClientLabels {
+		top := cfg.TopClients
+		if top <= 0 {
+			top = defaultTopClients
+		}
+		m.clients = newTopClients(top)
+		m.registry.MustRegister(m.clients)
+	}
+
+	return m
+}
+
+// Register adds collectors to the registry of metrics
+func (m *Metrics) Register(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// RegisterBuckets reports amount of live buckets returned by count on every scrape
+func (m *Metrics) RegisterBuckets(count func() int) {
+	m.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ratelimiter_buckets",
+		Help: "Buckets of clients that are stored by the rate limiter.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// RegisterEvictions reports amount of evicted buckets returned by evictions on every scrape
+func (m *Metrics) RegisterEvictions(evictions func() (idle, capacity uint64)) {
+	m.Register(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ratelimiter_bucket_evictions_total",
+			Help:        "Buckets evicted from storage by reason: idle buckets or the least recently used ones above the limit.",
+			ConstLabels: prometheus.Labels{"reason": "idle"},
+		}, func() float64 { idle, _ := evictions(); return float64(idle) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ratelimiter_bucket_evictions_total",
+			Help:        "Buckets evicted from storage by reason: idle buckets or the least recently used ones above the limit.",
+			ConstLabels: prometheus.Labels{"reason": "capacity"},
+		}, func() float64 { _, capacity := evictions(); return float64(capacity) }),
+	)
+}
+
+// RegisterInFlight reports amount of requests in flight returned by count on every scrape
+func (m *Metrics) RegisterInFlight(count func() int) {
+	m.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ratelimiter_in_flight_requests",
+		Help: "Requests of clients with a limit of requests in flight that are proxied to the target right now.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// RegisterAdaptive reports the adaptive limit of requests in flight to the target and amount of them on every scrape
+func (m *Metrics) RegisterAdaptive(limit, inFlight func() int) {
+	m.Register(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ratelimiter_adaptive_limit",
+			Help: "Current adaptive limit of requests in flight to the target.",
+		}, func() float64 { return float64(limit()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ratelimiter_adaptive_in_flight",
+			Help: "Requests in flight to the target counted by the adaptive limit.",
+		}, func() float64 { return float64(inFlight()) }),
+	)
+}
+
+// Handler returns a handler that serves metrics in Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveDecision counts a request of a client that was allowed or denied
+func (m *Metrics) ObserveDecision(client string, allowed bool) {
+	decision := "allowed"
+	if !allowed {
+		decision = "denied"
+	}
+
+	m.decisions.WithLabelValues(decision).Inc()
+	if m.clients != nil {
+		m.clients.observe(client, allowed)
+	}
+}
+
+// ObserveConfigRequest counts a call of the configuration API
+func (m *Metrics) ObserveConfigRequest(status int) {
+	m.configRequests.WithLabelValues(statusClass(status)).Inc()
+}
+
+// ObserveRepository records duration of a repository operation
+func (m *Metrics) ObserveRepository(operation string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.repository.WithLabelValues(operation, result).Observe(duration.Seconds())
+}
+
+// ObserveProxy records latency of a request proxied to the target, status 0 means that no response was received
+func (m *Metrics) ObserveProxy(status int, duration time.Duration) {
+	code := "error"
+	if status != 0 {
+		code = statusClass(status)
+	}
+	m.proxyLatency.WithLabelValues(code).Observe(duration.Seconds())
+}
+
+// ObserveShaping records time a request waited in a client's queue
+func (m *Metrics) ObserveShaping(delay time.Duration) {
+	m.shapingDelay.Observe(delay.Seconds())
+}
+
+// ObserveInFlightDenied counts a request rejected because its client had too many requests in flight
+func (m *Metrics) ObserveInFlightDenied() {
+	m.inFlightDenied.Inc()
+}
+
+// ObserveAdaptiveShed counts a request shed because the adaptive limit was exceeded
+func (m *Metrics) ObserveAdaptiveShed() {
+	m.adaptiveShed.Inc()
+}
+
+// statusClass returns a class of a status like 2xx
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
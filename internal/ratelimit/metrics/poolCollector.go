@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolAcquiredConnsDesc = prometheus.NewDesc("ratelimiter_db_pool_acquired_conns",
+		"Connections of the database pool that are currently in use.", nil, nil)
+	poolIdleConnsDesc = prometheus.NewDesc("ratelimiter_db_pool_idle_conns",
+		"Idle connections of the database pool.", nil, nil)
+	poolTotalConnsDesc = prometheus.NewDesc("ratelimiter_db_pool_total_conns",
+		"All connections of the database pool, including the ones being constructed.", nil, nil)
+	poolMaxConnsDesc = prometheus.NewDesc("ratelimiter_db_pool_max_conns",
+		"Maximum size of the database pool.", nil, nil)
+	poolAcquiresDesc = prometheus.NewDesc("ratelimiter_db_pool_acquires_total",
+		"Successful acquires of connections from the database pool.", nil, nil)
+	poolEmptyAcquiresDesc = prometheus.NewDesc("ratelimiter_db_pool_empty_acquires_total",
+		"Acquires that had to wait for a connection because the database pool was empty.", nil, nil)
+	poolCanceledAcquiresDesc = prometheus.NewDesc("ratelimiter_db_pool_canceled_acquires_total",
+		"Acquires that were canceled by a context.", nil, nil)
+	poolAcquireDurationDesc = prometheus.NewDesc("ratelimiter_db_pool_acquire_duration_seconds_total",
+		"Total time spent on successful acquires of connections.", nil, nil)
+)
+
+// PoolCollector reports statistics of a pgx connection pool
+type PoolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func NewPoolCollector(pool *pgxpool.Pool) *PoolCollector {
+	return &PoolCollector{pool}
+}
+
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredConnsDesc
+	ch <- poolIdleConnsDesc
+	ch <- poolTotalConnsDesc
+	ch <- poolMaxConnsDesc
+	ch <- poolAcquiresDesc
+	ch <- poolEmptyAcquiresDesc
+	ch <- poolCanceledAcquiresDesc
+	ch <- poolAcquireDurationDesc
+}
+
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConnsDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConnsDesc, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConnsDesc, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConnsDesc, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquiresDesc, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquiresDesc, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDurationDesc, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
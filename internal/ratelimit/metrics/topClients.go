@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var clientRequestsDesc = prometheus.NewDesc("ratelimiter_client_requests_total",
+	"Requests of the most active clients by decision. Counts are approximate: a client that replaces "+
+		"a less active one inherits its count, so the value is an upper bound.",
+	[]string{"client", "decision"}, nil)
+
+type clientCounts struct {
+	client  string
+	allowed float64
+	denied  float64
+	index   int // position in the heap
+}
+
+func (c *clientCounts) total() float64 {
+	return c.allowed + c.denied
+}
+
+// countsHeap is a min-heap of clients by their total count
+type countsHeap []*clientCounts
+
+func (h countsHeap) Len() int           { return len(h) }
+func (h countsHeap) Less(i, j int) bool { return h[i].total() < h[j].total() }
+
+func (h countsHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *countsHeap) Push(x any) {
+	c := x.(*clientCounts)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *countsHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topClients keeps request counts of at most size clients using the Space-Saving algorithm
+//
+// When it is full, a new client replaces the client with the lowest count and inherits that count.
+// Active clients push out the rare ones, so the tracked set converges to the most active clients.
+// Clients are kept in a min-heap by count, so a request costs O(log size) regardless of the size
+type topClients struct {
+	size    int
+	clients map[string]*clientCounts
+	byCount countsHeap
+	mu      sync.Mutex
+}
+
+func newTopClients(size int) *topClients {
+	return &topClients{
+		size:    size,
+		clients: make(map[string]*clientCounts, size),
+		byCount: make(countsHeap, 0, size),
+	}
+}
+
+func (t *topClients) observe(client string, allowed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.clients[client]
+	if !ok {
+		if c, ok = t.replaceMin(client); !ok {
+			c = &clientCounts{client: client}
+			heap.Push(&t.byCount, c)
+		}
+		t.clients[client] = c
+	}
+
+	if allowed {
+		c.allowed++
+	} else {
+		c.denied++
+	}
+	heap.Fix(&t.byCount, c.index)
+}
+
+// replaceMin gives counts of the client with the lowest count to a new client if there is no free place for it
+func (t *topClients) replaceMin(client string) (*clientCounts, bool) {
+	if len(t.byCount) < t.size {
+		return nil, false
+	}
+
+	c := t.byCount[0]
+	delete(t.clients, c.client)
+	c.client = client
+	return c, true
+}
+
+func (t *topClients) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientRequestsDesc
+}
+
+func (t *topClients) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for client, c := range t.clients {
+		ch <- prometheus.MustNewConstMetric(clientRequestsDesc, prometheus.CounterValue, c.allowed, client, "allowed")
+		ch <- prometheus.MustNewConstMetric(clientRequestsDesc, prometheus.CounterValue, c.denied, client, "denied")
+	}
+}
@@ -0,0 +1 @@
+ALTER TABLE user_configs DROP COLUMN IF EXISTS algorithm;
\ No newline at end of file
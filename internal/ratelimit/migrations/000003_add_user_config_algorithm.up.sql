@@ -0,0 +1 @@
+ALTER TABLE user_configs ADD COLUMN IF NOT EXISTS algorithm text NOT NULL DEFAULT '';
\ No newline at end of file
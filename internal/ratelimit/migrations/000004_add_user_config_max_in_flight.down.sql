@@ -0,0 +1 @@
+ALTER TABLE user_configs DROP COLUMN IF EXISTS max_in_flight;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE user_configs ADD COLUMN IF NOT EXISTS max_in_flight int NOT NULL DEFAULT 0;
\ No newline at end of file
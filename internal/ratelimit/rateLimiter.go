@@ -3,14 +3,18 @@ package ratelimit
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 )
 
 // BucketStorage is an interface for storing buckets
 //
-// This implementation is based on map with mutex
+// This implementation is based on map with mutex.
+// Buckets of clients with persisted configs are stored pinned, so storage never evicts them
 type BucketStorage interface {
-	Store(ctx context.Context, key string, bucket *TokenBucket)
-	Load(ctx context.Context, key string) (bucket *TokenBucket, ok bool)
+	LoadOrStore(ctx context.Context, key string, bucket Limiter) (actual Limiter, loaded bool)
+	StorePinned(ctx context.Context, key string, bucket Limiter)
+	Load(ctx context.Context, key string) (bucket Limiter, ok bool)
 }
 
 // RateLimiter is a main structure that rate-limits requests based on result of Allow() method
@@ -18,28 +22,46 @@ type RateLimiter struct {
 	bucketStorage BucketStorage
 	defaultCap    int     //Default capacity for a new client
 	defaultRps    float64 //Default rps for a new client
+	defaultAlg    string  //Default algorithm for a new client
 }
 
-func NewRateLimiter(bucketStorage BucketStorage, defaultCap int, defaultRps float64) (*RateLimiter, error) {
+func NewRateLimiter(bucketStorage BucketStorage, defaultCap int, defaultRps float64, defaultAlg string) (*RateLimiter, error) {
 	if bucketStorage == nil {
 		return nil, errors.New("nil values in ratelimiter constructor")
 	}
+	if defaultAlg == "" {
+		defaultAlg = AlgorithmTokenBucket
+	}
+	if !IsAlgorithm(defaultAlg) {
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", defaultAlg)
+	}
 
-	return &RateLimiter{bucketStorage, defaultCap, defaultRps}, nil
+	return &RateLimiter{bucketStorage, defaultCap, defaultRps, defaultAlg}, nil
+}
+
+// newLimiter creates a limiter of an algorithm, empty algorithm means default one
+func (rl *RateLimiter) newLimiter(algorithm string, capacity int, ratePerSec float64) (Limiter, error) {
+	if algorithm == "" {
+		algorithm = rl.defaultAlg
+	}
+	return NewLimiter(algorithm, capacity, ratePerSec)
 }
 
-// addBucket adds new bucket to the storage and configures it
-func (rl *RateLimiter) addBucket(ctx context.Context, ip string) *TokenBucket {
-	bucket := NewTokenBucket(rl.defaultCap, rl.defaultRps)
-	rl.bucketStorage.Store(ctx, ip, bucket)
+// addBucket adds new bucket with default config to the storage. If a bucket was stored for the client
+// concurrently, for example by Configure, that bucket is returned
+func (rl *RateLimiter) addBucket(ctx context.Context, ip string) Limiter {
+	// default algorithm is checked in constructor
+	bucket, _ := rl.newLimiter("", rl.defaultCap, rl.defaultRps)
+	actual, _ := rl.bucketStorage.LoadOrStore(ctx, ip, bucket)
 
-	return bucket
+	return actual
 }
 
 // Allow is a method that chooses if request is allowed based on client storage state
 //
-//	If there are not enought tokens, TooManyRequests response will be sended
-func (rl *RateLimiter) Allow(ctx context.Context, ip string) bool {
+//	If there are not enought tokens, TooManyRequests response will be sended.
+//	Returned decision also describes the client's limit, so it can be reported to the client
+func (rl *RateLimiter) Allow(ctx context.Context, ip string) Decision {
 	bucket, ok := rl.bucketStorage.Load(ctx, ip)
 	if !ok {
 		bucket = rl.addBucket(ctx, ip)
@@ -48,8 +70,77 @@ func (rl *RateLimiter) Allow(ctx context.Context, ip string) bool {
 	return bucket.Allow()
 }
 
+// Wait is Allow that delays a request instead of rejecting it while the client's queue has room
+//
+// The request waits until its token is refilled, so a client is slowed down to its rate.
+// It is rejected only if maxQueue requests of the client already wait or it would wait longer than maxDelay.
+// Limiters that can't queue requests reject them as Allow does.
+// If ctx is done before the request's turn, its token is given back and ctx error is returned
+func (rl *RateLimiter) Wait(ctx context.Context, ip string, maxQueue int, maxDelay time.Duration) (Decision, error) {
+	bucket, ok := rl.bucketStorage.Load(ctx, ip)
+	if !ok {
+		bucket = rl.addBucket(ctx, ip)
+	}
+
+	reserver, ok := bucket.(Reserver)
+	if !ok {
+		return bucket.Allow(), nil
+	}
+
+	decision, delay := reserver.Reserve(maxQueue, maxDelay)
+	if !decision.Allowed || delay <= 0 {
+		return decision, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return decision, nil
+	case <-ctx.Done():
+		reserver.CancelReservation()
+		return decision, ctx.Err()
+	}
+}
+
+// CancelReservation gives back a token taken by Allow or Wait for a request that was rejected afterwards,
+// so a client doesn't pay for requests that never reached the target. Limiters that can't queue requests keep it
+func (rl *RateLimiter) CancelReservation(ctx context.Context, ip string) {
+	bucket, ok := rl.bucketStorage.Load(ctx, ip)
+	if !ok {
+		return
+	}
+	if reserver, ok := bucket.(Reserver); ok {
+		reserver.CancelReservation()
+	}
+}
+
 // IsExists checks if there is a bucket for a client
 func (rl *RateLimiter) IsExists(ctx context.Context, ip string) bool {
 	_, ok := rl.bucketStorage.Load(ctx, ip)
 	return ok
 }
+
+// Configure sets a client's own capacity, rate and algorithm, the client's bucket is stored pinned.
+// Counted requests are kept unless the algorithm changes
+func (rl *RateLimiter) Configure(ctx context.Context, ip string, capacity int, ratePerSec float64, algorithm string) error {
+	if algorithm == "" {
+		algorithm = rl.defaultAlg
+	}
+
+	bucket, ok := rl.bucketStorage.Load(ctx, ip)
+	if !ok || bucket.Algorithm() != algorithm {
+		newBucket, err := rl.newLimiter(algorithm, capacity, ratePerSec)
+		if err != nil {
+			return err
+		}
+		rl.bucketStorage.StorePinned(ctx, ip, newBucket)
+		return nil
+	}
+
+	bucket.UpdateConfig(capacity, ratePerSec)
+	// bucket may have been created for the client with default config, it must not be evicted anymore
+	rl.bucketStorage.StorePinned(ctx, ip, bucket)
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorage is a bucket storage without eviction
+type testStorage struct {
+	buckets map[string]Limiter
+	mu      sync.Mutex
+}
+
+func newTestStorage() *testStorage {
+	return &testStorage{buckets: make(map[string]Limiter)}
+}
+
+func (s *testStorage) LoadOrStore(_ context.Context, key string, bucket Limiter) (Limiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if actual, ok := s.buckets[key]; ok {
+		return actual, true
+	}
+	s.buckets[key] = bucket
+	return bucket, false
+}
+
+func (s *testStorage) StorePinned(_ context.Context, key string, bucket Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[key] = bucket
+}
+
+func (s *testStorage) Load(_ context.Context, key string) (Limiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	return bucket, ok
+}
+
+// testReserver is a limiter that reserves requests at a given time
+type testReserver interface {
+	reserve(now time.Time, maxQueue int, maxDelay time.Duration) (Decision, time.Duration)
+}
+
+var reservers = []struct {
+	name       string
+	newLimiter func(capacity int, ratePerSec float64, start time.Time) testReserver
+}{
+	{AlgorithmTokenBucket, func(capacity int, ratePerSec float64, start time.Time) testReserver {
+		return &TokenBucket{capacity: capacity, ratePerSec: ratePerSec, available: float64(capacity), lastRefill: start}
+	}},
+	{AlgorithmGCRA, func(capacity int, ratePerSec float64, start time.Time) testReserver {
+		return &GCRA{capacity: capacity, ratePerSec: ratePerSec, tat: start, lastUsed: start}
+	}},
+}
+
+// TestReserve checks that requests over the limit are queued with growing delays until
+// max_queue requests wait or a delay would exceed max_delay
+func TestReserve(t *testing.T) {
+	type step struct {
+		advance     time.Duration
+		wantAllowed bool
+		wantDelay   time.Duration
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		maxQueue int
+		maxDelay time.Duration
+		steps    []step
+	}{
+		{"max queue", 2, 2, 10 * time.Second, []step{
+			{0, true, 0},
+			{0, true, 0},
+			{0, true, time.Second},
+			{0, true, 2 * time.Second},
+			{0, false, 0}, // two requests already wait
+			{time.Second, true, 2 * time.Second},
+			{0, false, 0},
+		}},
+		{"max delay", 1, 10, 1500 * time.Millisecond, []step{
+			{0, true, 0},
+			{0, true, time.Second},
+			{0, false, 0}, // would wait for 2s
+			{500 * time.Millisecond, true, 1500 * time.Millisecond},
+			{0, false, 0},
+		}},
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, r := range reservers {
+		for _, tt := range tests {
+			t.Run(r.name+"/"+tt.name, func(t *testing.T) {
+				limiter := r.newLimiter(tt.capacity, 1, start)
+				now := start
+				for i, s := range tt.steps {
+					now = now.Add(s.advance)
+					d, delay := limiter.reserve(now, tt.maxQueue, tt.maxDelay)
+					if d.Allowed != s.wantAllowed || delay != s.wantDelay {
+						t.Fatalf("request %d: allowed %v with delay %s, want allowed %v with delay %s", i, d.Allowed, delay, s.wantAllowed, s.wantDelay)
+					}
+					if !d.Allowed && d.RetryAfter <= 0 {
+						t.Fatalf("request %d: rejected with retry after %s", i, d.RetryAfter)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestWaitRejects checks that Wait rejects a request without waiting if the client's queue is full
+// or the request would wait longer than max_delay
+func TestWaitRejects(t *testing.T) {
+	for _, r := range reservers {
+		t.Run(r.name, func(t *testing.T) {
+			bucket, _ := NewLimiter(r.name, 1, 1)
+			s := newTestStorage()
+			s.StorePinned(context.Background(), "client", bucket)
+			rl, err := NewRateLimiter(s, 1, 1, r.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the token is taken and a request waits for the next one
+			bucket.(Reserver).Reserve(1, time.Hour)
+			bucket.(Reserver).Reserve(1, time.Hour)
+
+			for _, tt := range []struct {
+				name     string
+				maxQueue int
+				maxDelay time.Duration
+			}{
+				{"max queue", 1, time.Hour},
+				{"max delay", 10, time.Second},
+			} {
+				d, err := rl.Wait(context.Background(), "client", tt.maxQueue, tt.maxDelay)
+				if err != nil || d.Allowed {
+					t.Fatalf("%s: decision %+v, error %v, want rejected without error", tt.name, d, err)
+				}
+			}
+		})
+	}
+}
+
+// TestWaitCancel checks that a request that stops waiting gives its token back
+func TestWaitCancel(t *testing.T) {
+	for _, r := range reservers {
+		t.Run(r.name, func(t *testing.T) {
+			rl, err := NewRateLimiter(newTestStorage(), 1, 1, r.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d, err := rl.Wait(context.Background(), "client", 10, time.Hour); err != nil || !d.Allowed {
+				t.Fatalf("first request: decision %+v, error %v, want allowed", d, err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := rl.Wait(ctx, "client", 10, time.Hour); !errors.Is(err, context.Canceled) {
+				t.Fatalf("canceled request: error = %v, want %v", err, context.Canceled)
+			}
+
+			// the canceled request's token is back, so the next request waits a single interval, not two
+			bucket, _ := rl.bucketStorage.Load(context.Background(), "client")
+			d, delay := bucket.(Reserver).Reserve(10, time.Hour)
+			if !d.Allowed || delay > time.Second {
+				t.Fatalf("next request: allowed %v with delay %s, want allowed with delay up to 1s", d.Allowed, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package redislimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript checks and takes a token of a client in one round trip
+//
+// KEYS[1] is a hash with bucket state: tokens and time of the last refill in seconds.
+// KEYS[2] is a hash with the client's own capacity and rate, defaults from ARGV are used if it doesn't exist.
+// Time is taken from Redis, so replicas with skewed clocks see the same buckets.
+// State expires when the bucket would be full again, a missing state means a full bucket.
+// Fractional numbers are returned as strings, as Redis truncates Lua numbers to integers
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local cfg = redis.call('HMGET', KEYS[2], 'capacity', 'rate_per_sec')
+if cfg[1] then capacity = tonumber(cfg[1]) end
+if cfg[2] then rate = tonumber(cfg[2]) end
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = tokens + (now - ts) * rate
+	ts = now
+end
+tokens = math.min(tokens, capacity)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+if rate > 0 and tokens < capacity then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+	redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil((capacity - tokens) / rate * 1000)))
+elseif rate > 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+end
+
+return {allowed, tostring(tokens), capacity, tostring(rate)}
+`)
+
+// RateLimiter is a token bucket rate limiter that keeps buckets and clients' configs in Redis,
+// so all replicas of the rate limiter share the same limits
+//
+// If Redis is unavailable requests are allowed, the rate limiter must not take the target down with it
+type RateLimiter struct {
+	client     redis.UniversalClient
+	prefix     string
+	defaultCap int
+	defaultRps float64
+	logger     *logger.MyLogger
+}
+
+func NewRateLimiter(client redis.UniversalClient, prefix string, defaultCap int, defaultRps float64, logger *logger.MyLogger) (*RateLimiter, error) {
+	if client == nil || logger == nil {
+		return nil, errors.New("nil values in redis ratelimiter constructor")
+	}
+
+	return &RateLimiter{client, prefix, defaultCap, defaultRps, logger}, nil
+}
+
+// stateKey and configKey share a hash tag, so both keys of a client are in one slot of Redis Cluster
+func (rl *RateLimiter) stateKey(ip string) string {
+	return fmt.Sprintf("%s{%s}:bucket", rl.prefix, ip)
+}
+
+func (rl *RateLimiter) configKey(ip string) string {
+	return fmt.Sprintf("%s{%s}:config", rl.prefix, ip)
+}
+
+// Allow takes a token from a client's bucket if there is one
+func (rl *RateLimiter) Allow(ctx context.Context, ip string) ratelimit.Decision {
+	decision, err := rl.allow(ctx, ip)
+	if err != nil {
+		rl.logger.Error("Couldn't check rate limit in redis, request is allowed", slog.String("client", ip), slog.Any("error", err))
+		return ratelimit.Decision{Allowed: true, Limit: rl.defaultCap, Remaining: rl.defaultCap}
+	}
+
+	return decision
+}
+
+func (rl *RateLimiter) allow(ctx context.Context, ip string) (ratelimit.Decision, error) {
+	keys := []string{rl.stateKey(ip), rl.configKey(ip)}
+	res, err := tokenBucketScript.Run(ctx, rl.client, keys, rl.defaultCap, rl.defaultRps).Slice()
+	if err != nil {
+		return ratelimit.Decision{}, err
+	}
+	if len(res) != 4 {
+		return ratelimit.Decision{}, fmt.Errorf("unexpected script result: %v", res)
+	}
+
+	allowed, _ := res[0].(int64)
+	capacity, _ := res[2].(int64)
+	tokens, err := parseFloat(res[1])
+	if err != nil {
+		return ratelimit.Decision{}, err
+	}
+	rate, err := parseFloat(res[3])
+	if err != nil {
+		return ratelimit.Decision{}, err
+	}
+
+	return ratelimit.NewDecision(allowed == 1, int(capacity), tokens, rate), nil
+}
+
+// Wait doesn't delay requests, shaping is not supported by Redis storage and requests are checked as in Allow
+func (rl *RateLimiter) Wait(ctx context.Context, ip string, maxQueue int, maxDelay time.Duration) (ratelimit.Decision, error) {
+	return rl.Allow(ctx, ip), nil
+}
+
+// CancelReservation does nothing, a token taken in Redis is not given back
+func (rl *RateLimiter) CancelReservation(ctx context.Context, ip string) {}
+
+func parseFloat(v any) (float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected script result type %T", v)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Configure saves a client's own capacity and rate, they are applied from the next check of the client's bucket.
+// Only token bucket is kept in Redis, other algorithms are rejected
+func (rl *RateLimiter) Configure(ctx context.Context, ip string, capacity int, ratePerSec float64, algorithm string) error {
+	if algorithm != "" && algorithm != ratelimit.AlgorithmTokenBucket {
+		return fmt.Errorf("redis bucket storage supports only %s algorithm, got %q", ratelimit.AlgorithmTokenBucket, algorithm)
+	}
+
+	err := rl.client.HSet(ctx, rl.configKey(ip), "capacity", capacity, "rate_per_sec", ratePerSec).Err()
+	if err != nil {
+		return fmt.Errorf("failed to save config in redis: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes connections to Redis
+func (rl *RateLimiter) Close() error {
+	return rl.client.Close()
+}
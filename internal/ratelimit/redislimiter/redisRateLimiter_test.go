@@ -0,0 +1,154 @@
+package redislimiter
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/logger"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestLimiter returns a rate limiter on top of miniredis, time of Redis is frozen and moved by the test
+func newTestLimiter(t *testing.T, capacity int, ratePerSec float64) (*RateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	rl, err := NewRateLimiter(client, "test:", capacity, ratePerSec, logger.New(logger.EnvProd, logger.LogFormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.Close() })
+
+	return rl, mr
+}
+
+func TestAllowSequence(t *testing.T) {
+	rl, mr := newTestLimiter(t, 3, 2)
+	ctx := context.Background()
+
+	steps := []struct {
+		advance       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{0, true, 2},
+		{0, true, 1},
+		{0, true, 0},
+		{0, false, 0},
+		// half a token is earned, it isn't enough for a request
+		{250 * time.Millisecond, false, 0},
+		{250 * time.Millisecond, true, 0},
+		// the bucket doesn't grow over its capacity
+		{time.Hour, true, 2},
+	}
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		mr.SetTime(now)
+
+		d := rl.Allow(ctx, "client")
+		if d.Allowed != step.wantAllowed || d.Remaining != step.wantRemaining || d.Limit != 3 {
+			t.Fatalf("step %d: decision = %+v, want allowed %v, remaining %d, limit 3", i, d, step.wantAllowed, step.wantRemaining)
+		}
+		if !d.Allowed && d.RetryAfter <= 0 {
+			t.Fatalf("step %d: denied decision has no retry after", i)
+		}
+	}
+}
+
+// TestStateTTL checks that bucket state expires when the bucket would be full again
+func TestStateTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		rate     float64
+		requests int
+		wantTTL  time.Duration
+	}{
+		{name: "one token taken", capacity: 10, rate: 2, requests: 1, wantTTL: 500 * time.Millisecond},
+		{name: "bucket emptied", capacity: 10, rate: 2, requests: 10, wantTTL: 5 * time.Second},
+		{name: "slow rate", capacity: 5, rate: 0.1, requests: 2, wantTTL: 20 * time.Second},
+		{name: "zero rate never expires", capacity: 5, rate: 0, requests: 1, wantTTL: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, mr := newTestLimiter(t, tt.capacity, tt.rate)
+			ctx := context.Background()
+			for range tt.requests {
+				rl.Allow(ctx, "client")
+			}
+
+			key := rl.stateKey("client")
+			if !mr.Exists(key) {
+				t.Fatal("bucket state is not saved")
+			}
+			if ttl := mr.TTL(key); ttl != tt.wantTTL {
+				t.Fatalf("ttl = %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+// TestConfigure checks that a client's own config is used instead of defaults and doesn't affect other clients
+func TestConfigure(t *testing.T) {
+	rl, _ := newTestLimiter(t, 10, 10)
+	ctx := context.Background()
+
+	if err := rl.Configure(ctx, "configured", 2, 0.5, ratelimit.AlgorithmTokenBucket); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wantAllowed := range []bool{true, true, false} {
+		d := rl.Allow(ctx, "configured")
+		if d.Allowed != wantAllowed || d.Limit != 2 {
+			t.Fatalf("request %d: decision = %+v, want allowed %v, limit 2", i, d, wantAllowed)
+		}
+	}
+	// a token is refilled in two seconds with rate of 0.5
+	if d := rl.Allow(ctx, "configured"); d.RetryAfter != 2*time.Second {
+		t.Fatalf("retry after = %s, want 2s", d.RetryAfter)
+	}
+
+	if d := rl.Allow(ctx, "other"); !d.Allowed || d.Limit != 10 || d.Remaining != 9 {
+		t.Fatalf("decision of a client without config = %+v, want allowed with limit 10 and 9 remaining", d)
+	}
+}
+
+// TestAllowWithoutRedis checks that requests are allowed when Redis is unavailable
+func TestAllowWithoutRedis(t *testing.T) {
+	rl, mr := newTestLimiter(t, 1, 1)
+	mr.Close()
+
+	for range 3 {
+		if d := rl.Allow(context.Background(), "client"); !d.Allowed {
+			t.Fatal("request is denied while redis is unavailable")
+		}
+	}
+}
+
+// TestConfigureRejectsOtherAlgorithms checks that a config of an algorithm Redis doesn't keep is not saved
+func TestConfigureRejectsOtherAlgorithms(t *testing.T) {
+	rl, mr := newTestLimiter(t, 10, 10)
+	ctx := context.Background()
+
+	for _, algorithm := range []string{ratelimit.AlgorithmGCRA, ratelimit.AlgorithmSlidingWindowLog, ratelimit.AlgorithmSlidingWindowCounter} {
+		if err := rl.Configure(ctx, "client", 2, 1, algorithm); err == nil {
+			t.Errorf("configure with %s: error = nil, want an error", algorithm)
+		}
+	}
+	if mr.Exists(rl.configKey("client")) {
+		t.Fatal("config of a rejected algorithm is saved")
+	}
+
+	if err := rl.Configure(ctx, "client", 2, 1, ""); err != nil {
+		t.Fatalf("configure with default algorithm: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"ivanjabrony/cloud-test/internal/ratelimit/dto"
+	"time"
+)
+
+// Observer records duration and result of repository operations
+type Observer interface {
+	ObserveRepository(operation string, duration time.Duration, err error)
+}
+
+// InstrumentedRepository wraps ConfigRepository and reports duration of every operation to an observer
+type InstrumentedRepository struct {
+	repo     *ConfigRepository
+	observer Observer
+}
+
+func NewInstrumentedRepository(repo *ConfigRepository, observer Observer) (*InstrumentedRepository, error) {
+	if repo == nil || observer == nil {
+		return nil, errors.New("nil values in InstrumentedRepository constructor")
+	}
+
+	return &InstrumentedRepository{repo, observer}, nil
+}
+
+func (r *InstrumentedRepository) CreateOrUpdate(ctx context.Context, config *dto.UserConfig) (*dto.UserConfig, error) {
+	start := time.Now()
+	config, err := r.repo.CreateOrUpdate(ctx, config)
+	r.observer.ObserveRepository("create_or_update", time.Since(start), err)
+
+	return config, err
+}
+
+func (r *InstrumentedRepository) GetByIp(ctx context.Context, ip string) (*dto.UserConfig, error) {
+	start := time.Now()
+	config, err := r.repo.GetByIp(ctx, ip)
+	r.observer.ObserveRepository("get_by_ip", time.Since(start), err)
+
+	return config, err
+}
+
+func (r *InstrumentedRepository) GetAll(ctx context.Context) ([]*dto.UserConfig, error) {
+	start := time.Now()
+	configs, err := r.repo.GetAll(ctx)
+	r.observer.ObserveRepository("get_all", time.Since(start), err)
+
+	return configs, err
+}
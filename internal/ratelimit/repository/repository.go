@@ -54,9 +54,10 @@ func (repo ConfigRepository) CreateOrUpdate(ctx context.Context, config *dto.Use
 
 	query, args, err := repo.builder.
 		Insert("user_configs").
-		Columns("ip", "capacity", "rate_per_sec").
-		Values(config.Ip, config.Capacity, config.RatePerSec).
-		Suffix("ON CONFLICT (ip) DO UPDATE SET capacity = ?, rate_per_sec = ?", config.Capacity, config.RatePerSec).
+		Columns("ip", "capacity", "rate_per_sec", "algorithm", "max_in_flight").
+		Values(config.Ip, config.Capacity, config.RatePerSec, config.Algorithm, config.MaxInFlight).
+		Suffix("ON CONFLICT (ip) DO UPDATE SET capacity = ?, rate_per_sec = ?, algorithm = ?, max_in_flight = ?",
+			config.Capacity, config.RatePerSec, config.Algorithm, config.MaxInFlight).
 		ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("failed to build query: %w", err)
@@ -92,7 +93,7 @@ func (repo ConfigRepository) GetByIp(ctx context.Context, ip string) (*dto.UserC
 	}()
 
 	query, args, err := repo.builder.
-		Select("ip", "capacity", "rate_per_sec").
+		Select("ip", "capacity", "rate_per_sec", "algorithm", "max_in_flight").
 		From("user_configs").
 		Where(squirrel.Eq{"ip": ip}).
 		ToSql()
@@ -101,7 +102,7 @@ func (repo ConfigRepository) GetByIp(ctx context.Context, ip string) (*dto.UserC
 	}
 
 	var config dto.UserConfig
-	err = tx.QueryRow(ctx, query, args...).Scan(&config.Ip, &config.Capacity, &config.RatePerSec)
+	err = tx.QueryRow(ctx, query, args...).Scan(&config.Ip, &config.Capacity, &config.RatePerSec, &config.Algorithm, &config.MaxInFlight)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load user configuration: %w", err)
 	}
@@ -134,7 +135,7 @@ func (repo *ConfigRepository) GetAll(ctx context.Context) ([]*dto.UserConfig, er
 	}()
 
 	query, args, err := repo.builder.
-		Select("ip", "capacity", "rate_per_sec").
+		Select("ip", "capacity", "rate_per_sec", "algorithm", "max_in_flight").
 		From("user_configs").
 		ToSql()
 	if err != nil {
@@ -153,6 +154,8 @@ func (repo *ConfigRepository) GetAll(ctx context.Context) ([]*dto.UserConfig, er
 			&config.Ip,
 			&config.Capacity,
 			&config.RatePerSec,
+			&config.Algorithm,
+			&config.MaxInFlight,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
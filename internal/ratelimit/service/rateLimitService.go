@@ -4,17 +4,20 @@ import (
 	"context"
 	"errors"
 	"ivanjabrony/cloud-test/internal/logger"
-	"ivanjabrony/cloud-test/internal/ratelimit"
 	"ivanjabrony/cloud-test/internal/ratelimit/config"
 	"ivanjabrony/cloud-test/internal/ratelimit/dto"
 	"log/slog"
 )
 
-// BucketStorage is an interface for preferably in-memory storage for buckets. Basic implementation uses map[string]*ratelimit.TokenBucket with mutex,
-// but you can implement your own, for example sync.Map or Redis storage
-type BucketStorage interface {
-	Store(ctx context.Context, key string, bucket *ratelimit.TokenBucket)
-	Load(ctx context.Context, key string) (bucket *ratelimit.TokenBucket, ok bool)
+// RateLimiter is an interface for applying client configurations to limits of clients.
+// Basic implementation keeps buckets in memory, but limits may also live in a shared storage like Redis
+type RateLimiter interface {
+	Configure(ctx context.Context, ip string, capacity int, ratePerSec float64, algorithm string) error
+}
+
+// ConcurrencyLimiter is an interface for applying client configurations to limits of requests in flight
+type ConcurrencyLimiter interface {
+	Configure(ip string, maxInFlight int)
 }
 
 // ConfigurationRepository is an interface for client configurations
@@ -29,11 +32,15 @@ type RateLimitService struct {
 	cfg           *config.Config
 	logger        *logger.MyLogger
 	cfgRepository ConfigurationRepository
-	bucketStorage BucketStorage
+	rateLimiter   RateLimiter
+	concurrency   ConcurrencyLimiter
 }
 
-func NewService(cfg *config.Config, logger *logger.MyLogger, cfgRepository ConfigurationRepository, bucketStorage BucketStorage) (*RateLimitService, error) {
-	rl := &RateLimitService{cfg, logger, cfgRepository, bucketStorage}
+func NewService(cfg *config.Config, logger *logger.MyLogger, cfgRepository ConfigurationRepository, rateLimiter RateLimiter, concurrency ConcurrencyLimiter) (*RateLimitService, error) {
+	if cfg == nil || logger == nil || cfgRepository == nil || rateLimiter == nil || concurrency == nil {
+		return nil, errors.New("nil values in service constructor")
+	}
+	rl := &RateLimitService{cfg, logger, cfgRepository, rateLimiter, concurrency}
 
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.RepositoryTimeout)
 	defer cancel()
@@ -58,18 +65,10 @@ func NewService(cfg *config.Config, logger *logger.MyLogger, cfgRepository Confi
 	return rl, nil
 }
 
-// configureBucket configures a bucket based on a client config and stores it in storage
+// configureBucket applies a client config to the client's limits
 func (rl *RateLimitService) configureBucket(ctx context.Context, config *dto.UserConfig) error {
-	tb, ok := rl.bucketStorage.Load(ctx, config.Ip)
-	if !ok {
-		tb := ratelimit.NewTokenBucket(config.Capacity, config.RatePerSec)
-		rl.bucketStorage.Store(ctx, config.Ip, tb)
-		return nil
-	}
-
-	tb.UpdateConfig(config.Capacity, config.RatePerSec)
-
-	return nil
+	rl.concurrency.Configure(config.Ip, config.MaxInFlight)
+	return rl.rateLimiter.Configure(ctx, config.Ip, config.Capacity, config.RatePerSec, config.Algorithm)
 }
 
 // CreateOrUpdateConfig adds a config into a repository or updates if it already exists
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindowCounter approximates SlidingWindowLog with counters of the current and the previous fixed windows
+//
+// Requests of the previous window are assumed to be spread evenly, so the amount of requests
+// in the sliding window is prev * (share of the previous window still covered) + curr.
+// It needs constant memory per client whatever its capacity is
+type SlidingWindowCounter struct {
+	capacity    int
+	ratePerSec  float64
+	window      time.Duration
+	windowStart time.Time // start of the current fixed window
+	prev        int       // requests allowed in the previous fixed window
+	curr        int       // requests allowed in the current fixed window
+	lastUsed    time.Time
+	mu          sync.Mutex
+}
+
+func NewSlidingWindowCounter(capacity int, ratePerSec float64) *SlidingWindowCounter {
+	now := time.Now()
+	return &SlidingWindowCounter{
+		capacity:    capacity,
+		ratePerSec:  ratePerSec,
+		window:      windowDuration(capacity, ratePerSec),
+		windowStart: now,
+		lastUsed:    now,
+	}
+}
+
+// advance moves fixed windows forward to the one containing now, must be called with locked mutex
+func (c *SlidingWindowCounter) advance(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.window {
+		return
+	}
+
+	if elapsed < 2*c.window {
+		c.prev, c.curr = c.curr, 0
+		c.windowStart = c.windowStart.Add(c.window)
+		return
+	}
+
+	// more than a whole window has passed without requests
+	c.prev, c.curr = 0, 0
+	c.windowStart = c.windowStart.Add(elapsed / c.window * c.window)
+}
+
+// estimate returns approximate amount of requests in the sliding window ending at now
+func (c *SlidingWindowCounter) estimate(now time.Time) float64 {
+	covered := 1 - float64(now.Sub(c.windowStart))/float64(c.window)
+	return float64(c.prev)*covered + float64(c.curr)
+}
+
+// waitFor returns time from now till estimate drops to target
+func (c *SlidingWindowCounter) waitFor(now time.Time, target float64) time.Duration {
+	windowEnd := c.windowStart.Add(c.window)
+	// within the current window estimate decreases with the previous window's share
+	if float64(c.curr) <= target {
+		if c.prev == 0 {
+			return 0
+		}
+		share := 1 - (target-float64(c.curr))/float64(c.prev)
+		return until(now, c.windowStart.Add(time.Duration(math.Ceil(share*float64(c.window)))))
+	}
+
+	// in the next window the current window becomes the previous one
+	share := 1 - target/float64(c.curr)
+	return until(now, windowEnd.Add(time.Duration(math.Ceil(share*float64(c.window)))))
+}
+
+func (c *SlidingWindowCounter) Allow() Decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.lastUsed = now
+	c.advance(now)
+
+	allowed := c.estimate(now)+1 <= float64(c.capacity)
+	if allowed {
+		c.curr++
+	}
+
+	est := c.estimate(now)
+	d := Decision{
+		Allowed:   allowed,
+		Limit:     c.capacity,
+		Remaining: max(int(float64(c.capacity)-est), 0),
+		Reset:     c.waitFor(now, 0),
+	}
+	if !allowed && c.capacity > 0 {
+		d.RetryAfter = c.waitFor(now, float64(c.capacity)-1)
+	}
+	return d
+}
+
+// UpdateConfig changes capacity and window, counted requests are kept
+func (c *SlidingWindowCounter) UpdateConfig(newCapacity int, newRatePerSec float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.advance(now)
+
+	c.capacity = newCapacity
+	c.ratePerSec = newRatePerSec
+	c.window = windowDuration(newCapacity, newRatePerSec)
+	c.lastUsed = now
+}
+
+func (c *SlidingWindowCounter) LastUsed() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastUsed
+}
+
+// IsIdle checks if a counter was not used for ttl and both of its windows are over
+func (c *SlidingWindowCounter) IsIdle(now time.Time, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastUsed) < ttl {
+		return false
+	}
+	return now.Sub(c.windowStart) >= 2*c.window || (c.prev == 0 && c.curr == 0)
+}
+
+func (c *SlidingWindowCounter) Algorithm() string {
+	return AlgorithmSlidingWindowCounter
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingWindowLog allows at most capacity requests within any window of capacity/rate
+//
+// Times of allowed requests are kept in a ring buffer of capacity size, so memory of a client
+// grows with its capacity. Unlike TokenBucket it doesn't let a client spend a whole window's
+// worth of requests right after the previous window's burst
+type SlidingWindowLog struct {
+	capacity   int
+	ratePerSec float64
+	window     time.Duration
+	log        []time.Time // ring buffer of allowed requests, the oldest at head
+	head       int
+	count      int
+	lastUsed   time.Time
+	mu         sync.Mutex
+}
+
+func NewSlidingWindowLog(capacity int, ratePerSec float64) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		capacity:   capacity,
+		ratePerSec: ratePerSec,
+		window:     windowDuration(capacity, ratePerSec),
+		log:        make([]time.Time, max(capacity, 0)),
+		lastUsed:   time.Now(),
+	}
+}
+
+// at returns i-th oldest request in the log
+func (l *SlidingWindowLog) at(i int) time.Time {
+	return l.log[(l.head+i)%len(l.log)]
+}
+
+// expire drops requests that left the window, must be called with locked mutex
+func (l *SlidingWindowLog) expire(now time.Time) {
+	for l.count > 0 && !now.Before(l.at(0).Add(l.window)) {
+		l.head = (l.head + 1) % len(l.log)
+		l.count--
+	}
+}
+
+func (l *SlidingWindowLog) Allow() Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.lastUsed = now
+	l.expire(now)
+
+	allowed := l.count < l.capacity
+	if allowed {
+		l.log[(l.head+l.count)%len(l.log)] = now
+		l.count++
+	}
+
+	d := Decision{
+		Allowed:   allowed,
+		Limit:     l.capacity,
+		Remaining: l.capacity - l.count,
+	}
+	if l.count > 0 {
+		d.Reset = until(now, l.at(l.count-1).Add(l.window))
+		if !allowed {
+			d.RetryAfter = until(now, l.at(0).Add(l.window))
+		}
+	}
+	return d
+}
+
+// UpdateConfig changes capacity and window, the most recent requests that fit new capacity are kept
+func (l *SlidingWindowLog) UpdateConfig(newCapacity int, newRatePerSec float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.expire(now)
+
+	keep := min(l.count, newCapacity)
+	log := make([]time.Time, max(newCapacity, 0))
+	for i := 0; i < keep; i++ {
+		log[i] = l.at(l.count - keep + i)
+	}
+
+	l.log, l.head, l.count = log, 0, keep
+	l.capacity = newCapacity
+	l.ratePerSec = newRatePerSec
+	l.window = windowDuration(newCapacity, newRatePerSec)
+	l.lastUsed = now
+}
+
+func (l *SlidingWindowLog) LastUsed() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastUsed
+}
+
+// IsIdle checks if a log was not used for ttl and has no requests in the window
+func (l *SlidingWindowLog) IsIdle(now time.Time, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastUsed) < ttl {
+		return false
+	}
+	return l.count == 0 || !now.Before(l.at(l.count-1).Add(l.window))
+}
+
+func (l *SlidingWindowLog) Algorithm() string {
+	return AlgorithmSlidingWindowLog
+}
@@ -1,41 +1,202 @@
 package storage
 
 import (
+	"container/list"
 	"context"
 	"ivanjabrony/cloud-test/internal/ratelimit"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type entry struct {
+	key     string
+	bucket  ratelimit.Limiter
+	element *list.Element // position in LRU list, nil for pinned buckets
+	touched atomic.Bool   // loaded since it was moved to the front of LRU list
+}
+
+// touch marks an entry as used. The flag is written only if it isn't set yet,
+// so loads of a hot bucket don't write to shared memory
+func (e *entry) touch() {
+	if !e.touched.Load() {
+		e.touched.Store(true)
+	}
+}
+
 // BucketStorage is a in-memory key value storage for buckets
+//
+// Buckets that are idle for idleTTL and full are evicted periodically, as a new bucket would be the same.
+// If amount of buckets reaches maxBuckets, the least recently used bucket is evicted.
+// Pinned buckets are configured by clients' persisted configs, they are never evicted and don't count towards the limit
+//
+// Loads take only a read lock and mark a bucket as used, the bucket is moved to the front of LRU list
+// when eviction reaches it, like the CLOCK algorithm does. So the least recently used bucket is approximated:
+// a bucket loaded once since it was moved is as recent as a bucket loaded many times
 type BucketStorage struct {
-	buckets map[string]*ratelimit.TokenBucket
-	mu      sync.RWMutex
+	buckets           map[string]*entry
+	lru               *list.List // unpinned entries, the most recently used at front
+	idleTTL           time.Duration
+	maxBuckets        int
+	idleEvictions     atomic.Uint64
+	capacityEvictions atomic.Uint64
+	stopChan          chan struct{}
+	stopOnce          sync.Once
+	mu                sync.RWMutex
 }
 
-func NewBucketStorage() *BucketStorage {
-	return &BucketStorage{make(map[string]*ratelimit.TokenBucket), sync.RWMutex{}}
+// NewBucketStorage creates a storage and starts a goroutine that evicts idle buckets every cleanupInterval.
+// Zero idleTTL disables idle eviction, zero maxBuckets disables the limit
+func NewBucketStorage(idleTTL, cleanupInterval time.Duration, maxBuckets int) *BucketStorage {
+	bs := &BucketStorage{
+		buckets:    make(map[string]*entry),
+		lru:        list.New(),
+		idleTTL:    idleTTL,
+		maxBuckets: maxBuckets,
+		stopChan:   make(chan struct{}),
+	}
+
+	if idleTTL > 0 && cleanupInterval > 0 {
+		go runCleaner(cleanupInterval, bs.stopChan, bs.evictIdle)
+	}
+	return bs
 }
 
-// Store saves a bucket with a key
-func (bs *BucketStorage) Store(ctx context.Context, key string, bucket *ratelimit.TokenBucket) {
+// LoadOrStore returns a bucket stored with a key if there is one, otherwise it saves the given bucket.
+// Loaded is true if the bucket was stored before, so a bucket stored concurrently is never replaced
+func (bs *BucketStorage) LoadOrStore(ctx context.Context, key string, bucket ratelimit.Limiter) (actual ratelimit.Limiter, loaded bool) {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	bs.buckets[key] = bucket
+	if e, ok := bs.buckets[key]; ok {
+		e.touch()
+		return e.bucket, true
+	}
+
+	if bs.maxBuckets > 0 && bs.lru.Len() >= bs.maxBuckets {
+		bs.evictLeastRecent()
+	}
+
+	e := &entry{key: key, bucket: bucket}
+	e.element = bs.lru.PushFront(e)
+	bs.buckets[key] = e
+	return bucket, false
+}
+
+// evictLeastRecent evicts the least recently used unpinned bucket, must be called with locked mutex.
+// Buckets loaded since they were moved get a second chance and are moved to the front
+func (bs *BucketStorage) evictLeastRecent() {
+	// every bucket is moved at most once, so the loop ends within two passes
+	for el := bs.lru.Back(); el != nil; el = bs.lru.Back() {
+		e := el.Value.(*entry)
+		if e.touched.Swap(false) {
+			bs.lru.MoveToFront(el)
+			continue
+		}
+
+		bs.remove(e)
+		bs.capacityEvictions.Add(1)
+		return
+	}
+}
+
+// StorePinned saves a bucket with a key that is never evicted
+func (bs *BucketStorage) StorePinned(ctx context.Context, key string, bucket ratelimit.Limiter) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	e, ok := bs.buckets[key]
+	if !ok {
+		e = &entry{key: key}
+		bs.buckets[key] = e
+	}
+	if e.element != nil {
+		bs.lru.Remove(e.element)
+		e.element = nil
+	}
+	e.bucket = bucket
+	e.touched.Store(false)
 }
 
 // Load returns Bucket, true if bucket is exists on a key or nil, false if it is not
-func (bs *BucketStorage) Load(ctx context.Context, key string) (bucket *ratelimit.TokenBucket, ok bool) {
+func (bs *BucketStorage) Load(ctx context.Context, key string) (bucket ratelimit.Limiter, ok bool) {
 	bs.mu.RLock()
 	defer bs.mu.RUnlock()
 
-	value, ok := bs.buckets[key]
-	return value, ok
+	e, ok := bs.buckets[key]
+	if !ok {
+		return nil, false
+	}
+	e.touch()
+	return e.bucket, true
 }
 
-// Stop calls Stop method of every bucket in a storage
+// Len returns amount of buckets in a storage
+func (bs *BucketStorage) Len() int {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return len(bs.buckets)
+}
+
+// Evictions returns amount of buckets evicted for being idle and for exceeding the limit of buckets
+func (bs *BucketStorage) Evictions() (idle, capacity uint64) {
+	return bs.idleEvictions.Load(), bs.capacityEvictions.Load()
+}
+
+// Stop stops eviction of idle buckets
 func (bs *BucketStorage) Stop(ctx context.Context) {
-	for _, b := range bs.buckets {
-		b.Stop()
+	bs.stopOnce.Do(func() { close(bs.stopChan) })
+}
+
+// remove deletes an entry, must be called with locked mutex
+func (bs *BucketStorage) remove(e *entry) {
+	if e.element != nil {
+		bs.lru.Remove(e.element)
+	}
+	delete(bs.buckets, e.key)
+}
+
+// runCleaner periodically calls evict until stopChan is closed
+func runCleaner(interval time.Duration, stopChan <-chan struct{}, evict func(now time.Time)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			evict(time.Now())
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// evictIdle evicts unpinned buckets that are full and were not used for idleTTL.
+// Recently used buckets are at the front of LRU list, so the walk starts from the back and stops at the first recent one.
+// Buckets loaded since they were moved are moved to the front on the way, so the rest of the list stays in order of use
+func (bs *BucketStorage) evictIdle(now time.Time) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for el, n := bs.lru.Back(), bs.lru.Len(); el != nil && n > 0; n-- {
+		e := el.Value.(*entry)
+		prev := el.Prev()
+		if e.touched.Swap(false) {
+			bs.lru.MoveToFront(el)
+			el = prev
+			continue
+		}
+		if !e.bucket.IsIdle(now, bs.idleTTL) {
+			if now.Sub(e.bucket.LastUsed()) < bs.idleTTL {
+				break
+			}
+			// not full yet, it will be evicted by one of the next rounds
+			el = prev
+			continue
+		}
+
+		bs.remove(e)
+		bs.idleEvictions.Add(1)
+		el = prev
 	}
 }
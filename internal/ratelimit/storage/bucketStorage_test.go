@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bucketStorage is a storage as rate limiter sees it, with Len to check limits
+type bucketStorage interface {
+	LoadOrStore(ctx context.Context, key string, bucket ratelimit.Limiter) (actual ratelimit.Limiter, loaded bool)
+	StorePinned(ctx context.Context, key string, bucket ratelimit.Limiter)
+	Load(ctx context.Context, key string) (bucket ratelimit.Limiter, ok bool)
+	Len() int
+}
+
+var storages = []struct {
+	name       string
+	newStorage func(maxBuckets int) bucketStorage
+}{
+	{"mutex", func(maxBuckets int) bucketStorage { return NewBucketStorage(0, 0, maxBuckets) }},
+	{"sharded", func(maxBuckets int) bucketStorage { return NewShardedBucketStorage(0, 0, 0, maxBuckets) }},
+	{"sync_map", func(maxBuckets int) bucketStorage { return NewSyncMapBucketStorage(0, 0, maxBuckets) }},
+}
+
+// TestLoadOrStoreKeepsPinnedBucket checks that a default bucket added for a client doesn't replace
+// a bucket pinned by a concurrent Configure
+func TestLoadOrStoreKeepsPinnedBucket(t *testing.T) {
+	ctx := context.Background()
+	for _, s := range storages {
+		t.Run(s.name, func(t *testing.T) {
+			bs := s.newStorage(10)
+			pinned := ratelimit.NewTokenBucket(1, 1)
+			bs.StorePinned(ctx, "client", pinned)
+
+			actual, loaded := bs.LoadOrStore(ctx, "client", ratelimit.NewTokenBucket(100, 100))
+			if !loaded || actual != ratelimit.Limiter(pinned) {
+				t.Fatal("LoadOrStore didn't return the pinned bucket")
+			}
+			if bucket, _ := bs.Load(ctx, "client"); bucket != ratelimit.Limiter(pinned) {
+				t.Fatal("pinned bucket is replaced")
+			}
+		})
+	}
+}
+
+// TestStorageLimit checks that concurrent stores never leave more unpinned buckets than the limit
+// and pinned buckets are never evicted
+func TestStorageLimit(t *testing.T) {
+	const (
+		maxBuckets = 64
+		pinned     = 8
+		workers    = 8
+		keys       = 2000
+	)
+
+	ctx := context.Background()
+	for _, s := range storages {
+		t.Run(s.name, func(t *testing.T) {
+			bs := s.newStorage(maxBuckets)
+			for i := range pinned {
+				bs.StorePinned(ctx, "pinned"+strconv.Itoa(i), ratelimit.NewTokenBucket(1, 1))
+			}
+
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range keys {
+						key := strconv.Itoa(w*keys + i)
+						bs.LoadOrStore(ctx, key, ratelimit.NewTokenBucket(1, 1))
+						// pin some of just stored buckets, as Configure does
+						if i%100 == 0 {
+							bs.StorePinned(ctx, key, ratelimit.NewTokenBucket(1, 1))
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			pinnedTotal := pinned + workers*keys/100
+			// sharded storage rounds the limit up to a multiple of its shards
+			limit := maxBuckets + DefaultShards
+			if got := bs.Len(); got < pinnedTotal || got > pinnedTotal+limit {
+				t.Fatalf("len = %d, want from %d to %d", got, pinnedTotal, pinnedTotal+limit)
+			}
+			for i := range pinned {
+				if _, ok := bs.Load(ctx, "pinned"+strconv.Itoa(i)); !ok {
+					t.Fatal("pinned bucket is evicted")
+				}
+			}
+		})
+	}
+}
+
+// TestSyncMapEvictsSampledBuckets checks that buckets evicted over the limit are sampled from all buckets,
+// the order sync.Map ranges over its keys in doesn't decide which buckets are evicted
+func TestSyncMapEvictsSampledBuckets(t *testing.T) {
+	const maxBuckets = 100
+
+	ctx := context.Background()
+	bs := NewSyncMapBucketStorage(0, 0, maxBuckets)
+	for i := range maxBuckets {
+		bs.LoadOrStore(ctx, strconv.Itoa(i), ratelimit.NewTokenBucket(1, 1))
+	}
+	// the second half of buckets is used later than the first one
+	time.Sleep(time.Millisecond)
+	for i := maxBuckets / 2; i < maxBuckets; i++ {
+		bucket, _ := bs.Load(ctx, strconv.Itoa(i))
+		bucket.Allow()
+	}
+
+	for i := range maxBuckets / 2 {
+		bs.LoadOrStore(ctx, "new"+strconv.Itoa(i), ratelimit.NewTokenBucket(1, 1))
+	}
+
+	if got := bs.Len(); got != maxBuckets {
+		t.Fatalf("len = %d, want %d", got, maxBuckets)
+	}
+	if len(bs.unpinned) != maxBuckets || len(bs.positions) != maxBuckets {
+		t.Fatalf("index has %d keys and %d positions, want %d", len(bs.unpinned), len(bs.positions), maxBuckets)
+	}
+	evictedOld, evictedRecent := 0, 0
+	for i := range maxBuckets {
+		if _, ok := bs.Load(ctx, strconv.Itoa(i)); ok {
+			continue
+		}
+		if i < maxBuckets/2 {
+			evictedOld++
+		} else {
+			evictedRecent++
+		}
+	}
+	// the oldest of 5 samples is an old bucket with probability of 97% while half of buckets are old
+	if evictedOld <= evictedRecent {
+		t.Fatalf("evicted %d old and %d recently used buckets, old ones must be preferred", evictedOld, evictedRecent)
+	}
+}
+
+// BenchmarkStorageLoad compares concurrent loads of existing buckets
+func BenchmarkStorageLoad(b *testing.B) {
+	const keys = 10000
+
+	ctx := context.Background()
+	for _, s := range storages {
+		b.Run(s.name, func(b *testing.B) {
+			bs := s.newStorage(0)
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = strconv.Itoa(i)
+				bs.LoadOrStore(ctx, names[i], ratelimit.NewTokenBucket(1, 1))
+			}
+
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					bs.Load(ctx, names[r.IntN(keys)])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStorageLoadOrStore compares concurrent requests of clients that are mostly known,
+// with a limit of buckets that makes new clients evict old ones
+func BenchmarkStorageLoadOrStore(b *testing.B) {
+	const (
+		keys       = 20000
+		maxBuckets = 10000
+	)
+
+	ctx := context.Background()
+	for _, s := range storages {
+		b.Run(s.name, func(b *testing.B) {
+			bs := s.newStorage(maxBuckets)
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = strconv.Itoa(i)
+			}
+
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					// a quarter of clients makes most of requests, as real traffic does
+					key := names[r.IntN(keys/4)]
+					if r.IntN(10) == 0 {
+						key = names[r.IntN(keys)]
+					}
+					if _, ok := bs.Load(ctx, key); !ok {
+						bs.LoadOrStore(ctx, key, ratelimit.NewTokenBucket(1, 1))
+					}
+				}
+			})
+		})
+	}
+}
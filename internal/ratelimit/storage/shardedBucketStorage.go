@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"hash/maphash"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"sync"
+	"time"
+)
+
+// DefaultShards is amount of shards used when it is not configured
+const DefaultShards = 32
+
+// ShardedBucketStorage is a in-memory key value storage for buckets partitioned by hash of a key
+//
+// Every shard is a BucketStorage with its own mutex, so clients in different shards don't contend.
+// Limit of buckets is split between shards evenly, so LRU eviction is done per shard
+type ShardedBucketStorage struct {
+	shards   []*BucketStorage
+	seed     maphash.Seed
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewShardedBucketStorage creates a storage with a given amount of shards and starts a goroutine
+// that evicts idle buckets of all shards every cleanupInterval
+func NewShardedBucketStorage(shards int, idleTTL, cleanupInterval time.Duration, maxBuckets int) *ShardedBucketStorage {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	perShard := 0
+	if maxBuckets > 0 {
+		perShard = max((maxBuckets+shards-1)/shards, 1)
+	}
+
+	ss := &ShardedBucketStorage{
+		shards:   make([]*BucketStorage, shards),
+		seed:     maphash.MakeSeed(),
+		stopChan: make(chan struct{}),
+	}
+	for i := range ss.shards {
+		// shards don't run their own cleaners, one goroutine serves all of them
+		ss.shards[i] = NewBucketStorage(idleTTL, 0, perShard)
+	}
+
+	if idleTTL > 0 && cleanupInterval > 0 {
+		go runCleaner(cleanupInterval, ss.stopChan, ss.evictIdle)
+	}
+	return ss
+}
+
+func (ss *ShardedBucketStorage) shard(key string) *BucketStorage {
+	return ss.shards[maphash.String(ss.seed, key)%uint64(len(ss.shards))]
+}
+
+// LoadOrStore returns a bucket stored with a key if there is one, otherwise it saves the given bucket
+func (ss *ShardedBucketStorage) LoadOrStore(ctx context.Context, key string, bucket ratelimit.Limiter) (actual ratelimit.Limiter, loaded bool) {
+	return ss.shard(key).LoadOrStore(ctx, key, bucket)
+}
+
+// StorePinned saves a bucket with a key that is never evicted
+func (ss *ShardedBucketStorage) StorePinned(ctx context.Context, key string, bucket ratelimit.Limiter) {
+	ss.shard(key).StorePinned(ctx, key, bucket)
+}
+
+// Load returns Bucket, true if bucket is exists on a key or nil, false if it is not
+func (ss *ShardedBucketStorage) Load(ctx context.Context, key string) (bucket ratelimit.Limiter, ok bool) {
+	return ss.shard(key).Load(ctx, key)
+}
+
+// Len returns amount of buckets in a storage
+func (ss *ShardedBucketStorage) Len() int {
+	n := 0
+	for _, s := range ss.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Evictions returns amount of buckets evicted for being idle and for exceeding the limit of buckets
+func (ss *ShardedBucketStorage) Evictions() (idle, capacity uint64) {
+	for _, s := range ss.shards {
+		i, c := s.Evictions()
+		idle += i
+		capacity += c
+	}
+	return idle, capacity
+}
+
+// Stop stops eviction of idle buckets
+func (ss *ShardedBucketStorage) Stop(ctx context.Context) {
+	ss.stopOnce.Do(func() { close(ss.stopChan) })
+}
+
+func (ss *ShardedBucketStorage) evictIdle(now time.Time) {
+	for _, s := range ss.shards {
+		s.evictIdle(now)
+	}
+}
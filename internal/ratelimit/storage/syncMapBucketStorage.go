@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"ivanjabrony/cloud-test/internal/ratelimit"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// evictionSamples is amount of buckets compared to find the least recently used one
+const evictionSamples = 5
+
+type syncMapEntry struct {
+	bucket ratelimit.Limiter
+	pinned bool
+}
+
+// SyncMapBucketStorage is a in-memory key value storage for buckets based on sync.Map
+//
+// Loads of existing buckets don't take any locks, changes of the storage are serialized by a mutex.
+// sync.Map keeps no order of use, so when the limit of buckets is reached the least recently used bucket
+// is approximated like Redis does: the oldest of a few randomly sampled unpinned buckets is evicted.
+// Keys of unpinned buckets are kept in an index to be sampled from.
+// Use BucketStorage or ShardedBucketStorage if exact LRU order matters
+type SyncMapBucketStorage struct {
+	buckets           sync.Map       // string -> *syncMapEntry
+	unpinned          []string       // keys of unpinned buckets
+	positions         map[string]int // positions of keys in unpinned
+	total             atomic.Int64
+	idleTTL           time.Duration
+	maxBuckets        int
+	idleEvictions     atomic.Uint64
+	capacityEvictions atomic.Uint64
+	stopChan          chan struct{}
+	stopOnce          sync.Once
+	mu                sync.Mutex // guards changes of buckets and the index of unpinned keys
+}
+
+// NewSyncMapBucketStorage creates a storage and starts a goroutine that evicts idle buckets every cleanupInterval.
+// Zero idleTTL disables idle eviction, zero maxBuckets disables the limit
+func NewSyncMapBucketStorage(idleTTL, cleanupInterval time.Duration, maxBuckets int) *SyncMapBucketStorage {
+	bs := &SyncMapBucketStorage{
+		positions:  make(map[string]int),
+		idleTTL:    idleTTL,
+		maxBuckets: maxBuckets,
+		stopChan:   make(chan struct{}),
+	}
+
+	if idleTTL > 0 && cleanupInterval > 0 {
+		go runCleaner(cleanupInterval, bs.stopChan, bs.evictIdle)
+	}
+	return bs
+}
+
+// LoadOrStore returns a bucket stored with a key if there is one, otherwise it saves the given bucket
+func (bs *SyncMapBucketStorage) LoadOrStore(ctx context.Context, key string, bucket ratelimit.Limiter) (actual ratelimit.Limiter, loaded bool) {
+	if value, ok := bs.buckets.Load(key); ok {
+		return value.(*syncMapEntry).bucket, true
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	prev, loaded := bs.buckets.LoadOrStore(key, &syncMapEntry{bucket: bucket})
+	if loaded {
+		return prev.(*syncMapEntry).bucket, true
+	}
+
+	bs.total.Add(1)
+	bs.addKey(key)
+	if bs.maxBuckets > 0 {
+		for len(bs.unpinned) > bs.maxBuckets {
+			bs.evictSampled(key)
+		}
+	}
+	return bucket, false
+}
+
+// StorePinned saves a bucket with a key that is never evicted
+func (bs *SyncMapBucketStorage) StorePinned(ctx context.Context, key string, bucket ratelimit.Limiter) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	prev, loaded := bs.buckets.Swap(key, &syncMapEntry{bucket: bucket, pinned: true})
+	if !loaded {
+		bs.total.Add(1)
+		return
+	}
+	if !prev.(*syncMapEntry).pinned {
+		bs.removeKey(key)
+	}
+}
+
+// Load returns Bucket, true if bucket is exists on a key or nil, false if it is not
+func (bs *SyncMapBucketStorage) Load(ctx context.Context, key string) (bucket ratelimit.Limiter, ok bool) {
+	value, ok := bs.buckets.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*syncMapEntry).bucket, true
+}
+
+// Len returns amount of buckets in a storage
+func (bs *SyncMapBucketStorage) Len() int {
+	return int(bs.total.Load())
+}
+
+// Evictions returns amount of buckets evicted for being idle and for exceeding the limit of buckets
+func (bs *SyncMapBucketStorage) Evictions() (idle, capacity uint64) {
+	return bs.idleEvictions.Load(), bs.capacityEvictions.Load()
+}
+
+// Stop stops eviction of idle buckets
+func (bs *SyncMapBucketStorage) Stop(ctx context.Context) {
+	bs.stopOnce.Do(func() { close(bs.stopChan) })
+}
+
+// addKey adds a key of an unpinned bucket to the index, must be called with locked mutex
+func (bs *SyncMapBucketStorage) addKey(key string) {
+	bs.positions[key] = len(bs.unpinned)
+	bs.unpinned = append(bs.unpinned, key)
+}
+
+// removeKey removes a key from the index by moving the last key to its place, must be called with locked mutex
+func (bs *SyncMapBucketStorage) removeKey(key string) {
+	i, ok := bs.positions[key]
+	if !ok {
+		return
+	}
+
+	last := len(bs.unpinned) - 1
+	bs.unpinned[i] = bs.unpinned[last]
+	bs.positions[bs.unpinned[i]] = i
+	bs.unpinned = bs.unpinned[:last]
+	delete(bs.positions, key)
+}
+
+// remove deletes an unpinned bucket, must be called with locked mutex
+func (bs *SyncMapBucketStorage) remove(key string) {
+	bs.buckets.Delete(key)
+	bs.removeKey(key)
+	bs.total.Add(-1)
+}
+
+// evictSampled evicts the least recently used of a few randomly sampled unpinned buckets, except the one just stored.
+// Must be called with locked mutex
+func (bs *SyncMapBucketStorage) evictSampled(stored string) {
+	var oldestKey string
+	var oldestUsed time.Time
+	for range evictionSamples {
+		key := bs.unpinned[rand.IntN(len(bs.unpinned))]
+		if key == stored {
+			continue
+		}
+		value, _ := bs.buckets.Load(key)
+		if used := value.(*syncMapEntry).bucket.LastUsed(); oldestKey == "" || used.Before(oldestUsed) {
+			oldestKey, oldestUsed = key, used
+		}
+	}
+
+	if oldestKey != "" {
+		bs.remove(oldestKey)
+		bs.capacityEvictions.Add(1)
+	}
+}
+
+// evictIdle evicts unpinned buckets that are full and were not used for idleTTL
+func (bs *SyncMapBucketStorage) evictIdle(now time.Time) {
+	bs.buckets.Range(func(k, v any) bool {
+		e := v.(*syncMapEntry)
+		if e.pinned || !e.bucket.IsIdle(now, bs.idleTTL) {
+			return true
+		}
+
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+		// the bucket may have been replaced or pinned since Range has seen it
+		if current, ok := bs.buckets.Load(k); ok && current == v {
+			bs.remove(k.(string))
+			bs.idleEvictions.Add(1)
+		}
+		return true
+	})
+}
@@ -1,76 +1,43 @@
 package ratelimit
 
 import (
+	"math"
 	"sync"
 	"time"
 )
 
 // TokenBucket - struct that represents buckets with tokens
 //
-// Holds all configuration info about buckets and fields for refreshing tokens
+// Holds all configuration info about buckets and fields for refreshing tokens.
+// Tokens are refilled lazily: every call computes tokens earned since the last refill,
+// so a bucket needs no goroutine or timer
 type TokenBucket struct {
 	capacity   int       // max amount of tokens stored
 	ratePerSec float64   // rate of tokens' refreshing
-	available  float64   // current available
+	available  float64   // available at the time of last refill
 	lastRefill time.Time // last refresh time
-	ticker     *time.Ticker
-	stopChan   chan struct{} // chan for stopping refresh ticker
 	mu         sync.Mutex
 }
 
-// NewTokenBucket creates new bucket and starts goroutine that will refresh tokens
+// NewTokenBucket creates new full bucket
 func NewTokenBucket(capacity int, ratePerSec float64) *TokenBucket {
-	tb := &TokenBucket{
+	return &TokenBucket{
 		capacity:   capacity,
 		ratePerSec: ratePerSec,
 		available:  float64(capacity),
 		lastRefill: time.Now(),
-		stopChan:   make(chan struct{}),
 	}
-
-	refillInterval := calculateRefillInterval(ratePerSec)
-	tb.ticker = time.NewTicker(refillInterval)
-
-	go tb.startRefiller()
-	return tb
-}
-
-// calculateRefillInterval calculates optimal refill rate based on rps
-func calculateRefillInterval(ratePerSec float64) time.Duration {
-	// higher refresh rate for high prs
-	if ratePerSec >= 10 {
-		return time.Millisecond * 100
-	} else if ratePerSec >= 1 {
-		return time.Second / time.Duration(ratePerSec)
-	}
-	// for low rps refresh every second
-	return time.Second
 }
 
-// startRefiller starts refilling goroutine
-//
-// Stops via closing stopChan from bucket struct and refreshes tokens based on ticker
-func (tb *TokenBucket) startRefiller() {
-	for {
-		select {
-		case <-tb.ticker.C:
-			tb.refill()
-		case <-tb.stopChan:
-			tb.ticker.Stop()
-			return
-		}
+// refill adds tokens earned since the last refill, must be called with locked mutex
+func (tb *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.lastRefill).Seconds()
+	if elapsed <= 0 {
+		return
 	}
-}
-
-// refill refills tokens
-func (tb *TokenBucket) refill() {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
 
-	elapsed := time.Since(tb.lastRefill).Seconds()
-	tokensToAdd := elapsed * tb.ratePerSec
-	tb.available = min(tb.available+tokensToAdd, float64(tb.capacity))
-	tb.lastRefill = time.Now()
+	tb.available = min(tb.available+elapsed*tb.ratePerSec, float64(tb.capacity))
+	tb.lastRefill = now
 }
 
 // UpdateConfig updates configuration of a persons bucket
@@ -78,9 +45,8 @@ func (tb *TokenBucket) UpdateConfig(newCapacity int, newRatePerSec float64) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	// 1. recalculate cur tokens
-	elapsed := time.Since(tb.lastRefill).Seconds()
-	tb.available += elapsed * tb.ratePerSec
+	// 1. recalculate cur tokens with the old rate
+	tb.refill(time.Now())
 
 	// 2. apply new parameters
 	tb.ratePerSec = newRatePerSec
@@ -92,26 +58,89 @@ func (tb *TokenBucket) UpdateConfig(newCapacity int, newRatePerSec float64) {
 	} else if tb.available < 0 {
 		tb.available = 0
 	}
-
-	// 4. refresh ticker
-	newInterval := calculateRefillInterval(newRatePerSec)
-	tb.ticker.Reset(newInterval)
-	tb.lastRefill = time.Now()
 }
 
 // Allow checks if it is possible to make a requests (if there's enough tokens in a bucket)
-func (tb *TokenBucket) Allow() bool {
+// and takes a token if it is
+func (tb *TokenBucket) Allow() Decision {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return tb.allow(time.Now())
+}
+
+// allow is Allow at now, must be called with locked mutex
+func (tb *TokenBucket) allow(now time.Time) Decision {
+	tb.refill(now)
+
+	allowed := tb.available >= 1
+	if allowed {
+		tb.available--
+	}
+
+	return NewDecision(allowed, tb.capacity, tb.available, tb.ratePerSec)
+}
+
+// Reserve takes a token for a request even if it has to wait for the token to be refilled,
+// the returned delay is time the request must wait before it is allowed
+//
+// Tokens owed to waiting requests make available negative, so the bucket itself is a queue of them:
+// requests leave it one by one with the bucket's rate. A request is rejected if maxQueue requests
+// are already waiting or it would wait longer than maxDelay
+func (tb *TokenBucket) Reserve(maxQueue int, maxDelay time.Duration) (Decision, time.Duration) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
+	return tb.reserve(time.Now(), maxQueue, maxDelay)
+}
+
+// reserve is Reserve at now, must be called with locked mutex
+func (tb *TokenBucket) reserve(now time.Time, maxQueue int, maxDelay time.Duration) (Decision, time.Duration) {
+	tb.refill(now)
+
 	if tb.available >= 1 {
 		tb.available--
-		return true
+		return NewDecision(true, tb.capacity, tb.available, tb.ratePerSec), 0
+	}
+
+	queued := int(math.Ceil(-tb.available))
+	delay := tokensDuration(1-tb.available, tb.ratePerSec)
+	if tb.ratePerSec <= 0 || queued >= maxQueue || delay > maxDelay {
+		return NewDecision(false, tb.capacity, tb.available, tb.ratePerSec), 0
+	}
+
+	tb.available--
+	return NewDecision(true, tb.capacity, tb.available, tb.ratePerSec), delay
+}
+
+// CancelReservation returns a token of a request that stopped waiting
+func (tb *TokenBucket) CancelReservation() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.available = min(tb.available+1, float64(tb.capacity))
+}
+
+// LastUsed returns time of the last check or update of a bucket
+func (tb *TokenBucket) LastUsed() time.Time {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return tb.lastRefill
+}
+
+// IsIdle checks if a bucket was not used for ttl and is full, so it is no different from a new one
+func (tb *TokenBucket) IsIdle(now time.Time, ttl time.Duration) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	elapsed := now.Sub(tb.lastRefill)
+	if elapsed < ttl {
+		return false
 	}
-	return false
+	return tb.available+elapsed.Seconds()*tb.ratePerSec >= float64(tb.capacity)
 }
 
-// Stop stops all refill goroutines
-func (tb *TokenBucket) Stop() {
-	close(tb.stopChan)
+func (tb *TokenBucket) Algorithm() string {
+	return AlgorithmTokenBucket
 }
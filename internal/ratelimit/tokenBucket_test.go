@@ -0,0 +1,296 @@
+package ratelimit
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tickerTokenBucket is the token bucket as it was before lazy refill: every bucket has a goroutine
+// that refills it by a ticker. It is kept here to compare the cost of both approaches
+type tickerTokenBucket struct {
+	capacity   int
+	ratePerSec float64
+	available  float64
+	lastRefill time.Time
+	ticker     *time.Ticker
+	stopChan   chan struct{}
+	mu         sync.Mutex
+}
+
+func newTickerTokenBucket(capacity int, ratePerSec float64) *tickerTokenBucket {
+	tb := &tickerTokenBucket{
+		capacity:   capacity,
+		ratePerSec: ratePerSec,
+		available:  float64(capacity),
+		lastRefill: time.Now(),
+		stopChan:   make(chan struct{}),
+	}
+	tb.ticker = time.NewTicker(tickerRefillInterval(ratePerSec))
+
+	go tb.startRefiller()
+	return tb
+}
+
+func tickerRefillInterval(ratePerSec float64) time.Duration {
+	if ratePerSec >= 10 {
+		return time.Millisecond * 100
+	} else if ratePerSec >= 1 {
+		return time.Second / time.Duration(ratePerSec)
+	}
+	return time.Second
+}
+
+func (tb *tickerTokenBucket) startRefiller() {
+	for {
+		select {
+		case <-tb.ticker.C:
+			tb.refill()
+		case <-tb.stopChan:
+			tb.ticker.Stop()
+			return
+		}
+	}
+}
+
+func (tb *tickerTokenBucket) refill() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	elapsed := time.Since(tb.lastRefill).Seconds()
+	tb.available = min(tb.available+elapsed*tb.ratePerSec, float64(tb.capacity))
+	tb.lastRefill = time.Now()
+}
+
+func (tb *tickerTokenBucket) UpdateConfig(newCapacity int, newRatePerSec float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	elapsed := time.Since(tb.lastRefill).Seconds()
+	tb.available += elapsed * tb.ratePerSec
+
+	tb.ratePerSec = newRatePerSec
+	tb.capacity = newCapacity
+
+	if tb.available > float64(tb.capacity) {
+		tb.available = float64(tb.capacity)
+	} else if tb.available < 0 {
+		tb.available = 0
+	}
+
+	tb.ticker.Reset(tickerRefillInterval(newRatePerSec))
+	tb.lastRefill = time.Now()
+}
+
+func (tb *tickerTokenBucket) Allow() Decision {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	allowed := tb.available >= 1
+	if allowed {
+		tb.available--
+	}
+	return NewDecision(allowed, tb.capacity, tb.available, tb.ratePerSec)
+}
+
+func (tb *tickerTokenBucket) Stop() {
+	close(tb.stopChan)
+}
+
+// bucketState gives access to a state of both bucket implementations, so the same cases run against them
+type bucketState struct {
+	allow  func() Decision
+	update func(capacity int, ratePerSec float64)
+	state  func() (available float64, capacity int, ratePerSec float64)
+	// rewind moves the last refill back in time, as if d has passed since it
+	rewind func(d time.Duration)
+}
+
+func lazyBucketState(_ *testing.T, capacity int, ratePerSec float64) bucketState {
+	tb := NewTokenBucket(capacity, ratePerSec)
+	return bucketState{
+		allow:  tb.Allow,
+		update: tb.UpdateConfig,
+		state: func() (float64, int, float64) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+			return tb.available, tb.capacity, tb.ratePerSec
+		},
+		rewind: func(d time.Duration) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+			tb.lastRefill = tb.lastRefill.Add(-d)
+		},
+	}
+}
+
+func tickerBucketState(t *testing.T, capacity int, ratePerSec float64) bucketState {
+	tb := newTickerTokenBucket(capacity, ratePerSec)
+	// refills by the ticker would make the test depend on timing, only UpdateConfig refills the bucket
+	tb.Stop()
+
+	return bucketState{
+		allow:  tb.Allow,
+		update: tb.UpdateConfig,
+		state: func() (float64, int, float64) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+			return tb.available, tb.capacity, tb.ratePerSec
+		},
+		rewind: func(d time.Duration) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+			tb.lastRefill = tb.lastRefill.Add(-d)
+		},
+	}
+}
+
+// TestTokenBucketUpdateConfig checks that UpdateConfig of the lazy bucket works as the ticker-based one did:
+// tokens earned before the update are counted with the old rate, available tokens are kept
+// and clamped to the new capacity
+func TestTokenBucketUpdateConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		capacity      int
+		rate          float64
+		spend         int           // tokens taken before the update
+		elapsed       time.Duration // time passed between the spending and the update
+		newCapacity   int
+		newRate       float64
+		wantAvailable float64
+	}{
+		{
+			name: "full bucket shrinks to new capacity", capacity: 10, rate: 1,
+			newCapacity: 5, newRate: 1, wantAvailable: 5,
+		},
+		{
+			name: "grown bucket is not filled", capacity: 10, rate: 1, spend: 4,
+			newCapacity: 20, newRate: 1, wantAvailable: 6,
+		},
+		{
+			name: "tokens before update are earned with old rate", capacity: 10, rate: 2, spend: 10, elapsed: 2 * time.Second,
+			newCapacity: 10, newRate: 100, wantAvailable: 4,
+		},
+		{
+			name: "earned tokens are clamped to new capacity", capacity: 10, rate: 5, spend: 10, elapsed: time.Second,
+			newCapacity: 3, newRate: 1, wantAvailable: 3,
+		},
+		{
+			name: "zero rate stops refill", capacity: 10, rate: 0, spend: 3, elapsed: time.Hour,
+			newCapacity: 10, newRate: 0, wantAvailable: 7,
+		},
+	}
+
+	implementations := []struct {
+		name      string
+		newBucket func(t *testing.T, capacity int, ratePerSec float64) bucketState
+	}{
+		{"lazy", lazyBucketState},
+		{"ticker", tickerBucketState},
+	}
+
+	for _, impl := range implementations {
+		for _, tt := range tests {
+			t.Run(impl.name+"/"+tt.name, func(t *testing.T) {
+				tb := impl.newBucket(t, tt.capacity, tt.rate)
+				for range tt.spend {
+					if !tb.allow().Allowed {
+						t.Fatal("full bucket denied a request")
+					}
+				}
+
+				tb.rewind(tt.elapsed)
+				tb.update(tt.newCapacity, tt.newRate)
+
+				available, capacity, rate := tb.state()
+				// a few microseconds pass between the calls, they may add a tiny share of a token
+				if math.Abs(available-tt.wantAvailable) > 0.01 {
+					t.Fatalf("available = %v, want %v", available, tt.wantAvailable)
+				}
+				if capacity != tt.newCapacity || rate != tt.newRate {
+					t.Fatalf("config = (%d, %v), want (%d, %v)", capacity, rate, tt.newCapacity, tt.newRate)
+				}
+
+				// the bucket is refilled with the new rate after the update
+				tb.rewind(time.Second)
+				tb.update(tt.newCapacity, tt.newRate)
+				want := min(tt.wantAvailable+tt.newRate, float64(tt.newCapacity))
+				if available, _, _ := tb.state(); math.Abs(available-want) > 0.01 {
+					t.Fatalf("available a second after the update = %v, want %v", available, want)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkTokenBucketAllow compares throughput of Allow of a single bucket
+func BenchmarkTokenBucketAllow(b *testing.B) {
+	b.Run("lazy", func(b *testing.B) {
+		tb := NewTokenBucket(math.MaxInt32, 1e9)
+		for b.Loop() {
+			tb.Allow()
+		}
+	})
+	b.Run("ticker", func(b *testing.B) {
+		tb := newTickerTokenBucket(math.MaxInt32, 1e9)
+		defer tb.Stop()
+		for b.Loop() {
+			tb.Allow()
+		}
+	})
+	b.Run("lazy/parallel", func(b *testing.B) {
+		tb := NewTokenBucket(math.MaxInt32, 1e9)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				tb.Allow()
+			}
+		})
+	})
+	b.Run("ticker/parallel", func(b *testing.B) {
+		tb := newTickerTokenBucket(math.MaxInt32, 1e9)
+		defer tb.Stop()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				tb.Allow()
+			}
+		})
+	})
+}
+
+// BenchmarkNewTokenBucket compares the cost of a bucket: allocations, goroutines and their stacks.
+// Ticker-based buckets are kept alive until the end of the benchmark, as they are in a storage
+func BenchmarkNewTokenBucket(b *testing.B) {
+	b.Run("lazy", func(b *testing.B) {
+		buckets := make([]*TokenBucket, 0, b.N)
+		measureBuckets(b, func() { buckets = append(buckets, NewTokenBucket(100, 10)) })
+		runtime.KeepAlive(buckets)
+	})
+	b.Run("ticker", func(b *testing.B) {
+		buckets := make([]*tickerTokenBucket, 0, b.N)
+		measureBuckets(b, func() { buckets = append(buckets, newTickerTokenBucket(100, 10)) })
+		for _, tb := range buckets {
+			tb.Stop()
+		}
+	})
+}
+
+// measureBuckets runs newBucket b.N times and reports goroutines and stack memory per bucket
+func measureBuckets(b *testing.B, newBucket func()) {
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	b.ResetTimer()
+	for range b.N {
+		newBucket()
+	}
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(b.N), "goroutines/op")
+	b.ReportMetric(float64(after.StackInuse-before.StackInuse)/float64(b.N), "stack-B/op")
+}